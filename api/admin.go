@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// adminUsers are the user ids allowed to call the admin endpoints, from SPINUP_ADMIN_USERS.
+var adminUsers = map[string]bool{}
+
+type userUsage struct {
+	UserID   string
+	Clusters int
+	Ports    []int
+}
+
+// AdminListUsers lists every user with clusters on this host and the ports they hold.
+// Like the other admin handlers, it relies on RequireScope to check the caller.
+func AdminListUsers(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	users, err := store.Users()
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: listing users %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	usages := []userUsage{}
+	for _, u := range users {
+		clusters, err := store.ListClusters(u)
+		if err != nil {
+			logger(req.Context()).Printf("ERROR: reading clusters of %s %v", u, err)
+			http.Error(w, "Internal server error ", 500)
+			return
+		}
+		usage := userUsage{UserID: u, Ports: []int{}}
+		for _, c := range clusters {
+			usage.Clusters++
+			usage.Ports = append(usage.Ports, c.Port)
+		}
+		sort.Ints(usage.Ports)
+		usages = append(usages, usage)
+	}
+	jsonBody, err := json.Marshal(usages)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling user usages %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
+
+// ExportClusters streams the metadata of every cluster as newline delimited JSON, one
+// clusterInfo per line, for backups or moving to another store.
+func ExportClusters(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err := store.EachCluster(func(c clusterInfo) error {
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+		if n++; flusher != nil && n%100 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// the status is already sent, so the client only sees a truncated export
+		logger(req.Context()).Printf("ERROR: exporting clusters after %d %v", n, err)
+		return
+	}
+	logger(req.Context()).Printf("INFO: exported %d clusters", n)
+}
+
+type importResponse struct {
+	Imported int
+	// clusters which already exist, by user id and name
+	Skipped int
+}
+
+// ImportClusters reads newline delimited JSON as written by ExportClusters into the store.
+// Clusters which already exist are skipped, so an import can be repeated.
+func ImportClusters(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxUploadBytes))
+	dec.DisallowUnknownFields()
+	var res importResponse
+	for line := 1; ; line++ {
+		var c clusterInfo
+		err := dec.Decode(&c)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err.Error() == "http: request body too large" {
+			http.Error(w, fmt.Sprintf("import must not be larger than %d bytes, %d imported before cluster %d", maxUploadBytes, res.Imported, line), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cluster %d is invalid, %d imported before it: %v", line, res.Imported, err), http.StatusBadRequest)
+			return
+		}
+		if c.UserID == "" || c.Name == "" {
+			http.Error(w, fmt.Sprintf("cluster %d needs a UserID and Name, %d imported before it", line, res.Imported), http.StatusBadRequest)
+			return
+		}
+		err = store.InsertCluster(c)
+		if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			res.Skipped++
+			continue
+		}
+		if err != nil {
+			logger(req.Context()).Printf("ERROR: importing cluster %s of %s %v", c.Name, c.UserID, err)
+			http.Error(w, fmt.Sprintf("Error importing cluster %d, %d imported before it", line, res.Imported), 500)
+			return
+		}
+		res.Imported++
+	}
+	logger(req.Context()).Printf("INFO: imported %d clusters, skipped %d", res.Imported, res.Skipped)
+	jsonBody, err := json.Marshal(res)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling import response %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
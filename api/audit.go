@@ -0,0 +1,95 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// lifecycle events recorded in the audit log
+const (
+	auditCreate = "create"
+	auditDelete = "delete"
+	// a deleted cluster was started again within its retention
+	auditUndelete = "undelete"
+	auditResize   = "resize"
+	// the password of the cluster was set for a credentials download
+	auditCredentials = "credentials"
+	// the cluster was filled with the data of another, named in the detail
+	auditClone = "clone"
+	// settings of the running cluster were changed, listed in the detail
+	auditUpdate = "update"
+	// an uploaded dump was restored into the cluster, its size in the detail
+	auditRestore = "restore"
+)
+
+type auditEvent struct {
+	// the container id of the cluster at the time of the event
+	ClusterID string
+	UserID    string
+	Name      string
+	Event     string
+	// user id of who caused the event, or reaper
+	Actor     string
+	Timestamp int64
+	Detail    string `json:",omitempty"`
+}
+
+// audit records a lifecycle event of the cluster name of userID. The event has already
+// happened, so failing to record it is logged rather than failing the operation.
+func audit(actor, userID, name, clusterID, event, detail string) {
+	err := store.InsertAuditEvent(auditEvent{
+		ClusterID: clusterID,
+		UserID:    userID,
+		Name:      name,
+		Event:     event,
+		Actor:     actor,
+		Timestamp: time.Now().Unix(),
+		Detail:    detail,
+	})
+	if err != nil {
+		log.Printf("ERROR: AUDIT LOG WRITE FAILED, %s of %s of user %s by %s not recorded %v", event, name, userID, actor, err)
+	}
+}
+
+// GetServiceHistory returns the lifecycle events of one of the user's clusters, including
+// clusters which have been deleted since.
+func GetServiceHistory(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	events, err := store.AuditEvents(userId, name)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading history of %s for %s %v", name, userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if len(events) == 0 {
+		// the history predates the audit log if the cluster exists
+		if _, err = store.GetCluster(userId, name); errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "cluster not found", http.StatusNotFound)
+			return
+		}
+	}
+	jsonBody, err := json.Marshal(events)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling history %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// backupDir holds the scheduled backups, in <backupDir>/<userID>/<name>, from SPINUP_BACKUP_DIR.
+// It defaults to the backups directory of SPINUP_DATA_DIR.
+var backupDir string
+
+// backupRetention is how many backups of a cluster are kept, from SPINUP_BACKUP_RETENTION.
+var backupRetention = 7
+
+// backupSem bounds the number of backups running at once, from SPINUP_MAX_CONCURRENT_BACKUPS.
+var backupSem *semaphore.Weighted
+
+// status of the last backup of a cluster as recorded in metadata
+const (
+	backupSucceeded = "succeeded"
+	backupFailed    = "failed"
+)
+
+// backupsRunning are the clusters being backed up, so a backup which runs past the next one
+// isn't started twice.
+var backupsRunning = struct {
+	sync.Mutex
+	clusters map[string]bool
+}{clusters: map[string]bool{}}
+
+// backupsPath is the directory of the backups of a cluster.
+func backupsPath(userID, name string) string {
+	return filepath.Join(backupDir, userID, name)
+}
+
+// StartBackupScheduler backs up the clusters with a BackupSchedule when it is due. The schedules
+// are read from metadata every minute, so they survive restarts, but the minutes spinup wasn't
+// running are not caught up.
+func StartBackupScheduler() {
+	go func() {
+		last := time.Now().UTC().Truncate(time.Minute)
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			// a minute can be skipped when the host was busy or suspended
+			now = time.Now().UTC().Truncate(time.Minute)
+			for t := last.Add(time.Minute); !t.After(now); t = t.Add(time.Minute) {
+				runScheduledBackups(t)
+			}
+			last = now
+		}
+	}()
+}
+
+// runScheduledBackups starts the backups due in the minute of now.
+func runScheduledBackups(now time.Time) {
+	var due []clusterInfo
+	err := store.EachCluster(func(c clusterInfo) error {
+		if c.BackupSchedule == "" || c.DeletedAt != 0 {
+			return nil
+		}
+		schedule, err := parseCron(c.BackupSchedule)
+		if err != nil {
+			log.Printf("WARN: backup schedule of %s of user %s %v", c.Name, c.UserID, err)
+			return nil
+		}
+		if schedule.matches(now) {
+			due = append(due, c)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: reading backup schedules %v", err)
+		return
+	}
+	for _, c := range due {
+		key := c.UserID + "/" + c.Name
+		backupsRunning.Lock()
+		running := backupsRunning.clusters[key]
+		backupsRunning.clusters[key] = true
+		backupsRunning.Unlock()
+		if running {
+			log.Printf("WARN: skipping backup of %s of user %s, the previous one is still running", c.Name, c.UserID)
+			continue
+		}
+		c := c
+		// each backup is a job of the cluster's user, queued for a slot of backupSem
+		doneRunning := func() {
+			backupsRunning.Lock()
+			delete(backupsRunning.clusters, key)
+			backupsRunning.Unlock()
+		}
+		_, err = startJob(context.Background(), c.UserID, jobBackup, c.Name, backupSem, doneRunning, func(ctx context.Context) (interface{}, error) {
+			return runBackup(ctx, c, time.Now().UTC())
+		})
+		if err != nil {
+			log.Printf("ERROR: starting backup job of %s of user %s %v", c.Name, c.UserID, err)
+			doneRunning()
+		}
+	}
+}
+
+// backupResult is the result of a backup job.
+type backupResult struct {
+	// name of the backup, to download it with DownloadBackup
+	File string
+}
+
+// runBackup backs up c, records the outcome in metadata and prunes the backups past
+// backupRetention.
+func runBackup(ctx context.Context, c clusterInfo, now time.Time) (backupResult, error) {
+	status := backupSucceeded
+	path, err := backupCluster(ctx, c, now)
+	if err != nil {
+		status = backupFailed
+		log.Printf("ERROR: backing up %s of user %s %v", c.Name, c.UserID, err)
+	} else {
+		log.Printf("INFO: backed up %s of user %s to %s", c.Name, c.UserID, path)
+		if err := pruneBackups(backupsPath(c.UserID, c.Name), backupRetention); err != nil {
+			log.Printf("ERROR: pruning backups of %s of user %s %v", c.Name, c.UserID, err)
+		}
+	}
+	if err := store.SetLastBackup(c.UserID, c.Name, now.Unix(), status); err != nil {
+		log.Printf("ERROR: recording backup of %s of user %s %v", c.Name, c.UserID, err)
+	}
+	if err != nil {
+		return backupResult{}, err
+	}
+	return backupResult{File: filepath.Base(path)}, nil
+}
+
+// backupCluster writes a dump of c to its backups directory, named after the cluster and now so
+// the names sort by time, with the dumpCommand of its type: a custom format pg_dump of postgres,
+// a mongodump archive of mongo. The dump goes to a temporary file first, so a failed dump never
+// looks like a backup.
+func backupCluster(ctx context.Context, c clusterInfo, now time.Time) (string, error) {
+	dir := backupsPath(c.UserID, c.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, c.Name+"-"+now.Format("20060102T150405Z")+".dump")
+	tmp := filepath.Join(dir, "."+filepath.Base(path)+".partial")
+	t := dbTypes[c.Type]
+	if t.dumpCommand == nil {
+		return "", fmt.Errorf("%s clusters can't be backed up", c.Type)
+	}
+	script := fmt.Sprintf("docker exec %s %s > %s", c.ClusterID, shellWords(t.dumpCommand(c.Username)), shellQuote(tmp))
+	if _, err := runner.Run(ctx, "sh", "-c", script); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// pruneBackups removes the oldest backups in dir until keep are left, and the temporary files
+// of dumps cut short by a restart.
+func pruneBackups(dir string, keep int) error {
+	partials, _ := filepath.Glob(filepath.Join(dir, ".*.partial"))
+	for _, p := range partials {
+		os.Remove(p)
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err = os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// listBackups returns the names of the backups in dir, oldest first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".dump") && !strings.HasPrefix(e.Name(), ".") {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// validateBackupSchedule checks the BackupSchedule of a create, if it has one.
+func validateBackupSchedule(db dbCluster) error {
+	if db.BackupSchedule == "" {
+		return nil
+	}
+	if dbTypes[db.Type].dumpCommand == nil {
+		return fmt.Errorf("BackupSchedule isn't supported for %s", db.Type)
+	}
+	_, err := parseCron(db.BackupSchedule)
+	return err
+}
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// plainShellWord matches the words sh takes as they are.
+var plainShellWord = regexp.MustCompile(`^[A-Za-z0-9_./=:@%+-]+$`)
+
+// shellWords joins args into a sh command line, quoting the words which need it.
+func shellWords(args []string) string {
+	words := make([]string, len(args))
+	for i, a := range args {
+		words[i] = a
+		if !plainShellWord.MatchString(a) {
+			words[i] = shellQuote(a)
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type backupInfo struct {
+	// file name of the backup, which DownloadBackup takes
+	File string
+	Size int64
+	// unix time the backup was taken at
+	CreatedAt int64
+}
+
+// ListBackups lists the backups of a cluster in SPINUP_BACKUP_DIR, oldest first.
+func ListBackups(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	cluster, ok := requestedCluster(w, req)
+	if !ok {
+		return
+	}
+	dir := backupsPath(cluster.UserID, cluster.Name)
+	names, err := listBackups(dir)
+	if err != nil && !os.IsNotExist(err) {
+		logger(req.Context()).Printf("ERROR: listing backups of %s %v", cluster.ClusterID, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	backups := []backupInfo{}
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			// pruned since it was listed
+			continue
+		}
+		backups = append(backups, backupInfo{File: name, Size: fi.Size(), CreatedAt: backupTime(cluster.Name, name, fi.ModTime()).Unix()})
+	}
+	writeJSON(w, req, backups)
+}
+
+// DownloadBackup streams the backup file of a cluster, with support for range requests so an
+// interrupted download can be resumed.
+func DownloadBackup(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	cluster, ok := requestedCluster(w, req)
+	if !ok {
+		return
+	}
+	file := req.URL.Query().Get("file")
+	if !validBackupName(file) {
+		http.Error(w, "file must be the name of a backup from /listbackups", http.StatusBadRequest)
+		return
+	}
+	path := filepath.Join(backupsPath(cluster.UserID, cluster.Name), file)
+	// Lstat so a symlink planted in the directory isn't followed out of it
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		http.Error(w, "backup not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: opening backup %s %v", path, err)
+		http.Error(w, "backup not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+file+`"`)
+	http.ServeContent(w, req, file, fi.ModTime(), f)
+}
+
+// requestedCluster finds the cluster of the name query parameter for the backup handlers, and
+// answers the request itself when it can't.
+func requestedCluster(w http.ResponseWriter, req *http.Request) (clusterInfo, bool) {
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return clusterInfo{}, false
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return clusterInfo{}, false
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return clusterInfo{}, false
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return clusterInfo{}, false
+	}
+	return cluster, true
+}
+
+// validBackupName reports whether file can name a backup: a plain file name, without any path
+// which could lead out of the backups directory, and not one of the temporary files of a dump.
+func validBackupName(file string) bool {
+	return file != "" && file == filepath.Base(file) && !strings.ContainsAny(file, `/\`) &&
+		!strings.HasPrefix(file, ".") && strings.HasSuffix(file, ".dump")
+}
+
+// backupTime is the time a backup of cluster name was taken at, from its file name, or modTime
+// for a file spinup didn't name.
+func backupTime(name, file string, modTime time.Time) time.Time {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(file, name+"-"), ".dump")
+	if t, err := time.Parse("20060102T150405Z", stamp); err == nil {
+		return t
+	}
+	return modTime
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupClusterDumps(t *testing.T) {
+	previous := backupDir
+	backupDir = t.TempDir()
+	t.Cleanup(func() { backupDir = previous })
+	now := time.Date(2026, 10, 15, 3, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		dbType, username, dump string
+	}{
+		{"postgres", "postgres", "docker exec cid pg_dump -Fc -U postgres postgres > "},
+		{"mongo", "root", `docker exec cid sh -c 'exec mongodump --quiet --archive --gzip -u "$MONGO_INITDB_ROOT_USERNAME" -p "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin' > `},
+	} {
+		t.Run(tt.dbType, func(t *testing.T) {
+			c := clusterInfo{UserID: "alice", ClusterID: "cid", Name: tt.dbType, Type: tt.dbType, Username: tt.username}
+			// the fake doesn't run the redirection of the dump, which creates the temporary file
+			dir := backupsPath(c.UserID, c.Name)
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			want := c.Name + "-20261015T030000Z.dump"
+			if err := ioutil.WriteFile(filepath.Join(dir, "."+want+".partial"), []byte("dump"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			fake := &fakeRunner{}
+			useRunner(t, fake)
+			path, err := backupCluster(context.Background(), c, now)
+			if err != nil {
+				t.Fatalf("backupCluster: %v", err)
+			}
+			if filepath.Base(path) != want {
+				t.Errorf("want backup %s, got %s", want, path)
+			}
+			if len(fake.commands) != 1 || !strings.HasPrefix(fake.commands[0], "sh -c "+tt.dump) {
+				t.Errorf("want the dump run as %q, ran %q", tt.dump, fake.commands)
+			}
+		})
+	}
+}
+
+func TestValidateBackupSchedule(t *testing.T) {
+	for _, tt := range []struct {
+		dbType, schedule string
+		ok               bool
+	}{
+		{"postgres", "0 3 * * *", true},
+		{"mongo", "@daily", true},
+		{"mariadb", "0 3 * * *", false},
+		{"mariadb", "", true},
+		{"postgres", "every night", false},
+	} {
+		err := validateBackupSchedule(dbCluster{Type: tt.dbType, BackupSchedule: tt.schedule})
+		if tt.ok != (err == nil) {
+			t.Errorf("schedule %q of %s: want ok %v, got %v", tt.schedule, tt.dbType, tt.ok, err)
+		}
+	}
+}
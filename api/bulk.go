@@ -0,0 +1,291 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// maxBulkCreate bounds the number of services in a single bulk create.
+const maxBulkCreate = 10
+
+// bulkDeleteConcurrency bounds how many clusters a bulk delete tears down at once.
+const bulkDeleteConcurrency = 4
+
+type bulkCreateResult struct {
+	Name    string
+	Status  int
+	Error   string           `json:",omitempty"`
+	Service *serviceResponse `json:",omitempty"`
+}
+
+type bulkCreateResponse struct {
+	Created int
+	Failed  int
+	Results []bulkCreateResult
+}
+
+// BulkCreateService creates several services at once. Every service is created like a single
+// create, so the create semaphore bounds how many are started at the same time. Services are
+// created independently and the response reports the outcome of each.
+func BulkCreateService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	if rejectInMaintenance(w) {
+		return
+	}
+	if !beginCreate(w) {
+		return
+	}
+	defer endCreate()
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	if rejectUnlistedUser(w, userId) {
+		return
+	}
+	var services []service
+	if err = decodeJSONBody(w, req, &services); err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: decoding bulk create body %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if len(services) == 0 || len(services) > maxBulkCreate {
+		http.Error(w, fmt.Sprintf("between 1 and %d services can be created at once", maxBulkCreate), http.StatusBadRequest)
+		return
+	}
+	names := map[string]bool{}
+	for _, s := range services {
+		if s.UserID != userId {
+			logger(req.Context()).Printf("user %s trying to access /bulkcreateservice using jwt userId %s", s.UserID, userId)
+			http.Error(w, "userid doesn't match", http.StatusForbidden)
+			return
+		}
+		if names[s.Db.Name] {
+			http.Error(w, fmt.Sprintf("service %s is requested more than once", s.Db.Name), http.StatusBadRequest)
+			return
+		}
+		names[s.Db.Name] = true
+	}
+
+	res := bulkCreateResponse{Results: make([]bulkCreateResult, len(services))}
+	var wg sync.WaitGroup
+	for i, s := range services {
+		wg.Add(1)
+		go func(i int, s service) {
+			defer wg.Done()
+			result := bulkCreateResult{Name: s.Db.Name, Status: http.StatusOK}
+			serRes, err := createOnce(req.Context(), s)
+			if err != nil {
+				var se *serviceError
+				result.Status, result.Error = 500, "Internal server error"
+				if errors.As(err, &se) {
+					result.Status, result.Error = se.status, se.msg
+				}
+			} else {
+				result.Service = &serRes
+			}
+			res.Results[i] = result
+		}(i, s)
+	}
+	wg.Wait()
+	for _, r := range res.Results {
+		if r.Service != nil {
+			res.Created++
+		} else {
+			res.Failed++
+		}
+	}
+	logger(req.Context()).Printf("INFO: bulk create for user %s created %d failed %d", userId, res.Created, res.Failed)
+	jsonBody, err := json.Marshal(res)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling bulk create response %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
+
+// bulkDeleteRequest selects the clusters of a bulk delete. A cluster must match every filter set.
+type bulkDeleteRequest struct {
+	Tag string
+	// a duration like 24h, matching clusters created longer ago
+	OlderThan string
+	// a docker container state like running or exited
+	State string
+	// required to delete, unless DryRun is set
+	Confirm bool
+	// only lists the clusters which would be deleted
+	DryRun bool
+}
+
+type bulkDeleteResult struct {
+	Name   string
+	Status int
+	Error  string `json:",omitempty"`
+}
+
+type bulkDeleteResponse struct {
+	DryRun  bool
+	Deleted int
+	Failed  int
+	Results []bulkDeleteResult
+}
+
+// BulkDeleteService deletes every cluster of the user matching a filter, e.g. to clean up
+// ephemeral test clusters by tag.
+func BulkDeleteService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	var bd bulkDeleteRequest
+	if err = decodeJSONBody(w, req, &bd); err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: decoding bulk delete body %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if bd.Tag == "" && bd.OlderThan == "" && bd.State == "" {
+		http.Error(w, "at least one of Tag, OlderThan or State is required", http.StatusBadRequest)
+		return
+	}
+	if !bd.Confirm && !bd.DryRun {
+		http.Error(w, "Confirm must be true to delete, or use DryRun", http.StatusBadRequest)
+		return
+	}
+	var olderThan time.Duration
+	if bd.OlderThan != "" {
+		if olderThan, err = time.ParseDuration(bd.OlderThan); err != nil || olderThan <= 0 {
+			http.Error(w, fmt.Sprintf("OlderThan %q must be a positive duration", bd.OlderThan), http.StatusBadRequest)
+			return
+		}
+	}
+	clusters, err := store.ListClusters(userId)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading clusters of %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	now := time.Now()
+	var matched []clusterInfo
+	// clusters whose state couldn't be read for the State filter, reported instead of deleted
+	var unknown []bulkDeleteResult
+	for _, c := range clusters {
+		if bd.Tag != "" && !hasTag(c, bd.Tag) {
+			continue
+		}
+		// clusters from before CreatedAt was recorded have an unknown age
+		if olderThan > 0 && (c.CreatedAt == 0 || now.Sub(time.Unix(c.CreatedAt, 0)) < olderThan) {
+			continue
+		}
+		if bd.State != "" {
+			state, err := containerState(c.ClusterID)
+			if err != nil {
+				logger(req.Context()).Printf("ERROR: reading state of %s of %s %v", c.Name, userId, err)
+				unknown = append(unknown, bulkDeleteResult{Name: c.Name, Status: 500, Error: "Error reading the state of the container, the cluster wasn't deleted"})
+				continue
+			}
+			if state != bd.State {
+				continue
+			}
+		}
+		matched = append(matched, c)
+	}
+
+	res := bulkDeleteResponse{DryRun: bd.DryRun, Results: make([]bulkDeleteResult, len(matched))}
+	if bd.DryRun {
+		for i, c := range matched {
+			res.Results[i] = bulkDeleteResult{Name: c.Name, Status: http.StatusOK}
+		}
+	} else {
+		sem := semaphore.NewWeighted(bulkDeleteConcurrency)
+		var wg sync.WaitGroup
+		for i, c := range matched {
+			wg.Add(1)
+			go func(i int, c clusterInfo) {
+				defer wg.Done()
+				result := bulkDeleteResult{Name: c.Name, Status: http.StatusNoContent}
+				if err := sem.Acquire(req.Context(), 1); err != nil {
+					result.Status, result.Error = http.StatusServiceUnavailable, err.Error()
+					res.Results[i] = result
+					return
+				}
+				defer sem.Release(1)
+				err := removeService(req.Context(), userId, userId, c.Name, false)
+				if errors.Is(err, sql.ErrNoRows) {
+					result.Status, result.Error = http.StatusNotFound, "cluster not found"
+				} else if err != nil {
+					logger(req.Context()).Printf("ERROR: deleting service %s for %s %v", c.Name, userId, err)
+					result.Status, result.Error = 500, "Error deleting service"
+				}
+				res.Results[i] = result
+			}(i, c)
+		}
+		wg.Wait()
+	}
+	res.Results = append(res.Results, unknown...)
+	for _, r := range res.Results {
+		if r.Status == http.StatusNoContent {
+			res.Deleted++
+		} else if r.Status != http.StatusOK {
+			res.Failed++
+		}
+	}
+	if !bd.DryRun {
+		logger(req.Context()).Printf("INFO: bulk delete for user %s deleted %d failed %d", userId, res.Deleted, res.Failed)
+	}
+	jsonBody, err := json.Marshal(res)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling bulk delete response %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
+
+func hasTag(c clusterInfo, tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// containerState returns the docker state of a container, e.g. running or exited.
+func containerState(containerID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	output, err := runner.Run(ctx, "docker", "inspect", "-f", "{{.State.Status}}", containerID)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
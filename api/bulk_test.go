@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateForAnotherUserForbidden(t *testing.T) {
+	token, err := stringToJWT("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+		body    string
+	}{
+		{"/createservice", CreateService, `{"userId":"bob","db":{"name":"db","type":"postgres"}}`},
+		{"/bulkcreateservice", BulkCreateService, `[{"userId":"alice","db":{"name":"one","type":"postgres"}},{"userId":"bob","db":{"name":"two","type":"postgres"}}]`},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			fake := &fakeRunner{}
+			useRunner(t, fake)
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			tt.handler(w, req)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("want 403 for a service of another user, got %d %s", w.Code, w.Body)
+			}
+			if len(fake.commands) != 0 {
+				t.Errorf("want nothing provisioned, ran %q", fake.commands)
+			}
+		})
+	}
+}
+
+func TestBulkDeleteReportsUnknownState(t *testing.T) {
+	for _, c := range []clusterInfo{
+		{UserID: "alice", ClusterID: "exited-container", Name: "stopped", Type: "postgres"},
+		{UserID: "alice", ClusterID: "gone-container", Name: "unknown", Type: "postgres"},
+	} {
+		if err := store.InsertCluster(c); err != nil {
+			t.Fatal(err)
+		}
+		name := c.Name
+		t.Cleanup(func() { store.DeleteCluster("alice", name) })
+	}
+	fake := (&fakeRunner{}).
+		on("inspect -f {{.State.Status}} exited-container", "exited\n", nil).
+		on("inspect -f {{.State.Status}} gone-container", "", errors.New("Error: No such object: gone-container"))
+	useRunner(t, fake)
+	token, err := stringToJWT("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/bulkdeleteservice", strings.NewReader(`{"State":"exited","DryRun":true}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	BulkDeleteService(w, req)
+	var res bulkDeleteResponse
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	statuses := map[string]int{}
+	for _, r := range res.Results {
+		statuses[r.Name] = r.Status
+	}
+	if len(res.Results) != 2 || statuses["stopped"] != http.StatusOK || statuses["unknown"] != http.StatusInternalServerError || res.Failed != 1 {
+		t.Errorf("want stopped listed and unknown reported as failed, got %+v", res)
+	}
+}
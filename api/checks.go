@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/template"
+)
+
+// validateOnly runs the startup checks and prints a report of them instead of starting spinup,
+// with SPINUP_VALIDATE_ONLY=true or the --validate flag.
+var validateOnly bool
+
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	// a problem which doesn't stop spinup, e.g. the Cloudflare token while DNS is disabled
+	checkWarn = "warn"
+)
+
+type checkResult struct {
+	Name   string
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// checkResults are the startup checks in the order they ran.
+var checkResults []checkResult
+
+// check records the result of the startup check name and reports whether it passed. Unless
+// only validating, a failed check stops spinup.
+func check(name string, err error) bool {
+	if err == nil {
+		checkResults = append(checkResults, checkResult{Name: name, Status: checkPass})
+		return true
+	}
+	if !validateOnly {
+		log.Fatalf("FATAL: %v", err)
+	}
+	checkResults = append(checkResults, checkResult{Name: name, Status: checkFail, Error: err.Error()})
+	return false
+}
+
+// warnCheck records a startup check which failed without stopping spinup.
+func warnCheck(name string, err error) {
+	log.Printf("WARN: %v", err)
+	checkResults = append(checkResults, checkResult{Name: name, Status: checkWarn, Error: err.Error()})
+}
+
+// reportChecks prints the startup checks as JSON and exits, with 1 when one of them failed.
+func reportChecks() {
+	report := struct {
+		OK     bool
+		Checks []checkResult
+	}{OK: true, Checks: checkResults}
+	for _, c := range checkResults {
+		if c.Status == checkFail {
+			report.OK = false
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatalf("FATAL: writing validation report %v", err)
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// parseTemplates makes sure the compose template of every type parses.
+func parseTemplates() error {
+	for name, t := range dbTypes {
+		if _, err := template.ParseFS(dockerTempl, "templates/"+t.template); err != nil {
+			return fmt.Errorf("parsing template of %s %v", name, err)
+		}
+	}
+	return nil
+}
+
+func hasArg(arg string) bool {
+	for _, a := range os.Args[1:] {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
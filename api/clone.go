@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// cloneSem bounds the number of clones copying data at once, from SPINUP_MAX_CONCURRENT_CLONES.
+// A copy keeps a pg_dump and a pg_restore busy for as long as the database takes to stream.
+var cloneSem *semaphore.Weighted
+
+type cloneRequest struct {
+	// name of the cluster to copy
+	Source string
+	// name of the new cluster
+	Name string
+}
+
+// cloneEvent is a line of the progress a clone streams back.
+type cloneEvent struct {
+	// one of created, progress, done or error
+	Event string
+	// the new cluster, with created
+	Service *serviceResponse `json:",omitempty"`
+	// a line of pg_restore output, with progress
+	Line  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// CloneService creates a cluster with the version and resources of an existing postgres
+// cluster and copies its data into it with pg_dump and pg_restore. Once the new cluster is up
+// the progress of the copy is streamed as newline delimited JSON, ending with a done or an
+// error event. A clone whose copy fails is removed again.
+func CloneService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	if rejectInMaintenance(w) {
+		return
+	}
+	if !beginCreate(w) {
+		return
+	}
+	// an async clone hands its place in the drain to its job once it started
+	jobStarted := false
+	defer func() {
+		if !jobStarted {
+			endCreate()
+		}
+	}()
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	if rejectUnlistedUser(w, userId) {
+		return
+	}
+	var cr cloneRequest
+	if err = decodeJSONBody(w, req, &cr); err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: decoding clone body %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if cr.Source == "" || cr.Name == "" {
+		http.Error(w, "source and name are required", http.StatusBadRequest)
+		return
+	}
+	source, err := store.GetCluster(userId, cr.Source)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "source cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if source.DeletedAt > 0 {
+		http.Error(w, "source cluster is deleted", http.StatusConflict)
+		return
+	}
+	if source.Type != "postgres" {
+		http.Error(w, "cloning is only supported for postgres", http.StatusBadRequest)
+		return
+	}
+	if req.URL.Query().Get("async") == "true" {
+		// the job is queued until a clone slot is free
+		j, err := startJob(req.Context(), userId, jobClone, cr.Name, cloneSem, endCreate, func(ctx context.Context) (interface{}, error) {
+			return cloneCluster(ctx, userId, source, cr.Name, func(serviceResponse) {}, func(string) {})
+		})
+		if err != nil {
+			logger(req.Context()).Printf("ERROR: starting clone job of %s for %s %v", cr.Name, userId, err)
+			http.Error(w, "Internal server error ", 500)
+			return
+		}
+		jobStarted = true
+		writeJobStarted(w, req, j)
+		return
+	}
+	waitCtx, cancel := context.WithTimeout(req.Context(), createWaitTimeout)
+	defer cancel()
+	if err = cloneSem.Acquire(waitCtx, 1); err != nil {
+		logger(req.Context()).Printf("WARN: no free clone slot for %s within %v", userId, createWaitTimeout)
+		writeServiceError(w, &serviceError{status: http.StatusServiceUnavailable, msg: "too many clusters being cloned, try again later", retryAfter: createWaitTimeout})
+		return
+	}
+	defer cloneSem.Release(1)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(e cloneEvent) {
+		enc.Encode(e)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	created := false
+	_, err = cloneCluster(req.Context(), userId, source, cr.Name, func(serRes serviceResponse) {
+		created = true
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		send(cloneEvent{Event: "created", Service: &serRes})
+	}, func(line string) {
+		send(cloneEvent{Event: "progress", Line: line})
+	})
+	if err != nil && !created {
+		writeServiceError(w, err)
+		return
+	}
+	if err != nil {
+		// the status is already sent, the error event is all the client gets
+		send(cloneEvent{Event: "error", Error: err.Error()})
+		return
+	}
+	send(cloneEvent{Event: "done"})
+}
+
+// cloneCluster creates the clone name of source and copies the data of source into it. The new
+// cluster is handed to onCreated before the copy starts, and every line of its progress to
+// onLine. A clone which doesn't become ready or whose copy fails is removed again. Errors meant
+// for the client are returned as *serviceError.
+func cloneCluster(ctx context.Context, userID string, source clusterInfo, name string, onCreated func(serviceResponse), onLine func(string)) (serviceResponse, error) {
+	serRes, err := createService(ctx, cloneOf(source, name))
+	if err != nil {
+		return serRes, err
+	}
+	if serRes.Ready == nil || !*serRes.Ready {
+		logger(ctx).Printf("ERROR: clone %s of %s not ready within %v", name, userID, maxReadyTimeout)
+		if err = deleteService(context.Background(), userID, userID, name); err != nil {
+			logger(ctx).Printf("ERROR: removing clone %s of %s %v", name, userID, err)
+		}
+		return serRes, &serviceError{status: http.StatusGatewayTimeout, msg: "clone didn't become ready"}
+	}
+	if wasCancelled(ctx) {
+		if err = deleteService(context.Background(), userID, userID, name); err != nil {
+			logger(ctx).Printf("ERROR: removing cancelled clone %s of %s %v", name, userID, err)
+		}
+		return serRes, ctx.Err()
+	}
+	onCreated(serRes)
+	lines := 0
+	err = copyDatabase(ctx, source, serRes.ContainerID, func(line string) {
+		lines++
+		onLine(line)
+	})
+	if err != nil {
+		logger(ctx).Printf("ERROR: copying %s into clone %s of %s %v", source.Name, name, userID, err)
+		if err := deleteService(context.Background(), userID, userID, name); err != nil {
+			logger(ctx).Printf("ERROR: removing clone %s of %s %v", name, userID, err)
+		}
+		if wasCancelled(ctx) {
+			return serRes, ctx.Err()
+		}
+		return serRes, &serviceError{status: http.StatusInternalServerError, msg: "Error copying data, the clone was removed"}
+	}
+	audit(userID, userID, name, serRes.ContainerID, auditClone, fmt.Sprintf("from %s (%s)", source.Name, source.ClusterID))
+	logger(ctx).Printf("INFO: cloned %s into %s for user %s after %d lines of progress", source.Name, name, userID, lines)
+	return serRes, nil
+}
+
+// cloneOf is the service of a clone of source named name. It runs the image of source with the
+// same resources, but gets a record under its own default name.
+func cloneOf(source clusterInfo, name string) service {
+	return service{
+		UserID: source.UserID,
+		Db: dbCluster{
+			Name:           name,
+			Type:           source.Type,
+			Username:       source.Username,
+			Memory:         source.Memory,
+			Storage:        source.Storage,
+			MaxConnections: source.MaxConnections,
+			// pg_restore can only restore the data into a database which can represent it
+			Encoding:   source.Encoding,
+			Locale:     source.Locale,
+			Pooler:     source.PoolerPort != 0,
+			Metrics:    source.MetricsPort != 0,
+			TLS:        source.TLSDir != "",
+			Domain:     source.Domain,
+			Network:    source.Network,
+			Tags:       source.Tags,
+			ClonedFrom: source.ClusterID,
+			image:      source.Image,
+			// pg_dump and pg_restore turn the timeouts off for themselves
+			StatementTimeout:                source.StatementTimeout,
+			IdleInTransactionSessionTimeout: source.IdleInTransactionSessionTimeout,
+		},
+		// the copy needs the server up
+		ReadyTimeout: maxReadyTimeout.String(),
+	}
+}
+
+// copyDatabase streams a custom format pg_dump of source into the postgres container
+// targetID. The dump is piped between the containers without touching spinup's memory or
+// disk, and the verbose output of pg_restore is handed to onLine as it restores. The container
+// ids are hex and the username passed validateUsername, so neither needs quoting.
+func copyDatabase(ctx context.Context, source clusterInfo, targetID string, onLine func(string)) error {
+	database := dbTypes[source.Type].database(source.Username)
+	// sh has no pipefail, but a dump cut short fails pg_restore on the truncated archive
+	script := fmt.Sprintf("docker exec %s pg_dump -Fc -U %s %s | docker exec -i %s pg_restore --verbose --no-owner --exit-on-error -U %s -d %s 2>&1",
+		source.ClusterID, source.Username, database, targetID, source.Username, database)
+	return runLines(ctx, onLine, "sh", "-c", script)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// composeVersion is the version of the compose file format the templates render, from
+// SPINUP_COMPOSE_VERSION.
+var composeVersion = "3.9"
+
+// composeMinimums are the docker-compose 1.x releases which first read each file format.
+// Compose v2 reads all of them.
+var composeMinimums = map[string][3]int{
+	"2":   {1, 6, 0},
+	"2.0": {1, 6, 0},
+	"2.1": {1, 9, 0},
+	"2.2": {1, 13, 0},
+	"2.3": {1, 16, 0},
+	"2.4": {1, 21, 0},
+	"3":   {1, 10, 0},
+	"3.0": {1, 10, 0},
+	"3.1": {1, 11, 0},
+	"3.2": {1, 12, 0},
+	"3.3": {1, 14, 0},
+	"3.4": {1, 16, 0},
+	"3.5": {1, 18, 0},
+	"3.6": {1, 20, 0},
+	"3.7": {1, 22, 0},
+	"3.8": {1, 25, 5},
+	"3.9": {1, 27, 0},
+}
+
+func validateComposeVersion(v string) error {
+	if _, ok := composeMinimums[v]; ok {
+		return nil
+	}
+	var known []string
+	for k := range composeMinimums {
+		known = append(known, k)
+	}
+	sort.Strings(known)
+	return fmt.Errorf("SPINUP_COMPOSE_VERSION must be one of %s, got %q", strings.Join(known, ", "), v)
+}
+
+// composeBinaryVersion is the release of the docker-compose spinup runs, e.g. 1.29.2 or v2.20.2.
+func composeBinaryVersion(ctx context.Context) ([3]int, error) {
+	var version [3]int
+	output, err := runner.Run(ctx, "docker-compose", "version", "--short")
+	if err != nil {
+		return version, err
+	}
+	short := strings.TrimPrefix(strings.TrimSpace(string(output)), "v")
+	parts := strings.SplitN(short, ".", 3)
+	for i, p := range parts {
+		// a pre-release like 2.0.0-rc.3 only counts by its digits
+		if j := strings.IndexFunc(p, func(r rune) bool { return r < '0' || r > '9' }); j >= 0 {
+			p = p[:j]
+		}
+		if version[i], err = strconv.Atoi(p); err != nil {
+			return version, fmt.Errorf("docker-compose version %q isn't a release", short)
+		}
+	}
+	return version, nil
+}
+
+// checkComposeVersion makes sure docker-compose release have reads composeVersion files.
+func checkComposeVersion(have [3]int) error {
+	need := composeMinimums[composeVersion]
+	for i := range have {
+		if have[i] != need[i] {
+			if have[i] > need[i] {
+				return nil
+			}
+			return fmt.Errorf("docker-compose %d.%d.%d doesn't read compose file version %s, set SPINUP_COMPOSE_VERSION or upgrade to %d.%d.%d", have[0], have[1], have[2], composeVersion, need[0], need[1], need[2])
+		}
+	}
+	return nil
+}
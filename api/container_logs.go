@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// containerLogDriver is the docker log driver of the containers of clusters, from
+// SPINUP_CONTAINER_LOG_DRIVER. The daemon's default applies when it is empty.
+var containerLogDriver string
+
+// containerLogOptions are the options of containerLogDriver, from SPINUP_CONTAINER_LOG_OPTS.
+var containerLogOptions map[string]string
+
+// logDrivers are the log drivers docker ships with. Plugins are named like images, with a slash.
+var logDrivers = map[string]bool{
+	"none": true, "local": true, "json-file": true, "syslog": true, "journald": true,
+	"gelf": true, "fluentd": true, "awslogs": true, "splunk": true, "etwlogs": true,
+	"gcplogs": true, "logentries": true,
+}
+
+var logOptionKey = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+func validateLogDriver(driver string) error {
+	if logDrivers[driver] || strings.Contains(driver, "/") {
+		return nil
+	}
+	return fmt.Errorf("SPINUP_CONTAINER_LOG_DRIVER %q is neither a built in log driver nor a plugin", driver)
+}
+
+// parseLogOptions parses comma separated key=value options, e.g. max-size=10m,max-file=3.
+// docker-compose checks them against the driver when a cluster is created.
+func parseLogOptions(v string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("log option %q must be key=value", entry)
+		}
+		key := strings.TrimSpace(entry[:i])
+		if !logOptionKey.MatchString(key) {
+			return nil, fmt.Errorf("log option %q is not a valid key", key)
+		}
+		options[key] = strings.TrimSpace(entry[i+1:])
+	}
+	return options, nil
+}
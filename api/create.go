@@ -1,27 +1,34 @@
 package api
 
 import (
-	"bytes"
 	"context"
 	"crypto/rsa"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/golang-jwt/jwt"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/sync/semaphore"
 )
 
 var authToken, zoneID, projectDir, architecture string
+
+// dataDir holds the data of every cluster. It defaults to projectDir but can be put on a faster disk.
+var dataDir string
 var api *cloudflare.API
 var privKeyPath, pubKeyPath string
 var (
@@ -29,36 +36,534 @@ var (
 	signKey   *rsa.PrivateKey
 )
 
+// createSem bounds the number of docker-compose ups running at once. Image pulls
+// are heavy on disk and network, so this is kept separate from port allocation.
+var createSem *semaphore.Weighted
+
+// createWaitTimeout is how long a create waits for a free slot before giving up with a 503.
+var createWaitTimeout = 30 * time.Second
+
+// maxTotalClusters caps the clusters on this host across all users, from
+// SPINUP_MAX_TOTAL_CLUSTERS. 0 means no cap.
+var maxTotalClusters int
+
+var (
+	clusterMu sync.Mutex
+	// pendingClusters counts the creates which passed the cap but aren't in the store yet
+	pendingClusters int
+)
+
+var errClusterLimit = errors.New("the maximum number of clusters is reached")
+
+var errPortsOccupied = errors.New("error all allocated ports are occupied")
+
+// the ports clusters get, from firstPort up to but not including endPort
+const (
+	firstPort = 5432
+	endPort   = 5440
+)
+
+var (
+	portMu sync.Mutex
+	// reservedPorts holds ports handed out by allocatePort whose containers haven't bound them yet
+	reservedPorts = map[int]struct{}{}
+)
+
+// metricsBindAddress is the host address the port of an exporter is published on, from
+// SPINUP_METRICS_BIND_ADDRESS. The exporter doesn't authenticate scrapes, so only the host
+// reaches it unless the address of another interface is set.
+var metricsBindAddress = "127.0.0.1"
+
 func init() {
 	var ok bool
 	var err error
+	validateOnly = os.Getenv("SPINUP_VALIDATE_ONLY") == "true" || hasArg("--validate")
+	if envFile, ok = os.LookupEnv("SPINUP_ENV_FILE"); ok {
+		if err = loadEnvFile(envFile); err != nil {
+			err = fmt.Errorf("reading SPINUP_ENV_FILE %v", err)
+		}
+		check("SPINUP_ENV_FILE", err)
+	}
+	if v, ok := os.LookupEnv("SPINUP_LOG_OUTPUT"); ok {
+		w, err := logOutput(v)
+		if err != nil {
+			err = fmt.Errorf("opening SPINUP_LOG_OUTPUT %v", err)
+		}
+		// the report of a validation goes to stdout, so the logs stay where they are
+		if check("SPINUP_LOG_OUTPUT", err) && !validateOnly {
+			setLogOutput(v, w)
+		}
+	}
 	if projectDir, ok = os.LookupEnv("SPINUP_PROJECT_DIR"); !ok {
-		log.Fatalf("FATAL: getting environment variable SPINUP_PROJECT_DIR")
+		check("SPINUP_PROJECT_DIR", fmt.Errorf("getting environment variable SPINUP_PROJECT_DIR"))
+	}
+	if dataDir, ok = os.LookupEnv("SPINUP_DATA_DIR"); !ok {
+		dataDir = projectDir
+	}
+	writable := projectDir != "" && check("writable "+projectDir, checkWritable(projectDir))
+	backupDir = filepath.Join(dataDir, "backups")
+	if v, ok := os.LookupEnv("SPINUP_BACKUP_DIR"); ok {
+		backupDir = v
+		check("writable "+backupDir, checkWritable(backupDir))
+	}
+	if dataDir != projectDir {
+		check("writable "+dataDir, checkWritable(dataDir))
+	}
+	if v, ok := os.LookupEnv("SPINUP_LAYOUT"); ok {
+		if v != layoutFlat && v != layoutType {
+			check("SPINUP_LAYOUT", fmt.Errorf("SPINUP_LAYOUT must be flat or type, got %q", v))
+		}
+		layout = v
+	}
+	if v, ok := os.LookupEnv("SPINUP_METADATA_SHARDS"); ok {
+		var shards []Store
+		for _, path := range strings.Split(v, ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			shard, err := newSqliteStore(path)
+			if err != nil {
+				err = fmt.Errorf("opening metadata shard %s %v", path, err)
+			}
+			if check("metadata shard "+path, err) {
+				shards = append(shards, shard)
+			}
+		}
+		if len(shards) == 0 {
+			check("SPINUP_METADATA_SHARDS", fmt.Errorf("SPINUP_METADATA_SHARDS must list at least one database"))
+		} else {
+			store = newShardedStore(shards)
+		}
+	} else if writable {
+		if store, err = newSqliteStore(filepath.Join(projectDir, "spinup.db")); err != nil {
+			store = nil
+			err = fmt.Errorf("opening metadata store %v", err)
+		}
+		check("metadata store", err)
+	}
+	if store != nil {
+		if err = importLegacyClusters(store); err != nil {
+			err = fmt.Errorf("importing legacy cluster metadata %v", err)
+		}
+		check("legacy cluster metadata", err)
+		if err = store.FailRunningJobs(time.Now().Unix(), errJobInterrupted); err != nil {
+			err = fmt.Errorf("failing interrupted jobs %v", err)
+		}
+		check("jobs", err)
 	}
 	if architecture, ok = os.LookupEnv("ARCHITECTURE"); !ok {
-		log.Fatalf("FATAL: getting environment variable ARCHITECTURE")
+		check("ARCHITECTURE", fmt.Errorf("getting environment variable ARCHITECTURE"))
+	}
+	if v, ok := os.LookupEnv("SPINUP_DNS_PROVIDER"); ok {
+		dnsProviderName = v
 	}
-	if authToken, ok = os.LookupEnv("CF_AUTHORIZATION_TOKEN"); !ok {
-		log.Fatalf("FATAL: getting environment variable CF_AUTHORIZATION_TOKEN")
+	switch dnsProviderName {
+	case "cloudflare":
+		if authToken, ok = os.LookupEnv("CF_AUTHORIZATION_TOKEN"); !ok {
+			check("CF_AUTHORIZATION_TOKEN", fmt.Errorf("getting environment variable CF_AUTHORIZATION_TOKEN"))
+		}
+		if zoneID, ok = os.LookupEnv("CF_ZONE_ID"); !ok {
+			check("CF_ZONE_ID", fmt.Errorf("getting environment variable CF_ZONE_ID"))
+		}
+		api, err = cloudflare.NewWithAPIToken(authToken,
+			cloudflare.HTTPClient(&http.Client{Transport: cloudflareTransport}),
+			cloudflare.UsingRetryPolicy(0, 0, 0),
+		)
+		if err != nil {
+			api = nil
+			err = fmt.Errorf("creating new cloudflare client %v", err)
+		} else {
+			dnsProvider = cloudflareProvider{api: api}
+		}
+		check("cloudflare client", err)
+	case "route53", "webhook":
+		if zoneID, ok = os.LookupEnv("SPINUP_DNS_ZONE_ID"); !ok {
+			check("SPINUP_DNS_ZONE_ID", fmt.Errorf("getting environment variable SPINUP_DNS_ZONE_ID"))
+		}
+		if dnsProviderName == "route53" {
+			var p *route53Provider
+			if p, err = newRoute53Provider(); err == nil {
+				dnsProvider = p
+			}
+		} else {
+			var p *webhookProvider
+			if p, err = newWebhookProvider(os.Getenv("SPINUP_DNS_WEBHOOK_URL"), os.Getenv("SPINUP_DNS_WEBHOOK_TOKEN")); err == nil {
+				dnsProvider = p
+			}
+		}
+		check(dnsProviderName+" DNS provider", err)
+	default:
+		check("SPINUP_DNS_PROVIDER", fmt.Errorf("SPINUP_DNS_PROVIDER must be one of cloudflare, route53 or webhook, got %q", dnsProviderName))
 	}
-	if zoneID, ok = os.LookupEnv("CF_ZONE_ID"); !ok {
-		log.Fatalf("FATAL: getting environment variable CF_ZONE_ID")
+	maxCreates := 2
+	if v, ok := os.LookupEnv("SPINUP_MAX_CONCURRENT_CREATES"); ok {
+		if maxCreates, err = strconv.Atoi(v); err != nil || maxCreates < 1 {
+			maxCreates = 2
+			check("SPINUP_MAX_CONCURRENT_CREATES", fmt.Errorf("SPINUP_MAX_CONCURRENT_CREATES must be a positive integer, got %q", v))
+		}
 	}
-	api, err = cloudflare.NewWithAPIToken(authToken)
-	if err != nil {
-		log.Fatalf("FATAL: creating new cloudflare client %v", err)
+	createSem = semaphore.NewWeighted(int64(maxCreates))
+	maxClones := 1
+	if v, ok := os.LookupEnv("SPINUP_MAX_CONCURRENT_CLONES"); ok {
+		if maxClones, err = strconv.Atoi(v); err != nil || maxClones < 1 {
+			maxClones = 1
+			check("SPINUP_MAX_CONCURRENT_CLONES", fmt.Errorf("SPINUP_MAX_CONCURRENT_CLONES must be a positive integer, got %q", v))
+		}
+	}
+	cloneSem = semaphore.NewWeighted(int64(maxClones))
+	maxBackups := 1
+	if v, ok := os.LookupEnv("SPINUP_MAX_CONCURRENT_BACKUPS"); ok {
+		if maxBackups, err = strconv.Atoi(v); err != nil || maxBackups < 1 {
+			maxBackups = 1
+			check("SPINUP_MAX_CONCURRENT_BACKUPS", fmt.Errorf("SPINUP_MAX_CONCURRENT_BACKUPS must be a positive integer, got %q", v))
+		}
+	}
+	backupSem = semaphore.NewWeighted(int64(maxBackups))
+	if v, ok := os.LookupEnv("SPINUP_MAX_UPLOAD_BYTES"); ok {
+		if maxUploadBytes, err = strconv.ParseInt(v, 10, 64); err != nil || maxUploadBytes < 1 {
+			maxUploadBytes = 1 << 30
+			check("SPINUP_MAX_UPLOAD_BYTES", fmt.Errorf("SPINUP_MAX_UPLOAD_BYTES must be a positive integer, got %q", v))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_ALLOWED_NETWORKS"); ok {
+		for _, network := range strings.Split(v, ",") {
+			if network = strings.TrimSpace(network); network == "" {
+				continue
+			}
+			if !volumeName.MatchString(network) {
+				check("SPINUP_ALLOWED_NETWORKS", fmt.Errorf("SPINUP_ALLOWED_NETWORKS %q is not a valid docker network name", network))
+			}
+			allowedNetworks[network] = true
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_HEALTH_PORT_THRESHOLD"); ok {
+		if healthPortThreshold, err = strconv.Atoi(v); err != nil || healthPortThreshold < 1 || healthPortThreshold > 100 {
+			healthPortThreshold = 90
+			check("SPINUP_HEALTH_PORT_THRESHOLD", fmt.Errorf("SPINUP_HEALTH_PORT_THRESHOLD must be a percentage from 1 to 100, got %q", v))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_BACKUP_RETENTION"); ok {
+		if backupRetention, err = strconv.Atoi(v); err != nil || backupRetention < 1 {
+			backupRetention = 7
+			check("SPINUP_BACKUP_RETENTION", fmt.Errorf("SPINUP_BACKUP_RETENTION must be a positive integer, got %q", v))
+		}
+	}
+	queueCreates = os.Getenv("SPINUP_QUEUE_CREATES") == "true"
+	if v, ok := os.LookupEnv("SPINUP_QUEUE_DEPTH"); ok {
+		if queueDepth, err = strconv.Atoi(v); err != nil || queueDepth < 1 {
+			check("SPINUP_QUEUE_DEPTH", fmt.Errorf("SPINUP_QUEUE_DEPTH must be a positive integer, got %q", v))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_QUEUE_TIMEOUT"); ok {
+		if queueTimeout, err = time.ParseDuration(v); err != nil || queueTimeout <= 0 {
+			check("SPINUP_QUEUE_TIMEOUT", fmt.Errorf("SPINUP_QUEUE_TIMEOUT must be a positive duration, got %q", v))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_MAX_TOTAL_CLUSTERS"); ok {
+		if maxTotalClusters, err = strconv.Atoi(v); err != nil || maxTotalClusters < 0 {
+			check("SPINUP_MAX_TOTAL_CLUSTERS", fmt.Errorf("SPINUP_MAX_TOTAL_CLUSTERS must be a non negative integer, got %q", v))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_ADMIN_USERS"); ok {
+		for _, u := range strings.Split(v, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				adminUsers[u] = true
+			}
+		}
+	}
+	dnsEnabled = os.Getenv("SPINUP_DNS_ENABLED") == "true"
+	lengths := []struct {
+		name string
+		dst  *int
+	}{
+		{"SPINUP_MAX_NAME_LENGTH", &maxNameLength},
+		{"SPINUP_MAX_USERID_LENGTH", &maxUserIDLength},
+	}
+	for _, l := range lengths {
+		v, ok := os.LookupEnv(l.name)
+		if !ok {
+			continue
+		}
+		// a directory name can't be longer
+		if *l.dst, err = strconv.Atoi(v); err != nil || *l.dst < 1 || *l.dst > 255 {
+			check(l.name, fmt.Errorf("%s must be an integer from 1 to 255, got %q", l.name, v))
+		}
+	}
+	if dnsEnabled && maxUserIDLength+1+maxNameLength > 63 {
+		warnCheck("name lengths", fmt.Errorf("record names <userid>-<name> can be longer than a DNS label of 63 characters, use db.subdomain for long names"))
+	}
+	dnsFailHard = os.Getenv("SPINUP_DNS_FAIL_HARD") == "true"
+	if v, ok := os.LookupEnv("SPINUP_PUBLIC_IP"); ok {
+		if v == "auto" {
+			publicIPAuto = true
+			if v, err = detectPublicIP(); err != nil {
+				err = fmt.Errorf("detecting SPINUP_PUBLIC_IP %v", err)
+			} else {
+				log.Printf("INFO: detected public ip %s", v)
+			}
+			check("SPINUP_PUBLIC_IP", err)
+		} else if net.ParseIP(v) == nil {
+			check("SPINUP_PUBLIC_IP", fmt.Errorf("SPINUP_PUBLIC_IP %q is not an ip address", v))
+		}
+		if v != "" {
+			setPublicIP(v)
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_DNS_VERIFY_TIMEOUT"); ok {
+		if dnsVerifyTimeout, err = time.ParseDuration(v); err != nil || dnsVerifyTimeout < 0 {
+			check("SPINUP_DNS_VERIFY_TIMEOUT", fmt.Errorf("SPINUP_DNS_VERIFY_TIMEOUT must be a non negative duration, got %q", v))
+		}
+	}
+	dnsVerifyBlock = os.Getenv("SPINUP_DNS_VERIFY_BLOCK") == "true"
+	if v, ok := os.LookupEnv("SPINUP_DOMAIN"); ok {
+		domain = v
+	}
+	if v, ok := os.LookupEnv("SPINUP_DNS_NAME_TEMPLATE"); ok && v != "" {
+		if dnsNameTemplate, err = parseDNSNameTemplate(v); err != nil {
+			check("SPINUP_DNS_NAME_TEMPLATE", fmt.Errorf("parsing SPINUP_DNS_NAME_TEMPLATE %v", err))
+		}
+	}
+	zones[domain] = zoneID
+	if v, ok := os.LookupEnv("SPINUP_DNS_ZONES_FILE"); ok {
+		loaded, err := loadZones(v)
+		if err != nil {
+			err = fmt.Errorf("loading SPINUP_DNS_ZONES_FILE %v", err)
+		}
+		for d, id := range loaded {
+			if d == domain && id != zoneID {
+				err = fmt.Errorf("SPINUP_DNS_ZONES_FILE has zone %s for %s, which %s sets to %s", id, d, zoneIDVariable(), zoneID)
+				break
+			}
+			zones[d] = id
+		}
+		check("SPINUP_DNS_ZONES_FILE", err)
+	}
+	if dnsProvider != nil {
+		if err = checkDNSProvider(context.Background()); err != nil && !dnsEnabled {
+			warnCheck(dnsProviderName+" DNS provider", fmt.Errorf("%v, DNS records can't be created if DNS is enabled", err))
+		} else {
+			check(dnsProviderName+" DNS provider", err)
+		}
+	}
+	debugBodies = os.Getenv("SPINUP_DEBUG_BODIES") == "true"
+	if debugBodies {
+		log.Println("WARN: SPINUP_DEBUG_BODIES is set, request and response bodies are logged")
+	}
+	if v, ok := os.LookupEnv("SPINUP_PULL_POLICY"); ok {
+		if v != pullAlways && v != pullMissing && v != pullNever {
+			check("SPINUP_PULL_POLICY", fmt.Errorf("SPINUP_PULL_POLICY must be one of always, missing or never, got %q", v))
+		}
+		pullPolicy = v
+	}
+	if v, ok := os.LookupEnv("SPINUP_REAP_INTERVAL"); ok {
+		if reapInterval, err = time.ParseDuration(v); err != nil {
+			check("SPINUP_REAP_INTERVAL", fmt.Errorf("parsing SPINUP_REAP_INTERVAL %v", err))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_STOP_TIMEOUT"); ok {
+		if stopTimeout, err = time.ParseDuration(v); err != nil {
+			check("SPINUP_STOP_TIMEOUT", fmt.Errorf("parsing SPINUP_STOP_TIMEOUT %v", err))
+		} else if stopTimeout < time.Second {
+			check("SPINUP_STOP_TIMEOUT", fmt.Errorf("SPINUP_STOP_TIMEOUT must be at least 1s, got %v", stopTimeout))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_DELETE_RETENTION"); ok {
+		if deleteRetention, err = time.ParseDuration(v); err != nil {
+			check("SPINUP_DELETE_RETENTION", fmt.Errorf("parsing SPINUP_DELETE_RETENTION %v", err))
+		}
+		if deleteRetention > 0 && reapInterval <= 0 {
+			warnCheck("SPINUP_DELETE_RETENTION", errors.New("deleted clusters are never purged without SPINUP_REAP_INTERVAL"))
+		}
 	}
 
-	signBytes, err := ioutil.ReadFile(projectDir + "/app.rsa")
-	fatal(err)
+	portOwnerCheck = os.Getenv("SPINUP_PORT_OWNER_CHECK") != "false"
+	if v, ok := os.LookupEnv("SPINUP_PORT_SCAN_ADDRS"); ok {
+		portScanAddrs = nil
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			if net.ParseIP(addr) == nil {
+				check("SPINUP_PORT_SCAN_ADDRS", fmt.Errorf("SPINUP_PORT_SCAN_ADDRS %q is not an ip address", addr))
+			}
+			portScanAddrs = append(portScanAddrs, addr)
+		}
+		if len(portScanAddrs) == 0 {
+			check("SPINUP_PORT_SCAN_ADDRS", fmt.Errorf("SPINUP_PORT_SCAN_ADDRS must list at least one address"))
+		}
+	}
+	dockerContext = os.Getenv("DOCKER_CONTEXT")
+	dockerHost, err = remoteDockerHost(context.Background())
+	check("docker endpoint", err)
+	if dockerHost != "" && publicIPAuto {
+		warnCheck("SPINUP_PUBLIC_IP", fmt.Errorf("SPINUP_PUBLIC_IP=auto detects the address of this host, not of the docker host %s", dockerHost))
+	}
+	if dockerHost != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = checkDockerHost(ctx)
+		cancel()
+		check("docker host", err)
+		log.Printf("INFO: clusters run on docker host %s", dockerHost)
+		// the clusters publish their ports there rather than on this host
+		if _, ok := os.LookupEnv("SPINUP_PORT_SCAN_ADDRS"); !ok {
+			portScanAddrs = []string{dockerHost}
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_CONTENT_ENCODINGS"); ok {
+		contentEncodings = map[string]bool{}
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.ToLower(strings.TrimSpace(e)); e == "" {
+				continue
+			}
+			if e != "gzip" {
+				check("SPINUP_CONTENT_ENCODINGS", fmt.Errorf("SPINUP_CONTENT_ENCODINGS only supports gzip, got %q", e))
+			}
+			contentEncodings[e] = true
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_PRESETS_FILE"); ok {
+		if presets, err = loadPresets(v); err != nil {
+			err = fmt.Errorf("loading SPINUP_PRESETS_FILE %v", err)
+		}
+		check("SPINUP_PRESETS_FILE", err)
+	}
+	if certFile, ok := os.LookupEnv("SPINUP_TLS_CA_CERT"); ok {
+		if tlsCA, err = loadTLSCA(certFile, os.Getenv("SPINUP_TLS_CA_KEY")); err != nil {
+			err = fmt.Errorf("loading SPINUP_TLS_CA_CERT %v", err)
+		}
+		check("SPINUP_TLS_CA_CERT", err)
+	}
+	requireSignedUploads = os.Getenv("SPINUP_REQUIRE_SIGNED_UPLOADS") == "true"
+	if v, ok := os.LookupEnv("SPINUP_UPLOAD_PUBLIC_KEY"); ok {
+		if uploadKey, err = loadUploadKey(v); err != nil {
+			err = fmt.Errorf("loading SPINUP_UPLOAD_PUBLIC_KEY %v", err)
+		}
+		check("SPINUP_UPLOAD_PUBLIC_KEY", err)
+	} else if requireSignedUploads {
+		check("SPINUP_UPLOAD_PUBLIC_KEY", fmt.Errorf("SPINUP_REQUIRE_SIGNED_UPLOADS needs SPINUP_UPLOAD_PUBLIC_KEY"))
+	}
+	if v, ok := os.LookupEnv("SPINUP_DEFAULT_MEMORY"); ok {
+		if defaultMemory, err = parseTypeDefaults("memory", v); err != nil {
+			err = fmt.Errorf("parsing SPINUP_DEFAULT_MEMORY %v", err)
+		}
+		check("SPINUP_DEFAULT_MEMORY", err)
+	}
+	if v, ok := os.LookupEnv("SPINUP_DEFAULT_STORAGE"); ok {
+		if defaultStorage, err = parseTypeDefaults("storage", v); err != nil {
+			err = fmt.Errorf("parsing SPINUP_DEFAULT_STORAGE %v", err)
+		}
+		check("SPINUP_DEFAULT_STORAGE", err)
+	}
+	allowLatestVersion = os.Getenv("SPINUP_ALLOW_LATEST_VERSION") == "true"
+	if v, ok := os.LookupEnv("SPINUP_IMAGES_FILE"); ok {
+		if imageOverrides, err = loadImageOverrides(v); err != nil {
+			err = fmt.Errorf("loading SPINUP_IMAGES_FILE %v", err)
+		}
+		check("SPINUP_IMAGES_FILE", err)
+	}
+	for name, t := range dbTypes {
+		env := "SPINUP_DEFAULT_" + strings.ToUpper(name) + "_VERSION"
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		db := dbCluster{Type: name, Version: v}
+		if err = parseVersion(&db); err == nil {
+			err = t.resolveVersion(name, &db)
+		}
+		if err != nil {
+			check(env, fmt.Errorf("%s %v", env, err))
+			continue
+		}
+		defaultVersions[name] = v
+	}
+	for name, d := range map[string]*time.Duration{
+		"SPINUP_READY_TIMEOUT":       &readyTimeout,
+		"SPINUP_READY_INITIAL_DELAY": &readyInitialDelay,
+		"SPINUP_READY_INTERVAL":      &readyInterval,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			if *d, err = time.ParseDuration(v); err != nil || *d < 0 {
+				check(name, fmt.Errorf("%s must be a non negative duration, got %q", name, v))
+			}
+		}
+	}
+	if readyInterval <= 0 {
+		readyInterval = time.Second
+		check("SPINUP_READY_INTERVAL", fmt.Errorf("SPINUP_READY_INTERVAL must be positive"))
+	}
+	if v, ok := os.LookupEnv("SPINUP_READY_CHECK"); ok {
+		if v != readyTCP && v != readyQuery {
+			check("SPINUP_READY_CHECK", fmt.Errorf("SPINUP_READY_CHECK must be tcp or query, got %q", v))
+		}
+		readyCheck = v
+	}
+	if v, ok := os.LookupEnv("SPINUP_JWT_USER_CLAIM"); ok {
+		if v = strings.TrimSpace(v); v == "" {
+			check("SPINUP_JWT_USER_CLAIM", fmt.Errorf("SPINUP_JWT_USER_CLAIM must not be empty"))
+		}
+		jwtUserClaim = v
+	}
+	if v, ok := os.LookupEnv("SPINUP_JWT_LEEWAY"); ok {
+		if jwtLeeway, err = time.ParseDuration(v); err != nil || jwtLeeway < 0 {
+			check("SPINUP_JWT_LEEWAY", fmt.Errorf("SPINUP_JWT_LEEWAY must be a non negative duration, got %q", v))
+		}
+	}
+	check("templates", parseTemplates())
+	if v, ok := os.LookupEnv("SPINUP_CONTAINER_LOG_DRIVER"); ok {
+		if err = validateLogDriver(v); err == nil {
+			containerLogDriver = v
+		}
+		check("SPINUP_CONTAINER_LOG_DRIVER", err)
+	}
+	if v, ok := os.LookupEnv("SPINUP_CONTAINER_LOG_OPTS"); ok {
+		if containerLogDriver == "" {
+			check("SPINUP_CONTAINER_LOG_OPTS", fmt.Errorf("SPINUP_CONTAINER_LOG_OPTS needs SPINUP_CONTAINER_LOG_DRIVER"))
+		} else if containerLogOptions, err = parseLogOptions(v); err != nil {
+			check("SPINUP_CONTAINER_LOG_OPTS", fmt.Errorf("parsing SPINUP_CONTAINER_LOG_OPTS %v", err))
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_METRICS_BIND_ADDRESS"); ok {
+		// the short port syntax of compose only takes IPv4 addresses
+		if ip := net.ParseIP(v); ip == nil || ip.To4() == nil {
+			check("SPINUP_METRICS_BIND_ADDRESS", fmt.Errorf("SPINUP_METRICS_BIND_ADDRESS %q is not an IPv4 address", v))
+		} else {
+			metricsBindAddress = v
+		}
+	}
+	if v, ok := os.LookupEnv("SPINUP_COMPOSE_VERSION"); ok {
+		if err = validateComposeVersion(v); err == nil {
+			composeVersion = v
+		}
+		check("SPINUP_COMPOSE_VERSION", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	composeRelease, err := composeBinaryVersion(ctx)
+	cancel()
+	if err != nil {
+		// docker-compose may only be installed later, creates fail loudly without it
+		warnCheck("compose file version", fmt.Errorf("reading docker-compose version %v", err))
+	} else {
+		check("compose file version", checkComposeVersion(composeRelease))
+		profilesSupported = composeRelease[0] > 1 || composeRelease[1] >= 28
+	}
 
-	signKey, err = jwt.ParseRSAPrivateKeyFromPEM(signBytes)
-	fatal(err)
-	verifyBytes, err := ioutil.ReadFile(projectDir + "/app.rsa.pub")
-	fatal(err)
+	applyReloadable()
 
-	verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
-	fatal(err)
+	signBytes, err := ioutil.ReadFile(filepath.Join(projectDir, "app.rsa"))
+	if err == nil {
+		signKey, err = jwt.ParseRSAPrivateKeyFromPEM(signBytes)
+	}
+	check("signing key", err)
+	verifyBytes, err := ioutil.ReadFile(filepath.Join(projectDir, "app.rsa.pub"))
+	if err == nil {
+		verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+	}
+	check("verification key", err)
+	if validateOnly {
+		check("docker", ValidateSystemRequirements())
+		reportChecks()
+	}
 	log.Println("INFO: initial validations successful")
 }
 
@@ -69,6 +574,15 @@ type service struct {
 	Architecture string
 	//Port         uint
 	Db dbCluster
+	// optional docker-compose override merged on top of the generated file
+	ComposeOverride string
+	// base64 detached signature of ComposeOverride, required with SPINUP_REQUIRE_SIGNED_UPLOADS
+	ComposeOverrideSignature string
+	// how long to wait for the cluster to become ready, e.g. 10s, instead of SPINUP_READY_TIMEOUT
+	ReadyTimeout string
+	// keeps what a create provisioned when it fails after starting the containers, instead of
+	// removing it again; ?bestEffort=true of /createservice
+	bestEffort bool
 }
 
 type dbCluster struct {
@@ -78,96 +592,636 @@ type dbCluster struct {
 	Port       int
 	MajVersion uint
 	MinVersion uint
-	Memory     string
-	Storage    string
+	// instead of MajVersion and MinVersion, <major>, <major>.<minor> or latest
+	Version string
+	// set when only the major version was requested
+	majorOnly bool
+	Memory    string
+	Storage   string
+	// superuser of the cluster, defaults to postgres or root for mariadb
+	Username string
+	// runs pgbouncer in front of the cluster on a port of its own
+	Pooler bool
+	// runs a prometheus exporter of the cluster on a port of its own, postgres only
+	Metrics bool
+	// compose profiles of the template to start the optional services of, e.g. pooler
+	Profiles []string
+	// name of the DNS record instead of <userID>-<dbName>
+	Subdomain string
+	// base domain of the DNS record, one of SPINUP_DNS_ZONES_FILE instead of SPINUP_DOMAIN
+	Domain string
+	// runs mongo as a single member replica set, for transactions and change streams
+	ReplicaSet bool
+	// postgres max_connections, the server default when 0
+	MaxConnections int
+	// character set and locale of a new postgres cluster, e.g. UTF8 and en_US.UTF-8, the
+	// image defaults when empty. initdb applies them once, they can't change afterwards.
+	Encoding string
+	Locale   string
+	// cron expression of scheduled backups in UTC, e.g. "0 3 * * *", postgres and mongo only
+	BackupSchedule string
+	// postgres statement_timeout and idle_in_transaction_session_timeout as durations like
+	// 30s, the server defaults when empty. /updateservice changes them later.
+	StatementTimeout                string
+	IdleInTransactionSessionTimeout string
+	// name of the preset the settings left out are taken from
+	Preset string
+	// free form labels to find the cluster by, e.g. for a bulk delete
+	Tags []string
+	// existing docker network the cluster is attached to besides its own, e.g. the one of an
+	// app's compose project. It has to be in SPINUP_ALLOWED_NETWORKS.
+	Network string
+	// docker volume holding the data of the cluster instead of a new data directory, e.g.
+	// from another system. spinup doesn't remove it with the cluster.
+	ExistingVolume string
+	// serves TLS with a certificate signed by SPINUP_TLS_CA_CERT or a self-signed one,
+	// postgres only
+	TLS bool
+	// UID:GID the database runs as instead of the default user of the image. The data
+	// directory is owned by it.
+	RunAsUser string
+	// CPUs reserved for the cluster, e.g. "1.5". Docker has no hard reservation outside of
+	// swarm, so it is rendered as the cpu_shares weight the cluster gets when the host's CPU is
+	// contended, relative to containers with the default of one CPU. It doesn't cap the cluster.
+	CPUs string
+	// host cores the cluster is pinned to, e.g. "0-1,3"
+	CPUSet string
+	// set by spinup, not by the request
+	PoolerPort     int    `json:"-"`
+	MetricsPort    int    `json:"-"`
+	DNSStatus      string `json:"-"`
+	DNSReady       bool   `json:"-"`
+	ComposeProject string `json:"-"`
+	ClonedFrom     string `json:"-"`
+	// image a clone runs instead of the one of its version, the image of its source
+	image string
+	// password of the superuser, generated for every create
+	password string
+}
+
+func (db dbCluster) timeouts() pgTimeouts {
+	return pgTimeouts{db.StatementTimeout, db.IdleInTransactionSessionTimeout}
 }
 
 type serviceResponse struct {
-	HostName    string
-	Port        int
-	ContainerID string
+	HostName         string
+	Port             int
+	ContainerID      string
+	ConnectionString string
+	// empty when DNS is disabled, otherwise created or pending
+	DNSStatus string `json:",omitempty"`
+	// whether the record resolved in time, only set when the create waited for it
+	DNSReady *bool `json:",omitempty"`
+	// only set when the cluster has a pooler
+	PoolerPort             int    `json:",omitempty"`
+	PoolerConnectionString string `json:",omitempty"`
+	// only set when the cluster has a metrics exporter, the URL prometheus scrapes
+	MetricsPort int    `json:",omitempty"`
+	MetricsURL  string `json:",omitempty"`
+	// whether the cluster became ready in time, only set when the create waited for it
+	Ready *bool `json:",omitempty"`
+	// the version the cluster runs, e.g. 14 or 14.1, after presets and defaults
+	Version string
+	// the memory limit and storage of the cluster, after presets and defaults
+	Memory  string `json:",omitempty"`
+	Storage string `json:",omitempty"`
+	// PEM of the CA the cluster's certificate is verified with, only set with TLS
+	CACert string `json:",omitempty"`
+	// password of the superuser. spinup doesn't return it again, /credentials sets a new one.
+	Password string `json:",omitempty"`
+	// where containers on the cluster's docker networks reach it without the published port:
+	// its alias on db.network, or else its address on its own network
+	InternalHost string `json:",omitempty"`
+	InternalPort int    `json:",omitempty"`
 }
 
+// Hello greets in plain text, or with the service, its version and the endpoints to discover
+// it with when the client asks for JSON.
 func Hello(w http.ResponseWriter, req *http.Request) {
+	if prefersJSON(req) {
+		writeJSON(w, req, helloResponse{
+			Service: "spinup",
+			Version: Version,
+			Links:   map[string]string{"health": "/health", "version": "/version", "dbtypes": "/dbtypes"},
+		})
+		return
+	}
 	fmt.Fprintf(w, "hello !! Welcome to spinup \n")
 }
 
+// serviceError is returned while creating a service for errors the client should see, with
+// the status code to report them with.
+type serviceError struct {
+	status int
+	msg    string
+	// sent as Retry-After when set
+	retryAfter time.Duration
+}
+
+func (e *serviceError) Error() string {
+	return e.msg
+}
+
+func writeServiceError(w http.ResponseWriter, err error) {
+	var se *serviceError
+	if !errors.As(err, &se) {
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if se.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(se.retryAfter.Seconds())))
+	}
+	http.Error(w, se.msg, se.status)
+}
+
 func CreateService(w http.ResponseWriter, req *http.Request) {
-	if (*req).Method != "POST" {
-		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	if rejectInMaintenance(w) {
 		return
 	}
+	if !beginCreate(w) {
+		return
+	}
+	// an async create hands its place in the drain to its job once it started
+	jobStarted := false
+	defer func() {
+		if !jobStarted {
+			endCreate()
+		}
+	}()
 	authHeader := req.Header.Get("Authorization")
 	userId, err := validateToken(authHeader)
 	if err != nil {
-		log.Printf("error validating token %v", err)
-		http.Error(w, "error validating token", 500)
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	if rejectUnlistedUser(w, userId) {
+		return
 	}
 	var s service
-	byteArray, err := ioutil.ReadAll(req.Body)
+	body, err := requestBody(w, req, maxJSONBody)
 	if err != nil {
-		log.Fatalf("fatal: reading from readall body %v", err)
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: reading request body %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	byteArray, err := ioutil.ReadAll(body)
+	if errors.Is(err, errBodyTooLarge) || (err != nil && err.Error() == "http: request body too large") {
+		http.Error(w, "Request body must not be larger than 1MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading from readall body %v", err)
+		http.Error(w, "error reading request body", http.StatusBadRequest)
+		return
 	}
 	err = json.Unmarshal(byteArray, &s)
 	if err != nil {
-		log.Fatalf("fatal: reading from readall body %v", err)
+		logger(req.Context()).Printf("ERROR: unmarshalling request body %v", err)
+		http.Error(w, "request body is not a valid service", http.StatusBadRequest)
+		return
 	}
 	if s.UserID != userId {
-		log.Printf("user %s trying to access /createservice using jwt userId %s", s.UserID, userId)
-		http.Error(w, "userid doesn't match", http.StatusInternalServerError)
+		logger(req.Context()).Printf("user %s trying to access /createservice using jwt userId %s", s.UserID, userId)
+		http.Error(w, "userid doesn't match", http.StatusForbidden)
 		return
 	}
-	if s.Db.Type != "postgres" {
-		fmt.Fprintf(w, "currently we don't support %s", s.Db.Type)
-		http.Error(w, "db type is currently not supported", 500)
+	s.bestEffort = req.URL.Query().Get("bestEffort") == "true"
+	if req.URL.Query().Get("async") == "true" {
+		j, err := startJob(req.Context(), userId, jobCreate, s.Db.Name, nil, endCreate, func(ctx context.Context) (interface{}, error) {
+			return createOnce(ctx, s)
+		})
+		if err != nil {
+			logger(req.Context()).Printf("ERROR: recording create job of %s for %s %v", s.Db.Name, userId, err)
+			http.Error(w, "Internal server error ", 500)
+			return
+		}
+		jobStarted = true
+		writeJobStarted(w, req, j)
 		return
 	}
-	s.Db.Port, err = portcheck()
-	s.Architecture = architecture
-	servicePath := projectDir + "/" + s.UserID + "/" + s.Db.Name
-	if err = prepareService(s, servicePath); err != nil {
-		log.Printf("ERROR: preparing service for %s %v", s.UserID, err)
-		http.Error(w, "Error preparing service", 500)
+	serRes, err := createOnce(req.Context(), s)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
-	if err = startService(s, servicePath); err != nil {
-		log.Printf("ERROR: starting service for %s %v", s.UserID, err)
-		http.Error(w, "Error starting service", 500)
+	jsonBody, err := json.Marshal(serRes)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling service response struct serviceResponse %v", err)
+		http.Error(w, "Internal server error ", 500)
 		return
 	}
-	log.Printf("INFO: created service for user %s", s.UserID)
-	/* err = connectService(s)
+	w.Write(jsonBody)
+}
+
+// createService validates s, provisions the cluster and records it in the store. Errors meant
+// for the client are returned as *serviceError.
+func createService(ctx context.Context, s service) (serviceResponse, error) {
+	var serRes serviceResponse
+	if err := validateName("userid", s.UserID, maxUserIDLength); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateName("name", s.Db.Name, maxNameLength); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := parseVersion(&s.Db); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := applyPreset(&s.Db); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	t, ok := dbTypes[s.Db.Type]
+	if !ok {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: fmt.Sprintf("currently we don't support %s", s.Db.Type)}
+	}
+	if err := applyDefaultVersion(&s.Db); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := t.resolveVersion(s.Db.Type, &s.Db); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	applyDefaults(&s.Db)
+	if s.Db.Username == "" {
+		s.Db.Username = t.defaultUsername
+	}
+	if err := t.validateUser(s.Db.Username); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateProfiles(t, &s.Db); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if s.Db.Pooler && !t.pooler {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: fmt.Sprintf("a pooler isn't supported for %s", s.Db.Type)}
+	}
+	if s.Db.Metrics && !t.metrics {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: fmt.Sprintf("metrics aren't supported for %s", s.Db.Type)}
+	}
+	if err := validateTags(s.Db.Tags); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateMaxConnections(s.Db); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	encoding, err := validateEncoding(s.Db)
 	if err != nil {
-		log.Printf("ERROR: connecting service for %s %v", s.UserID, err)
-		http.Error(w, "Error connecting service", 500)
-		return
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	s.Db.Encoding = encoding
+	if err := validateBackupSchedule(s.Db); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validatePGTimeouts(s.Db.Type, s.Db.timeouts()); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateSize("memory", s.Db.Memory); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateSize("storage", s.Db.Storage); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateCPUs(s.Db.CPUs, s.Db.CPUSet); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateExistingVolume(ctx, s.Db.ExistingVolume); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if _, _, err := parseRunAsUser(s.Db.RunAsUser); err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if err := validateNetwork(ctx, s.Db.Network); errors.Is(err, errNetworkNotAllowed) {
+		return serRes, &serviceError{status: http.StatusForbidden, msg: err.Error()}
+	} else if err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	readyWait, err := parseReadyTimeout(s.ReadyTimeout)
+	if err != nil {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if s.Db.ReplicaSet && !t.replicaSet {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: fmt.Sprintf("a replica set isn't supported for %s", s.Db.Type)}
+	}
+	if s.Db.TLS && !t.tls {
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: fmt.Sprintf("TLS isn't supported for %s", s.Db.Type)}
+	}
+	if s.Db.TLS && s.Db.RunAsUser != "" {
+		// the key is handed to the postgres user by an entrypoint which runs as root
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: "runAsUser can't be used with TLS"}
+	}
+	if s.Db.ReplicaSet && s.Db.RunAsUser != "" {
+		// the keyfile is handed to the mongodb user by an entrypoint which runs as root
+		return serRes, &serviceError{status: http.StatusBadRequest, msg: "runAsUser can't be used with a replica set"}
+	}
+	if _, err := store.GetCluster(s.UserID, s.Db.Name); err == nil {
+		return serRes, &serviceError{status: http.StatusConflict, msg: "cluster with this name already exists"}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		logger(ctx).Printf("ERROR: reading cluster info for %s %v", s.UserID, err)
+		return serRes, err
+	}
+	if s.Db.Domain != "" {
+		if !dnsEnabled {
+			return serRes, &serviceError{status: http.StatusBadRequest, msg: "a domain can only be set when DNS is enabled"}
+		}
+		s.Db.Domain = strings.ToLower(s.Db.Domain)
+		if _, ok := zones[s.Db.Domain]; !ok {
+			return serRes, &serviceError{status: http.StatusBadRequest, msg: fmt.Sprintf("domain %q isn't one of the configured zones", s.Db.Domain)}
+		}
+	}
+	if s.Db.Subdomain != "" {
+		if !dnsEnabled {
+			return serRes, &serviceError{status: http.StatusBadRequest, msg: "a subdomain can only be set when DNS is enabled"}
+		}
+		s.Db.Subdomain = strings.ToLower(s.Db.Subdomain)
+		if err := validateSubdomain(s.Db.Subdomain); err != nil {
+			return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+		taken, err := subdomainTaken(ctx, s)
+		if err != nil {
+			logger(ctx).Printf("ERROR: looking up subdomain %s %v", s.Db.Subdomain, err)
+			return serRes, &serviceError{status: http.StatusServiceUnavailable, msg: "Error looking up subdomain"}
+		}
+		if taken {
+			return serRes, &serviceError{status: http.StatusConflict, msg: fmt.Sprintf("subdomain %s is already taken", s.Db.Subdomain)}
+		}
+	} else if dnsEnabled && dnsNameTemplate != nil {
+		if s.Db.Subdomain, err = templatedDNSName(s); err != nil {
+			return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+	}
+	if s.ComposeOverride != "" {
+		if err := verifyUpload("composeOverride", []byte(s.ComposeOverride), s.ComposeOverrideSignature); err != nil {
+			logger(ctx).Printf("ERROR: unverified compose override for %s %v", s.UserID, err)
+			return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+		if err := validateOverride(s.ComposeOverride); err != nil {
+			logger(ctx).Printf("ERROR: invalid compose override for %s %v", s.UserID, err)
+			return serRes, &serviceError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+	}
+	if err := reserveCluster(); err != nil {
+		logger(ctx).Printf("ERROR: reserving cluster for %s %v", s.UserID, err)
+		if err == errClusterLimit {
+			return serRes, &serviceError{status: http.StatusServiceUnavailable, msg: "the host can't take more clusters"}
+		}
+		return serRes, &serviceError{status: 500, msg: "Internal server error "}
+	}
+	defer releaseCluster()
+	s.Db.Port, err = allocatePort(ctx)
+	if err != nil {
+		logger(ctx).Printf("ERROR: allocating port for %s %v", s.UserID, err)
+		return serRes, &serviceError{status: http.StatusServiceUnavailable, msg: "no free port available"}
 	}
-	err = internal.UpdateTunnelClientYml(s.Db.Name, s.Db.Port)
+	defer releasePort(s.Db.Port)
+	if s.Db.Pooler {
+		s.Db.PoolerPort, err = allocatePort(ctx)
+		if err != nil {
+			logger(ctx).Printf("ERROR: allocating pooler port for %s %v", s.UserID, err)
+			return serRes, &serviceError{status: http.StatusServiceUnavailable, msg: "no free port available for the pooler"}
+		}
+		defer releasePort(s.Db.PoolerPort)
+	}
+	if s.Db.Metrics {
+		s.Db.MetricsPort, err = allocatePort(ctx)
+		if err != nil {
+			logger(ctx).Printf("ERROR: allocating metrics port for %s %v", s.UserID, err)
+			return serRes, &serviceError{status: http.StatusServiceUnavailable, msg: "no free port available for the metrics exporter"}
+		}
+		defer releasePort(s.Db.MetricsPort)
+	}
+	s.Architecture = architecture
+	s.Db.ComposeProject = composeProject(s.UserID, s.Db.Name)
+	if s.Db.password, err = newPassword(); err != nil {
+		logger(ctx).Printf("ERROR: generating password for %s %v", s.UserID, err)
+		return serRes, err
+	}
+	path := servicePath(s.UserID, s.Db.Type, s.Db.Name)
+	waitCtx, cancel := context.WithTimeout(ctx, createWaitTimeout)
+	defer cancel()
+	if err = createSem.Acquire(waitCtx, 1); err != nil {
+		logger(ctx).Printf("WARN: no free create slot for %s within %v", s.UserID, createWaitTimeout)
+		return serRes, &serviceError{status: http.StatusServiceUnavailable, msg: "too many clusters being created, try again later", retryAfter: createWaitTimeout}
+	}
+	// a cancelled job stops between the stages below and removes what it provisioned so far
+	cancelled := func() bool {
+		if !wasCancelled(ctx) {
+			return false
+		}
+		logger(ctx).Printf("INFO: create of %s for %s cancelled, removing it", s.Db.Name, s.UserID)
+		abandonCreate(ctx, s, path)
+		return true
+	}
+	if wasCancelled(ctx) {
+		createSem.Release(1)
+		return serRes, ctx.Err()
+	}
+	// the slot covers the image pulls of prepareService as well
+	if err = prepareService(s, path); err != nil {
+		createSem.Release(1)
+		logger(ctx).Printf("ERROR: preparing service for %s %v", s.UserID, err)
+		var ie *imageError
+		if errors.As(err, &ie) && ie.missing {
+			return serRes, &serviceError{status: http.StatusServiceUnavailable, msg: ie.Error()}
+		}
+		if errors.As(err, &ie) {
+			return serRes, &serviceError{status: http.StatusBadGateway, msg: fmt.Sprintf("Error pulling image %s", ie.image)}
+		}
+		return serRes, &serviceError{status: 500, msg: "Error preparing service"}
+	}
+	if cancelled() {
+		createSem.Release(1)
+		return serRes, ctx.Err()
+	}
+	// from here on containers may run, so a failure removes the cluster again rather than
+	// leaving it running without metadata, unless the client asked to keep it
+	failed := func(err error) (serviceResponse, error) {
+		if s.bestEffort {
+			logger(ctx).Printf("WARN: keeping failed create of %s for %s, bestEffort is set", s.Db.Name, s.UserID)
+			return serRes, err
+		}
+		logger(ctx).Printf("INFO: create of %s for %s failed, removing it", s.Db.Name, s.UserID)
+		abandonCreate(ctx, s, path)
+		return serRes, err
+	}
+	// not the request's context, a client going away must not stop docker-compose half way
+	err = startService(context.Background(), s, path)
+	createSem.Release(1)
 	if err != nil {
-		log.Printf("ERROR: updating tunnel client for %s %v", s.UserID, err)
+		logger(ctx).Printf("ERROR: starting service for %s %v", s.UserID, err)
+		return failed(&serviceError{status: 500, msg: "Error starting service"})
+	}
+	if cancelled() {
+		return serRes, ctx.Err()
+	}
+	logger(ctx).Printf("INFO: created service for user %s", s.UserID)
+	serRes.HostName = hostName()
+	if dnsEnabled {
+		if err = connectService(ctx, s); err != nil {
+			if dnsFailHard {
+				logger(ctx).Printf("ERROR: connecting service for %s %v", s.UserID, err)
+				if errors.Is(err, errDNSConflict) {
+					return failed(&serviceError{status: http.StatusConflict, msg: fmt.Sprintf("DNS record %s already points elsewhere", recordName(s))})
+				}
+				return failed(&serviceError{status: 500, msg: "Error connecting service"})
+			}
+			// the container is up, so the cluster is still usable through the raw host and port
+			logger(ctx).Printf("WARN: connecting service for %s, DNS is pending %v", s.UserID, err)
+			s.Db.DNSStatus = dnsPending
+		} else {
+			s.Db.DNSStatus = dnsCreated
+			serRes.HostName = recordName(s)
+			if dnsVerifyTimeout > 0 && dnsVerifyBlock {
+				s.Db.DNSReady = verifyDNS(ctx, s)
+				serRes.DNSReady = &s.Db.DNSReady
+			}
+		}
+	}
+	/* err = internal.UpdateTunnelClientYml(s.Db.Name, s.Db.Port)
+	if err != nil {
+		logger(ctx).Printf("ERROR: updating tunnel client for %s %v", s.UserID, err)
 		http.Error(w, "Error updating tunnel client", 500)
 		return
 	} */
-	containerID, err := lastContainerID()
+	if cancelled() {
+		return serRes, ctx.Err()
+	}
+	containerID, err := serviceContainerID(ctx, path, s.Db.ComposeProject, t.service)
 	if err != nil {
-		log.Printf("ERROR: getting container id %v", err)
-		http.Error(w, "Error getting container id", 500)
-		return
+		logger(ctx).Printf("ERROR: getting container id %v", err)
+		return failed(&serviceError{status: 500, msg: "Error getting container id"})
 	}
 	s.Db.ID = containerID
-	var serRes serviceResponse
-	//serRes.HostName = s.UserID + "-" + s.Db.Name + ".spinup.host"
-	serRes.HostName = "localhost"
+	// in-network clients can fall back to the published port, so this isn't worth failing over
+	if serRes.InternalHost, err = internalHost(ctx, s); err != nil {
+		logger(ctx).Printf("WARN: getting internal address of %s %v", s.Db.Name, err)
+	} else {
+		serRes.InternalPort = t.port
+	}
+	if readyWait > 0 {
+		// the container is up either way, a client can poll describe until it's ready
+		ready := waitForReady(ctx, s, readyWait)
+		if !ready {
+			logger(ctx).Printf("WARN: %s of %s not ready within %v", s.Db.Name, s.UserID, readyWait)
+		}
+		serRes.Ready = &ready
+	}
+	if cancelled() {
+		return serRes, ctx.Err()
+	}
 	serRes.Port = s.Db.Port
+	serRes.DNSStatus = s.Db.DNSStatus
+	serRes.Version = versionOf(s.Db)
+	serRes.Memory, serRes.Storage = s.Db.Memory, s.Db.Storage
 	serRes.ContainerID = containerID
-	jsonBody, err := json.Marshal(serRes)
+	serRes.Password = s.Db.password
+	serRes.ConnectionString = fmt.Sprintf("%s://%s@%s/%s", t.scheme, s.Db.Username, net.JoinHostPort(serRes.HostName, strconv.Itoa(serRes.Port)), t.database(s.Db.Username))
+	if s.Db.ReplicaSet {
+		// the member is known as localhost:27017 inside the container, so clients must not discover it
+		serRes.ConnectionString += "?directConnection=true"
+	}
+	if s.Db.TLS {
+		serRes.ConnectionString += "?sslmode=verify-full"
+		ca, err := ioutil.ReadFile(filepath.Join(tlsDir(path), "ca.crt"))
+		if err != nil {
+			logger(ctx).Printf("ERROR: reading CA certificate of %s %v", s.Db.Name, err)
+			return failed(&serviceError{status: 500, msg: "Error reading CA certificate"})
+		}
+		serRes.CACert = string(ca)
+	}
+	if s.Db.Pooler {
+		serRes.PoolerPort = s.Db.PoolerPort
+		serRes.PoolerConnectionString = fmt.Sprintf("%s://%s@%s/%s", t.scheme, s.Db.Username, net.JoinHostPort(serRes.HostName, strconv.Itoa(serRes.PoolerPort)), t.database(s.Db.Username))
+	}
+	if s.Db.Metrics {
+		serRes.MetricsPort = s.Db.MetricsPort
+		metricsHost := metricsBindAddress
+		if net.ParseIP(metricsHost).IsUnspecified() {
+			metricsHost = serRes.HostName
+		}
+		serRes.MetricsURL = fmt.Sprintf("http://%s/metrics", net.JoinHostPort(metricsHost, strconv.Itoa(serRes.MetricsPort)))
+	}
+	var expiresAt int64
+	if s.Duration > 0 {
+		expiresAt = time.Now().Add(s.Duration).Unix()
+	}
+	err = store.InsertCluster(clusterInfo{
+		UserID:         s.UserID,
+		ClusterID:      s.Db.ID,
+		Name:           s.Db.Name,
+		Port:           s.Db.Port,
+		ExpiresAt:      expiresAt,
+		Username:       s.Db.Username,
+		DNSStatus:      s.Db.DNSStatus,
+		PoolerPort:     s.Db.PoolerPort,
+		MetricsPort:    s.Db.MetricsPort,
+		Subdomain:      s.Db.Subdomain,
+		Domain:         s.Db.Domain,
+		Type:           s.Db.Type,
+		MaxConnections: s.Db.MaxConnections,
+		Encoding:       s.Db.Encoding,
+		Locale:         s.Db.Locale,
+		BackupSchedule: s.Db.BackupSchedule,
+		Tags:           s.Db.Tags,
+		CreatedAt:      time.Now().Unix(),
+		ExistingVolume: s.Db.ExistingVolume,
+		Network:        s.Db.Network,
+		ComposeProject: s.Db.ComposeProject,
+		Image:          t.image(s),
+		Storage:        s.Db.Storage,
+		Memory:         s.Db.Memory,
+		TLSDir:         tlsDirOf(s, path),
+		DNSReady:       s.Db.DNSReady,
+		ClonedFrom:     s.Db.ClonedFrom,
+		// set with /updateservice afterwards
+		StatementTimeout:                s.Db.StatementTimeout,
+		IdleInTransactionSessionTimeout: s.Db.IdleInTransactionSessionTimeout,
+	})
 	if err != nil {
-		log.Printf("ERROR: marshalling service response struct serviceResponse %v", err)
-		http.Error(w, "Internal server error ", 500)
-		return
+		logger(ctx).Printf("ERROR: saving cluster info for %s %v", s.UserID, err)
+		return failed(err)
+	}
+	audit(s.UserID, s.UserID, s.Db.Name, s.Db.ID, auditCreate, fmt.Sprintf("port %d", s.Db.Port))
+	if s.Db.DNSStatus == dnsCreated && dnsVerifyTimeout > 0 && !dnsVerifyBlock {
+		// the row exists by now for the verification to update
+		go verifyDNSInBackground(s)
+	}
+	return serRes, nil
+}
+
+// abandonCreate removes what a create of s provisioned before it was cancelled or failed: its
+// containers, DNS record and directories. It has no metadata yet.
+func abandonCreate(ctx context.Context, s service, path string) {
+	// ctx may be cancelled already
+	cleanup := context.Background()
+	if _, err := os.Stat(filepath.Join(path, "docker-compose.yml")); err == nil {
+		if _, err = runner.Run(cleanup, "docker-compose", append(composeFiles(path, s.Db.ComposeProject), withStopTimeout("down", "-v")...)...); err != nil {
+			logger(ctx).Printf("ERROR: removing containers of abandoned create of %s %v", s.Db.Name, err)
+		}
+	}
+	if s.Db.DNSStatus == dnsCreated {
+		if err := disconnectService(cleanup, s); err != nil {
+			logger(ctx).Printf("ERROR: deleting DNS record of abandoned create of %s %v", s.Db.Name, err)
+		}
+	}
+	if dir := tlsDirOf(s, path); dir != "" {
+		if err := os.RemoveAll(dir); err != nil {
+			logger(ctx).Printf("ERROR: removing TLS directory of abandoned create of %s %v", s.Db.Name, err)
+		}
+	}
+	if err := os.RemoveAll(path); err != nil {
+		logger(ctx).Printf("ERROR: removing directory of abandoned create of %s %v", s.Db.Name, err)
+	}
+	if s.Db.ExistingVolume == "" {
+		if err := os.RemoveAll(filepath.Dir(dataPath(s.UserID, s.Db.Type, s.Db.Name))); err != nil {
+			logger(ctx).Printf("ERROR: removing data directory of abandoned create of %s %v", s.Db.Name, err)
+		}
 	}
-	updateSqliteDB(projectDir+"/"+s.UserID, s.UserID, s)
-	w.Write(jsonBody)
 }
 
 func prepareService(s service, path string) error {
@@ -175,13 +1229,55 @@ func prepareService(s service, path string) error {
 	if err != nil {
 		return fmt.Errorf("ERROR: creating project directory at %s", path)
 	}
+	if s.Db.ExistingVolume == "" {
+		data := dataPath(s.UserID, s.Db.Type, s.Db.Name)
+		if err = os.MkdirAll(data, 0700); err != nil {
+			return fmt.Errorf("ERROR: creating data directory %v", err)
+		}
+		if s.Db.RunAsUser != "" {
+			// the database can't initialize a directory it doesn't own
+			uid, gid, _ := parseRunAsUser(s.Db.RunAsUser)
+			if err = os.Chown(data, uid, gid); err != nil {
+				return fmt.Errorf("ERROR: changing owner of data directory %v", err)
+			}
+		}
+	}
 	if err := createDockerComposeFile(path, s); err != nil {
 		return fmt.Errorf("ERROR: creating service docker-compose file %v", err)
 	}
-	return nil
+	if s.Db.Type == "postgres" {
+		if err := createConfigfile(path, s.Db.timeouts()); err != nil {
+			return fmt.Errorf("ERROR: writing postgres config file %v", err)
+		}
+	}
+	if err := writeCredentialsFile(path, s.Db.Type, s.Db.Username, s.Db.password); err != nil {
+		return fmt.Errorf("ERROR: writing credentials file %v", err)
+	}
+	if s.ComposeOverride != "" {
+		if err := writeOverrideFile(path, s.ComposeOverride); err != nil {
+			return fmt.Errorf("ERROR: writing docker-compose override file %v", err)
+		}
+	}
+	if len(s.Db.Profiles) > 0 {
+		if err := writeProfilesFile(path, s.Db.Profiles); err != nil {
+			return fmt.Errorf("ERROR: writing profiles file %v", err)
+		}
+	}
+	if s.Db.ReplicaSet {
+		if err := writeMongoKeyfile(path); err != nil {
+			return fmt.Errorf("ERROR: writing mongo keyfile %v", err)
+		}
+	}
+	if s.Db.TLS {
+		if err := writeServerCert(tlsDir(path), tlsHosts(s)); err != nil {
+			return fmt.Errorf("ERROR: writing TLS certificate %v", err)
+		}
+	}
+	// pulling here rather than in docker-compose up reports image problems on their own
+	return pullImages(s)
 }
 
-func startService(s service, path string) error {
+func startService(ctx context.Context, s service, path string) error {
 	err := ValidateSystemRequirements()
 	if err != nil {
 		return err
@@ -190,119 +1286,235 @@ func startService(s service, path string) error {
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command("docker-compose", "-f", path+"/docker-compose.yml", "up", "-d")
-	// https://stackoverflow.com/questions/18159704/how-to-debug-exit-status-1-error-when-running-exec-command-in-golang/18159705
-	// To print the actual error instead of just printing the exit status
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err = cmd.Run()
-	if err != nil {
-		fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		return err
-	}
-	return nil
+	// the error of the runner carries the stderr of docker-compose rather than just the exit status
+	_, err = runner.Run(ctx, "docker-compose", append(composeFiles(path, s.Db.ComposeProject), "up", "-d")...)
+	return err
 }
 
 func ValidateDockerCompose(path string) error {
-	cmd := exec.Command("docker-compose", "-f", path+"/docker-compose.yml", "config")
-	if err := cmd.Run(); err != nil {
+	// with an override present this validates the merged result
+	if _, err := runner.Run(context.Background(), "docker-compose", append(composeFiles(path, ""), "config", "-q")...); err != nil {
 		return fmt.Errorf("validating docker-compose file %v", err)
 	}
 	return nil
 }
 
 func ValidateSystemRequirements() error {
-	cmd := exec.Command("which", "docker-compose")
-	if err := cmd.Run(); err != nil {
+	if _, err := runner.Run(context.Background(), "which", "docker-compose"); err != nil {
 		return fmt.Errorf("docker-compose doesn't exist %v", err)
 	}
-	cmd = exec.Command("which", "docker")
-	if err := cmd.Run(); err != nil {
+	if _, err := runner.Run(context.Background(), "which", "docker"); err != nil {
 		return err
 	}
 	return nil
 }
 
-func connectService(s service) error {
-	_, err := api.CreateDNSRecord(context.Background(), zoneID, cloudflare.DNSRecord{
-		Type:    "A",
-		Name:    s.UserID + "-" + s.Db.Name,
-		Content: "34.203.202.32",
-	})
+// reserveCluster counts a new cluster against maxTotalClusters until releaseCluster is called,
+// by which time it is either in the store or failed.
+func reserveCluster() error {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+	if maxTotalClusters == 0 {
+		return nil
+	}
+	n, err := store.CountClusters()
 	if err != nil {
-		return err
+		return fmt.Errorf("counting clusters %v", err)
+	}
+	if n+pendingClusters >= maxTotalClusters {
+		return errClusterLimit
 	}
-	log.Printf("INFO: DNS record created for %s ", s.UserID+"-"+s.Db.Name)
+	pendingClusters++
 	return nil
 }
 
+func releaseCluster() {
+	clusterMu.Lock()
+	defer clusterMu.Unlock()
+	if maxTotalClusters > 0 {
+		pendingClusters--
+	}
+}
+
+// allocatePort finds a free port and reserves it until releasePort is called, so that
+// concurrent creates don't pick the same port while an earlier container is still starting.
+// With SPINUP_QUEUE_CREATES it waits for a port to free up when all are occupied.
+func allocatePort(ctx context.Context) (int, error) {
+	portMu.Lock()
+	defer portMu.Unlock()
+	port, err := portcheck()
+	if err == errPortsOccupied && queueCreates {
+		port, err = waitForPort(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	reservedPorts[port] = struct{}{}
+	return port, nil
+}
+
+func releasePort(port int) {
+	portMu.Lock()
+	defer portMu.Unlock()
+	delete(reservedPorts, port)
+	notifyPortFreed()
+}
+
+// portScanAddrs are dialed to find out whether a port is taken. A service may only listen on
+// one of IPv4 and IPv6, so a port is only free when it's free on all of them.
+var portScanAddrs = []string{"127.0.0.1", "::1"}
+
+func portInUse(port int) (bool, error) {
+	for _, addr := range portScanAddrs {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, strconv.Itoa(port)), 3*time.Second)
+		if err == nil {
+			conn.Close()
+			return true, nil
+		}
+		// nothing can listen on an address the host doesn't have, e.g. ::1 without IPv6
+		if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.ENETUNREACH) {
+			continue
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// clusterLabel is set on the containers of a cluster to <userID>/<name>, which tells them
+// apart from containers spinup doesn't manage.
+const clusterLabel = "host.spinup.cluster"
+
+// managedLabel is set on every container spinup creates, along with spinup.user_id,
+// spinup.db_name and spinup.created_at. Cleanups never touch containers without it.
+const managedLabel = "spinup.managed_by"
+
+// portOwnerCheck looks up who holds the ports in use which spinup didn't record, from
+// SPINUP_PORT_OWNER_CHECK.
+var portOwnerCheck = true
+
+// warnPortOwner logs what holds a port in use which isn't recorded in metadata: a container of
+// a cluster whose metadata is missing, another container or a process outside of docker.
+func warnPortOwner(ctx context.Context, port int) {
+	output, err := runner.Run(ctx, "docker", "ps", "--filter", "publish="+strconv.Itoa(port), "--format", "{{.Names}} {{.Label \""+clusterLabel+"\"}}")
+	if err != nil {
+		log.Printf("WARN: looking up the container of port %d %v", port, err)
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if lines[0] == "" {
+		log.Printf("WARN: port %d is held by a process outside of docker", port)
+		return
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			log.Printf("WARN: port %d is held by container %s of cluster %s, which has no metadata", port, fields[0], fields[1])
+		} else {
+			log.Printf("WARN: port %d is held by container %s, which spinup doesn't manage", port, fields[0])
+		}
+	}
+}
+
+// portcheck returns the first port which is neither recorded in metadata, reserved by an
+// in-flight create nor in use on the host.
 func portcheck() (int, error) {
-	endingPort := 5440
-	for startingPort := 5432; startingPort < endingPort; startingPort++ {
-		target := fmt.Sprintf("%s:%d", "localhost", startingPort)
-		_, err := net.DialTimeout("tcp", target, 3*time.Second)
-		if err != nil && !strings.Contains(err.Error(), "connect: connection refused") {
+	allocated, err := store.AllocatedPorts()
+	if err != nil {
+		return 0, fmt.Errorf("reading allocated ports %v", err)
+	}
+	for startingPort := firstPort; startingPort < endPort; startingPort++ {
+		if _, ok := reservedPorts[startingPort]; ok {
+			continue
+		}
+		if _, ok := allocated[startingPort]; ok {
+			continue
+		}
+		inUse, err := portInUse(startingPort)
+		if err != nil {
 			log.Printf("INFO: error on port scanning %d %v", startingPort, err)
 			return 0, err
 		}
-		if err != nil && strings.Contains(err.Error(), "connect: connection refused") {
+		if !inUse {
 			log.Printf("INFO: port %d is unused", startingPort)
 			return startingPort, nil
 		}
+		if portOwnerCheck {
+			warnPortOwner(context.Background(), startingPort)
+		}
 	}
 	log.Printf("WARN: all allocated ports are occupied")
-	return 0, fmt.Errorf("error all allocated ports are occupied")
+	return 0, errPortsOccupied
 }
 
-func lastContainerID() (string, error) {
-	cmd := exec.Command("/bin/bash", "-c", "docker ps --last 1 -q")
-	output, err := cmd.CombinedOutput()
+// serviceContainerID returns the id of the database container, named dbService in the compose
+// file, of the service at path. Unlike the last started container, this is still right when
+// several clusters are created at once.
+func serviceContainerID(ctx context.Context, path, project, dbService string) (string, error) {
+	output, err := runner.Run(ctx, "docker-compose", append(composeFiles(path, project), "ps", "-q", dbService)...)
 	if err != nil {
 		return "", err
 	}
-	return string(output), nil
+	return strings.TrimSpace(string(output)), nil
 }
 
-func validateToken(authHeader string) (string, error) {
-	splitToken := strings.Split(authHeader, "Bearer ")
-	if len(splitToken) < 2 {
-		return "", fmt.Errorf("cannot validate empty token")
+// internalHost returns the host other containers reach the database of s at: its alias on the
+// external network it is attached to, or else its address on the default network of its
+// compose project.
+func internalHost(ctx context.Context, s service) (string, error) {
+	if s.Db.Network != "" {
+		// set by the templates
+		return s.UserID + "-" + s.Db.Name, nil
 	}
-	reqToken := splitToken[1]
-	userID, err := JWTToString(reqToken)
+	output, err := runner.Run(ctx, "docker", "inspect", "-f", "{{json .NetworkSettings.Networks}}", s.Db.ID)
 	if err != nil {
 		return "", err
 	}
-	return userID, nil
-}
-
-func updateSqliteDB(path string, dbName string, data service) {
-	db, err := sql.Open("sqlite3", path+"/"+dbName+".db")
-	if err != nil {
-		log.Fatal(err)
+	var networks map[string]struct {
+		IPAddress string
 	}
-	defer db.Close()
-	sqlStmt := `
-	create table if not exists clusterInfo (id integer not null primary key autoincrement, clusterId text, Name text, Port integer);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		log.Printf("%q: %s\n", err, sqlStmt)
+	if err = json.Unmarshal(output, &networks); err != nil {
+		return "", fmt.Errorf("decoding docker inspect output %v", err)
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal(err)
+	if n := networks[s.Db.ComposeProject+"_default"]; n.IPAddress != "" {
+		return n.IPAddress, nil
 	}
-	stmt, err := tx.Prepare("insert into clusterInfo(clusterId, name, port) values(?, ?, ?)")
+	for _, n := range networks {
+		if n.IPAddress != "" {
+			return n.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("container %s has no address", s.Db.ID)
+}
+
+var (
+	errMissingAuthorization = errors.New("missing Authorization header")
+	errAuthorizationScheme  = errors.New("Authorization scheme must be Bearer")
+	errMalformedToken       = errors.New("malformed bearer token")
+)
+
+// bearerToken returns the token of an Authorization header of the form "Bearer <token>". The
+// scheme is case insensitive and any whitespace may surround the parts.
+func bearerToken(authHeader string) (string, error) {
+	fields := strings.Fields(authHeader)
+	switch {
+	case len(fields) == 0:
+		return "", errMissingAuthorization
+	case !strings.EqualFold(fields[0], "Bearer"):
+		return "", errAuthorizationScheme
+	case len(fields) != 2:
+		return "", errMalformedToken
+	}
+	return fields[1], nil
+}
+
+func validateToken(authHeader string) (string, error) {
+	reqToken, err := bearerToken(authHeader)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(data.Db.ID, data.Db.Name, data.Db.Port)
+	userID, err := JWTToString(reqToken)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-	tx.Commit()
+	return userID, nil
 }
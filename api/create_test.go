@@ -0,0 +1,49 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		header    string
+		wantToken string
+		wantErr   error
+	}{
+		{name: "missing header", header: "", wantErr: errMissingAuthorization},
+		{name: "only whitespace", header: " \t ", wantErr: errMissingAuthorization},
+		{name: "bearer", header: "Bearer abc.def.ghi", wantToken: "abc.def.ghi"},
+		{name: "lower case scheme", header: "bearer abc.def.ghi", wantToken: "abc.def.ghi"},
+		{name: "upper case scheme", header: "BEARER abc.def.ghi", wantToken: "abc.def.ghi"},
+		{name: "extra spaces", header: "  Bearer   abc.def.ghi  ", wantToken: "abc.def.ghi"},
+		{name: "tab between", header: "Bearer\tabc.def.ghi", wantToken: "abc.def.ghi"},
+		{name: "wrong scheme", header: "Basic YWxpY2U6c2VjcmV0", wantErr: errAuthorizationScheme},
+		{name: "bare token", header: "abc.def.ghi", wantErr: errAuthorizationScheme},
+		{name: "scheme as prefix", header: "Bearerabc.def.ghi", wantErr: errAuthorizationScheme},
+		{name: "empty token", header: "Bearer", wantErr: errMalformedToken},
+		{name: "empty token after space", header: "Bearer ", wantErr: errMalformedToken},
+		{name: "token with spaces", header: "Bearer abc def", wantErr: errMalformedToken},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := bearerToken(tt.header)
+			if err != tt.wantErr || token != tt.wantToken {
+				t.Errorf("bearerToken(%q) = %q, %v, want %q, %v", tt.header, token, err, tt.wantToken, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	token, err := stringToJWT("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := validateToken("bearer  " + token)
+	if err != nil || userID != "alice" {
+		t.Fatalf("want alice, got %q %v", userID, err)
+	}
+	if _, err = validateToken("Bearer " + token + "x"); err == nil {
+		t.Error("want a token with a bad signature rejected")
+	}
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	crand "crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// credential file formats, by the format parameter
+const (
+	formatEnv     = "env"
+	formatPgpass  = "pgpass"
+	formatService = "service"
+)
+
+// credentialFiles are the file names the formats are downloaded as.
+var credentialFiles = map[string]string{
+	formatEnv:     ".env",
+	formatPgpass:  ".pgpass",
+	formatService: "pg_service.conf",
+}
+
+type credentials struct {
+	name     string
+	host     string
+	port     int
+	database string
+	user     string
+	password string
+	tls      bool
+}
+
+// Credentials rotates the password of a postgres cluster and returns the connection details
+// with the new password as a .env file, a .pgpass line or a psql service entry. spinup doesn't
+// return a password twice, so every download sets a fresh one. The pooler and exporter of the
+// cluster are recreated to log in with it.
+func Credentials(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = formatEnv
+	}
+	if _, ok := credentialFiles[format]; !ok {
+		http.Error(w, fmt.Sprintf("format must be one of env, pgpass or service, got %q", format), http.StatusBadRequest)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if cluster.Type != "postgres" {
+		http.Error(w, "credentials are only supported for postgres", http.StatusBadRequest)
+		return
+	}
+	path := servicePath(cluster.UserID, cluster.Type, cluster.Name)
+	sidecars := sidecarServices(cluster)
+	if _, err := os.Stat(filepath.Join(path, credentialsFileName)); err != nil && len(sidecars) > 0 {
+		// created before the credentials file, the sidecars have the password in their compose file
+		http.Error(w, "the password of this cluster can't be rotated without breaking its pooler or exporter, recreate the cluster to rotate it", http.StatusConflict)
+		return
+	}
+	password, err := newPassword()
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: generating password %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if err = setPassword(req.Context(), cluster, password); err != nil {
+		logger(req.Context()).Printf("ERROR: setting password of %s %v", cluster.ClusterID, err)
+		http.Error(w, "Error setting password", 500)
+		return
+	}
+	if err = writeCredentialsFile(path, cluster.Type, cluster.Username, password); err == nil && len(sidecars) > 0 {
+		err = restartSidecars(req.Context(), path, cluster.ComposeProject, sidecars)
+	}
+	if err != nil && len(sidecars) > 0 {
+		logger(req.Context()).Printf("ERROR: handing the new password of %s to %s %v", cluster.ClusterID, strings.Join(sidecars, ", "), err)
+		http.Error(w, "Error restarting the pooler or exporter with the new password, rotate it again", 500)
+		return
+	}
+	if err != nil {
+		// only the first start of the database reads it
+		logger(req.Context()).Printf("WARN: writing credentials file of %s %v", cluster.ClusterID, err)
+	}
+	audit(userId, userId, name, cluster.ClusterID, auditCredentials, "password rotated")
+	c := credentials{
+		name:     cluster.Name,
+		host:     clusterHost(cluster),
+		port:     cluster.Port,
+		database: dbTypes[cluster.Type].database(cluster.Username),
+		user:     cluster.Username,
+		password: password,
+		tls:      cluster.TLSDir != "",
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", credentialFiles[format]))
+	// the password is only in this response
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(c.format(format)))
+}
+
+// clusterHost is the host clients reach a recorded cluster at.
+func clusterHost(c clusterInfo) string {
+	if c.DNSStatus == dnsCreated {
+		return recordName(service{UserID: c.UserID, Db: dbCluster{Name: c.Name, Subdomain: c.Subdomain, Domain: c.Domain}})
+	}
+	return hostName()
+}
+
+func (c credentials) format(format string) string {
+	var b strings.Builder
+	port := strconv.Itoa(c.port)
+	switch format {
+	case formatPgpass:
+		fmt.Fprintf(&b, "%s:%s:%s:%s:%s\n", c.host, port, c.database, c.user, c.password)
+	case formatService:
+		fmt.Fprintf(&b, "[%s]\nhost=%s\nport=%s\ndbname=%s\nuser=%s\npassword=%s\n", c.name, c.host, port, c.database, c.user, c.password)
+		if c.tls {
+			b.WriteString("sslmode=verify-full\n")
+		}
+	default:
+		url := fmt.Sprintf("postgresql://%s:%s@%s/%s", c.user, c.password, net.JoinHostPort(c.host, port), c.database)
+		fmt.Fprintf(&b, "PGHOST=%s\nPGPORT=%s\nPGDATABASE=%s\nPGUSER=%s\nPGPASSWORD=%s\n", c.host, port, c.database, c.user, c.password)
+		if c.tls {
+			b.WriteString("PGSSLMODE=verify-full\n")
+			url += "?sslmode=verify-full"
+		}
+		fmt.Fprintf(&b, "DATABASE_URL=%s\n", url)
+	}
+	return b.String()
+}
+
+// newPassword returns a random password which needs no escaping in any of the formats.
+func newPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// credentialsFileName holds the password of the superuser of a cluster next to its
+// docker-compose.yml, in the credentialsEnv of its type, so the compose file doesn't have it.
+const credentialsFileName = "credentials.env"
+
+func writeCredentialsFile(path, dbType, username, password string) error {
+	env := dbTypes[dbType].credentialsEnv(username, password)
+	body := "# written by spinup, rewritten when /credentials rotates the password\n" + strings.Join(env, "\n") + "\n"
+	return ioutil.WriteFile(filepath.Join(path, credentialsFileName), []byte(body), 0600)
+}
+
+// sidecarServices are the services of a postgres cluster which log in with the password of
+// its superuser, the pooler and the exporter.
+func sidecarServices(c clusterInfo) []string {
+	var services []string
+	if c.PoolerPort != 0 {
+		services = append(services, "pgbouncer")
+	}
+	if c.MetricsPort != 0 {
+		services = append(services, "exporter")
+	}
+	return services
+}
+
+// restartSidecars recreates the services of the compose project at path, which reads the
+// credentials file again, without touching the database they depend on.
+func restartSidecars(ctx context.Context, path, project string, services []string) error {
+	_, err := runner.Run(ctx, "docker-compose", append(composeFiles(path, project), append([]string{"up", "-d", "--no-deps", "--force-recreate"}, services...)...)...)
+	return err
+}
+
+// setPassword sets the password of the superuser of a postgres cluster. The username passed
+// validateUsername and the password is base64, so neither needs quoting beyond the SQL.
+func setPassword(ctx context.Context, c clusterInfo, password string) error {
+	query := fmt.Sprintf(`ALTER ROLE "%s" PASSWORD '%s'`, c.Username, password)
+	_, err := runner.Run(ctx, "docker", "exec", c.ClusterID, "psql", "-U", c.Username, "-d", dbTypes[c.Type].database(c.Username), "-qc", query)
+	return err
+}
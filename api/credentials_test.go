@@ -0,0 +1,166 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rotate calls /credentials for cluster db of alice and returns the response.
+func rotate(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := stringToJWT("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/credentials?name=db", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	Credentials(w, req)
+	return w
+}
+
+// recordCluster records cluster db of alice with a pooler and an exporter, and returns the
+// directory of its compose file.
+func recordCluster(t *testing.T) string {
+	t.Helper()
+	c := clusterInfo{UserID: "alice", ClusterID: "cid", Name: "db", Type: "postgres", Username: "postgres", Port: 5432, PoolerPort: 6432, MetricsPort: 9187, ComposeProject: "alice-db"}
+	if err := store.InsertCluster(c); err != nil {
+		t.Fatal(err)
+	}
+	path := servicePath("alice", "postgres", "db")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.DeleteCluster("alice", "db")
+		os.RemoveAll(path)
+	})
+	return path
+}
+
+func TestCredentialsRestartsSidecars(t *testing.T) {
+	path := recordCluster(t)
+	if err := writeCredentialsFile(path, "postgres", "postgres", "initial"); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{}
+	useRunner(t, fake)
+	w := rotate(t)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d %s", w.Code, w.Body)
+	}
+	var password string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "PGPASSWORD=") {
+			password = strings.TrimPrefix(line, "PGPASSWORD=")
+		}
+	}
+	if password == "" || len(fake.ran("ALTER ROLE \"postgres\" PASSWORD '"+password+"'")) != 1 {
+		t.Fatalf("want the returned password %q set, ran %q", password, fake.commands)
+	}
+	env, err := ioutil.ReadFile(filepath.Join(path, credentialsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"DB_PASSWORD=" + password + "\n", "DATA_SOURCE_NAME=postgresql://postgres:" + password + "@postgres:5432/postgres?sslmode=disable\n"} {
+		if !strings.Contains(string(env), want) {
+			t.Errorf("want %q in %s, got\n%s", want, credentialsFileName, env)
+		}
+	}
+	if len(fake.ran("-p alice-db up -d --no-deps --force-recreate pgbouncer exporter")) != 1 {
+		t.Errorf("want the pooler and exporter recreated after the password, ran %q", fake.commands)
+	}
+}
+
+func TestCredentialsRefusedForSidecarsWithoutCredentialsFile(t *testing.T) {
+	recordCluster(t)
+	fake := &fakeRunner{}
+	useRunner(t, fake)
+	if w := rotate(t); w.Code != http.StatusConflict {
+		t.Fatalf("want 409, got %d %s", w.Code, w.Body)
+	}
+	if len(fake.commands) != 0 {
+		t.Errorf("want the password left alone, ran %q", fake.commands)
+	}
+}
+
+func TestWriteCredentialsFile(t *testing.T) {
+	path := t.TempDir()
+	if err := writeCredentialsFile(path, "postgres", "app", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(path, credentialsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("want %s only readable by its owner, mode %v", credentialsFileName, info.Mode().Perm())
+	}
+}
+
+func TestComposePasswords(t *testing.T) {
+	s := service{UserID: "alice", Architecture: "amd64", Db: dbCluster{Name: "db", Type: "postgres", Username: "postgres", Pooler: true, PoolerPort: 6432, Metrics: true, MetricsPort: 9187, password: "s3cret"}}
+	dir := t.TempDir()
+	if err := createDockerComposeFile(dir, s); err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "s3cret") || strings.Contains(string(body), "replaceme") {
+		t.Errorf("want the password only in %s, the compose file has it:\n%s", credentialsFileName, body)
+	}
+	if n := strings.Count(string(body), credentialsFileName); n != 3 {
+		t.Errorf("want the database, pooler and exporter to read %s, %d do:\n%s", credentialsFileName, n, body)
+	}
+
+	for _, db := range []dbCluster{
+		{Name: "db", Type: "mariadb", Username: "root", password: "s3cret"},
+		{Name: "db", Type: "mariadb", Username: "app", password: "s3cret"},
+		{Name: "db", Type: "mongo", Username: "root", password: "s3cret"},
+		{Name: "db", Type: "mongo", Username: "root", password: "s3cret", ReplicaSet: true},
+	} {
+		if err = createDockerComposeFile(dir, service{UserID: "alice", Architecture: "amd64", Db: db}); err != nil {
+			t.Fatal(err)
+		}
+		body, _ = ioutil.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+		if strings.Contains(string(body), "s3cret") || !strings.Contains(string(body), credentialsFileName) {
+			t.Errorf("want the password of %s user %s only in %s, the compose file is\n%s", db.Type, db.Username, credentialsFileName, body)
+		}
+	}
+}
+
+func TestCredentialsFileOfMariaDBAndMongo(t *testing.T) {
+	for _, tt := range []struct {
+		dbType, username string
+		env              []string
+	}{
+		{"mariadb", "root", []string{"MARIADB_ROOT_PASSWORD=s3cret"}},
+		{"mariadb", "app", []string{"MARIADB_ROOT_PASSWORD=s3cret", "MARIADB_PASSWORD=s3cret"}},
+		{"mongo", "root", []string{"MONGO_INITDB_ROOT_PASSWORD=s3cret"}},
+	} {
+		path := t.TempDir()
+		if err := writeCredentialsFile(path, tt.dbType, tt.username, "s3cret"); err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadFile(filepath.Join(path, credentialsFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var env []string
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				env = append(env, line)
+			}
+		}
+		if strings.Join(env, " ") != strings.Join(tt.env, " ") {
+			t.Errorf("want credentials of %s user %s %q, got %q", tt.dbType, tt.username, tt.env, env)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dbType describes how to run and connect to one type of database.
+type dbType struct {
+	// docker-compose template under templates/
+	template string
+	// name of the database service in the template
+	service         string
+	defaultUsername string
+	validateUser    func(username string) error
+	// scheme of the connection string
+	scheme string
+	// database returns the database the connection string points at for username
+	database func(username string) string
+	// supported minor versions by major version. nil when any minor of majors can be used.
+	versions map[uint][]uint
+	// majors which can be requested, when versions doesn't list them
+	majors []uint
+	// whether a pgbouncer pooler can run in front of the database
+	pooler bool
+	// whether a prometheus exporter of the database can run next to it
+	metrics bool
+	// whether the database can run as a single member replica set
+	replicaSet bool
+	// whether the database can serve TLS with a certificate spinup issues
+	tls bool
+	// port the database listens on in its container
+	port int
+	// versionCommand is run in the database container to print the server version
+	versionCommand func(username string) []string
+	// credentialsEnv returns the environment holding the password of the superuser, written to
+	// the credentials file the services of the template read with env_file.
+	credentialsEnv func(username, password string) []string
+	// dumpCommand is run in the database container to write a dump of its databases to
+	// stdout, which restoreCommand reads from stdin. nil when the type can't be backed up.
+	dumpCommand    func(username string) []string
+	restoreCommand func(username string) []string
+}
+
+// dbTypes are the database types which can be created, by service.Db.Type.
+var dbTypes = map[string]dbType{
+	"postgres": {
+		template:        "docker-compose-template.yml",
+		service:         "postgres",
+		defaultUsername: defaultUsername,
+		validateUser:    validateUsername,
+		scheme:          "postgresql",
+		// the postgres image names the default database after POSTGRES_USER
+		database: func(username string) string { return username },
+		// minors come too often to list, every one is published as postgres:<major>.<minor>
+		majors:  []uint{9, 10, 11, 12, 13, 14, 15, 16},
+		pooler:  true,
+		metrics: true,
+		tls:     true,
+		port:    5432,
+		versionCommand: func(username string) []string {
+			return []string{"psql", "-U", username, "-tAc", "SELECT version()"}
+		},
+		// POSTGRES_PASSWORD for the first start of the database, DB_PASSWORD for pgbouncer and
+		// DATA_SOURCE_NAME for the exporter, which reaches the database within the network of the
+		// project, so without TLS
+		credentialsEnv: func(username, password string) []string {
+			dsn := fmt.Sprintf("postgresql://%s:%s@postgres:5432/%s?sslmode=disable", username, password, username)
+			return []string{"POSTGRES_PASSWORD=" + password, "DB_PASSWORD=" + password, "DATA_SOURCE_NAME=" + dsn}
+		},
+		// the custom format of pg_dump -Fc, objects which exist are dropped and recreated
+		dumpCommand: func(username string) []string {
+			return []string{"pg_dump", "-Fc", "-U", username, username}
+		},
+		restoreCommand: func(username string) []string {
+			return []string{"pg_restore", "--clean", "--if-exists", "--no-owner", "--exit-on-error", "-U", username, "-d", username}
+		},
+	},
+	// MariaDB listens on 3306 like MySQL but its image has its own tags and MARIADB_* variables
+	"mariadb": {
+		template:        "docker-compose-mariadb-template.yml",
+		service:         "mariadb",
+		defaultUsername: "root",
+		validateUser:    validateMariaDBUsername,
+		scheme:          "mysql",
+		// MARIADB_DATABASE is named after the user, root doesn't get one
+		database: func(username string) string {
+			if username == "root" {
+				return ""
+			}
+			return username
+		},
+		// release series published as mariadb:<major>.<minor>
+		versions: map[uint][]uint{10: {2, 3, 4, 5, 6}},
+		port:     3306,
+		versionCommand: func(string) []string {
+			return []string{"sh", "-c", `exec mysql -uroot -p"$MARIADB_ROOT_PASSWORD" -N -e "SELECT VERSION()"`}
+		},
+		// a user other than root gets the same password as root
+		credentialsEnv: func(username, password string) []string {
+			env := []string{"MARIADB_ROOT_PASSWORD=" + password}
+			if username != "root" {
+				env = append(env, "MARIADB_PASSWORD="+password)
+			}
+			return env
+		},
+	},
+	"mongo": {
+		template:        "docker-compose-mongo-template.yml",
+		service:         "mongo",
+		defaultUsername: "root",
+		validateUser:    validateMongoUsername,
+		scheme:          "mongodb",
+		// the root user lives in the admin database, which is the default authSource
+		database:   func(string) string { return "" },
+		versions:   map[uint][]uint{4: {0, 2, 4}, 5: {0}},
+		replicaSet: true,
+		port:       27017,
+		versionCommand: func(string) []string {
+			return []string{"sh", "-c", `exec $(command -v mongosh || echo mongo) --quiet -u "$MONGO_INITDB_ROOT_USERNAME" -p "$MONGO_INITDB_ROOT_PASSWORD" --eval "db.version()"`}
+		},
+		credentialsEnv: func(_, password string) []string {
+			return []string{"MONGO_INITDB_ROOT_PASSWORD=" + password}
+		},
+		// a gzipped archive of mongodump of every database, collections which exist are
+		// dropped before they are restored
+		dumpCommand: func(string) []string {
+			return []string{"sh", "-c", `exec mongodump --quiet --archive --gzip -u "$MONGO_INITDB_ROOT_USERNAME" -p "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin`}
+		},
+		restoreCommand: func(string) []string {
+			return []string{"sh", "-c", `exec mongorestore --quiet --archive --gzip --drop -u "$MONGO_INITDB_ROOT_USERNAME" -p "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin`}
+		},
+	},
+}
+
+// allowLatestVersion allows the latest alias for Db.Version, from SPINUP_ALLOW_LATEST_VERSION.
+// It is off since a pinned version is usually preferred.
+var allowLatestVersion bool
+
+// parseVersion sets the major and minor version of db from its Version, one of <major>,
+// <major>.<minor> or latest.
+func parseVersion(db *dbCluster) error {
+	if db.Version == "" {
+		return nil
+	}
+	if db.MajVersion != 0 || db.MinVersion != 0 {
+		return fmt.Errorf("set either version or majVersion and minVersion")
+	}
+	if db.Version == "latest" {
+		if !allowLatestVersion {
+			return fmt.Errorf("the latest version alias is disabled, pin a version")
+		}
+		return nil
+	}
+	parts := strings.Split(db.Version, ".")
+	major, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || major == 0 || len(parts) > 2 {
+		return fmt.Errorf("version %q must be <major>, <major>.<minor> or latest", db.Version)
+	}
+	db.MajVersion = uint(major)
+	if len(parts) == 1 {
+		db.majorOnly = true
+		return nil
+	}
+	minor, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return fmt.Errorf("version %q must be <major>, <major>.<minor> or latest", db.Version)
+	}
+	db.MinVersion = uint(minor)
+	return nil
+}
+
+func (t dbType) supportsMajor(major uint) bool {
+	for _, m := range t.majors {
+		if m == major {
+			return true
+		}
+	}
+	_, ok := t.versions[major]
+	return ok
+}
+
+// resolveVersion checks the requested version against the releases of t. The version may be
+// left out to get the latest release. A major without a minor gets the latest minor of that
+// major, for types without a list of minors also when the minor is 0.
+func (t dbType) resolveVersion(name string, db *dbCluster) error {
+	major, minor := db.MajVersion, db.MinVersion
+	if major == 0 && minor == 0 {
+		return nil
+	}
+	if t.versions == nil && minor == 0 {
+		db.majorOnly = true
+	}
+	if db.majorOnly || t.versions == nil {
+		if !t.supportsMajor(major) {
+			return fmt.Errorf("%s %d is not a supported major version, supported are %s", name, major, t.supportedMajors())
+		}
+		return nil
+	}
+	for _, m := range t.versions[major] {
+		if m == minor {
+			return nil
+		}
+	}
+	var supported []string
+	for maj, minors := range t.versions {
+		for _, m := range minors {
+			supported = append(supported, fmt.Sprintf("%d.%d", maj, m))
+		}
+	}
+	sort.Strings(supported)
+	return fmt.Errorf("%s %d.%d is not a supported release, supported are %s", name, major, minor, strings.Join(supported, ", "))
+}
+
+// supportedVersions lists the versions t can be created with: its majors when any minor of
+// them can be used, else its releases.
+func (t dbType) supportedVersions() []string {
+	var supported []string
+	for _, m := range t.majors {
+		supported = append(supported, strconv.Itoa(int(m)))
+	}
+	for maj, minors := range t.versions {
+		for _, m := range minors {
+			supported = append(supported, fmt.Sprintf("%d.%d", maj, m))
+		}
+	}
+	sort.Slice(supported, func(i, j int) bool {
+		return compareVersions(supported[i], supported[j]) < 0
+	})
+	return supported
+}
+
+// compareVersions orders versions like 9 and 10.2 numerically.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x - y
+		}
+	}
+	return len(as) - len(bs)
+}
+
+func (t dbType) supportedMajors() string {
+	majors := append([]uint{}, t.majors...)
+	for m := range t.versions {
+		majors = append(majors, m)
+	}
+	sort.Slice(majors, func(i, j int) bool { return majors[i] < majors[j] })
+	var supported []string
+	for _, m := range majors {
+		supported = append(supported, strconv.Itoa(int(m)))
+	}
+	return strings.Join(supported, ", ")
+}
+
+// imageOverrides are read from SPINUP_IMAGES_FILE, by type and then by version as
+// <major>.<minor>, or latest for a create which leaves out the version.
+var imageOverrides = map[string]map[string]string{}
+
+// loadImageOverrides reads a YAML file of the image references to run instead of the
+// conventional ones, e.g.
+//
+//	postgres:
+//	  "13.4": registry.internal/postgres:13.4-amd64
+//	  latest: registry.internal/postgres:14.1-amd64
+func loadImageOverrides(path string) (map[string]map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]map[string]string{}
+	if err = yaml.NewDecoder(bytes.NewReader(data)).Decode(&loaded); err != nil {
+		return nil, fmt.Errorf("parsing %s %v", path, err)
+	}
+	for dbType, images := range loaded {
+		if _, ok := dbTypes[dbType]; !ok {
+			return nil, fmt.Errorf("%s has images for unknown type %q", path, dbType)
+		}
+		for version, image := range images {
+			if strings.TrimSpace(image) == "" {
+				return nil, fmt.Errorf("%s has an empty image for %s %s", path, dbType, version)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// image is the image reference the database of s runs: the image of its source for a clone,
+// the one pinned in imageOverrides for its version or else the conventional one.
+func (t dbType) image(s service) string {
+	if s.Db.image != "" {
+		return s.Db.image
+	}
+	version := versionOf(s.Db)
+	if image, ok := imageOverrides[s.Db.Type][version]; ok {
+		return image
+	}
+	image := s.Architecture + "/" + s.Db.Type
+	if version != "latest" {
+		// the major alone is the tag of its latest minor
+		image += ":" + version
+	}
+	return image
+}
+
+// versionOf is the version db runs: the major alone, <major>.<minor> or latest, or the tag of
+// the image of a clone.
+func versionOf(db dbCluster) string {
+	if db.image != "" {
+		ref := db.image
+		if i := strings.Index(ref, "@"); i >= 0 {
+			ref = ref[:i]
+		}
+		if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+			return ref[i+1:]
+		}
+		return "latest"
+	}
+	switch {
+	case db.majorOnly:
+		return fmt.Sprintf("%d", db.MajVersion)
+	case db.MajVersion != 0:
+		return fmt.Sprintf("%d.%d", db.MajVersion, db.MinVersion)
+	}
+	return "latest"
+}
+
+// MariaDB user names, limited to 80 characters
+var mariaDBUser = regexp.MustCompile(`^[a-zA-Z0-9_]{1,80}$`)
+
+// MongoDB user names, kept to characters which don't need escaping in a connection string
+var mongoUser = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+func validateMongoUsername(username string) error {
+	if !mongoUser.MatchString(username) {
+		return fmt.Errorf("username %q must contain only letters, digits, _, . or - and be at most 64 characters", username)
+	}
+	return nil
+}
+
+func validateMariaDBUsername(username string) error {
+	if !mariaDBUser.MatchString(username) {
+		return fmt.Errorf("username %q must contain only letters, digits or _ and be at most 80 characters", username)
+	}
+	return nil
+}
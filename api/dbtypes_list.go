@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+)
+
+type dbTypeInfo struct {
+	Name string
+	// versions a create can ask for. With AnyMinor, <major>.<minor> of a listed major works too.
+	Versions []string
+	AnyMinor bool
+	// version of a create which asks for none, from SPINUP_DEFAULT_<TYPE>_VERSION
+	DefaultVersion string
+	// port the database listens on in its container
+	Port            int
+	DefaultUsername string
+	// memory and storage of a create which asks for none, unset when unbounded
+	DefaultMemory  string `json:",omitempty"`
+	DefaultStorage string `json:",omitempty"`
+	Pooler         bool
+	Metrics        bool
+	ReplicaSet     bool
+	TLS            bool
+}
+
+// ListDBTypes lists the database types spinup can create with their versions, defaults and
+// features, for clients to build their forms from. Like Hello it doesn't need a token.
+func ListDBTypes(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	list := []dbTypeInfo{}
+	for name, t := range dbTypes {
+		defaultVersion, ok := defaultVersions[name]
+		if !ok {
+			defaultVersion = "latest"
+		}
+		list = append(list, dbTypeInfo{
+			Name:            name,
+			Versions:        t.supportedVersions(),
+			AnyMinor:        t.versions == nil,
+			DefaultVersion:  defaultVersion,
+			Port:            t.port,
+			DefaultUsername: t.defaultUsername,
+			DefaultMemory:   typeDefault(defaultMemory, name),
+			DefaultStorage:  typeDefault(defaultStorage, name),
+			Pooler:          t.pooler,
+			Metrics:         t.metrics,
+			ReplicaSet:      t.replicaSet,
+			TLS:             t.tls,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, req, list)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// debugBodies logs the request and response body of every call, see LogBodies.
+var debugBodies bool
+
+// maxDebugBody is how much of a body is logged, the rest is cut off.
+const maxDebugBody = 16 << 10
+
+const redacted = "[REDACTED]"
+
+// secretKey matches the names of fields whose values must never be logged.
+var secretKey = regexp.MustCompile(`(?i)password|passwd|secret|token|authorization|private_?key|signature|^code$`)
+
+// secretAssignment matches secrets embedded in a string, like POSTGRES_PASSWORD: x in a
+// compose override or password=x in a DSN. The value is the last group.
+var secretAssignment = regexp.MustCompile(`(?i)([a-z0-9_]*(?:password|passwd|secret|token)[a-z0-9_]*"?\s*[:=]\s*"?)([^\s"',&}]+)`)
+
+// urlPassword matches the password in the userinfo of a URL, like postgresql://user:x@host. The
+// password is the last group.
+var urlPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@"']*:)([^/\s@"']+)@`)
+
+// jwtPattern matches bare JWTs, like a token outside of a JSON field.
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+
+// LogBodies logs the request and response bodies when SPINUP_DEBUG_BODIES is set, with
+// secrets redacted by field name. Websocket upgrades are passed through untouched.
+func LogBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !debugBodies || strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		head, err := ioutil.ReadAll(io.LimitReader(req.Body, maxDebugBody))
+		if err != nil {
+			logger(req.Context()).Printf("WARN: reading request body for debug log %v", err)
+		}
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+		logger(req.Context()).Printf("DEBUG: %s %s request %s", req.Method, req.URL.Path, redactBody(head))
+		response := redacted
+		// responses which mustn't be stored, like /credentials, carry secrets in any format
+		if !strings.Contains(rec.Header().Get("Cache-Control"), "no-store") {
+			response = redactBody(rec.body.Bytes())
+		}
+		logger(req.Context()).Printf("DEBUG: %s %s response %d %s", req.Method, req.URL.Path, rec.status, response)
+	})
+}
+
+// bodyRecorder keeps the first maxDebugBody bytes of a response.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bodyRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if room := maxDebugBody - r.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		r.body.Write(b[:room])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *bodyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// redactBody redacts JSON bodies field by field, anything else only by secretAssignment.
+func redactBody(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return redactString(string(body))
+	}
+	out, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return redacted
+	}
+	return string(out)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if secretKey.MatchString(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(field)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	case string:
+		return redactString(v)
+	}
+	return v
+}
+
+func redactString(s string) string {
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	s = urlPassword.ReplaceAllString(s, "${1}"+redacted+"@")
+	return secretAssignment.ReplaceAllString(s, "${1}"+redacted)
+}
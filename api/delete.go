@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// reapInterval is how often expired clusters are looked for. The reaper is disabled when zero.
+var reapInterval time.Duration
+
+// reaperActor is recorded in the history of clusters deleted by the reaper.
+const reaperActor = "reaper"
+
+// deleteRetention is how long a deleted cluster is stopped but kept, so it can be undeleted,
+// before the reaper purges it. Clusters are purged right away when zero.
+var deleteRetention time.Duration
+
+var errNotDeleted = errors.New("cluster isn't deleted")
+
+// stopTimeout is how long the containers of a cluster get to shut down cleanly after SIGTERM
+// before they are killed. docker's default of 10s applies when zero.
+var stopTimeout time.Duration
+
+// withStopTimeout adds stopTimeout to the arguments of a docker-compose stop or down.
+func withStopTimeout(args ...string) []string {
+	if stopTimeout <= 0 {
+		return args
+	}
+	return append(args, "-t", strconv.Itoa(int(math.Ceil(stopTimeout.Seconds()))))
+}
+
+func DeleteService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "DELETE") {
+		return
+	}
+	authHeader := req.Header.Get("Authorization")
+	userId, err := validateToken(authHeader)
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	purge := req.URL.Query().Get("purge") == "true"
+	if req.URL.Query().Get("async") == "true" {
+		if _, err = store.GetCluster(userId, name); errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "cluster not found", http.StatusNotFound)
+			return
+		}
+		var j job
+		if err == nil {
+			j, err = startJob(req.Context(), userId, jobDelete, name, nil, nil, func(ctx context.Context) (interface{}, error) {
+				return nil, removeService(ctx, userId, userId, name, purge)
+			})
+		}
+		if err != nil {
+			logger(req.Context()).Printf("ERROR: starting delete job of %s for %s %v", name, userId, err)
+			http.Error(w, "Internal server error ", 500)
+			return
+		}
+		writeJobStarted(w, req, j)
+		return
+	}
+	err = removeService(req.Context(), userId, userId, name, purge)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: deleting service %s for %s %v", name, userId, err)
+		http.Error(w, "Error deleting service", 500)
+		return
+	}
+	logger(req.Context()).Printf("INFO: deleted service %s for user %s", name, userId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeService deletes a cluster of userID. While deleted clusters are retained it only
+// stops the cluster, unless purge is set.
+func removeService(ctx context.Context, actor, userID, name string, purge bool) error {
+	if deleteRetention <= 0 || purge {
+		return deleteService(ctx, actor, userID, name)
+	}
+	return softDeleteService(ctx, actor, userID, name)
+}
+
+// softDeleteService stops the cluster's containers and marks it deleted, keeping its data,
+// port and DNS record until the reaper purges it after deleteRetention.
+func softDeleteService(ctx context.Context, actor, userID, name string) error {
+	cluster, err := store.GetCluster(userID, name)
+	if err != nil {
+		return err
+	}
+	if cluster.DeletedAt != 0 {
+		return nil
+	}
+	path := servicePath(userID, cluster.Type, name)
+	if _, err := os.Stat(filepath.Join(path, "docker-compose.yml")); err == nil {
+		if _, err = runner.Run(ctx, "docker-compose", append(composeFiles(path, cluster.ComposeProject), withStopTimeout("stop")...)...); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if err = store.SetDeletedAt(userID, name, now.Unix()); err != nil {
+		return err
+	}
+	audit(actor, userID, name, cluster.ClusterID, auditDelete, "retained until "+now.Add(deleteRetention).UTC().Format(time.RFC3339))
+	return nil
+}
+
+// UndeleteService starts a deleted cluster again while it is retained.
+func UndeleteService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	err = undeleteService(req.Context(), userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errNotDeleted) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: undeleting service %s for %s %v", name, userId, err)
+		http.Error(w, "Error undeleting service", 500)
+		return
+	}
+	logger(req.Context()).Printf("INFO: undeleted service %s for user %s", name, userId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func undeleteService(ctx context.Context, userID, name string) error {
+	cluster, err := store.GetCluster(userID, name)
+	if err != nil {
+		return err
+	}
+	if cluster.DeletedAt == 0 {
+		return errNotDeleted
+	}
+	path := servicePath(userID, cluster.Type, name)
+	if _, err = runner.Run(ctx, "docker-compose", append(composeFiles(path, cluster.ComposeProject), "start")...); err != nil {
+		return err
+	}
+	if err = store.SetDeletedAt(userID, name, 0); err != nil {
+		return err
+	}
+	audit(userID, userID, name, cluster.ClusterID, auditUndelete, "")
+	return nil
+}
+
+// deleteService tears down the cluster's containers, its DNS record, directory and data,
+// and finally its metadata row, which makes the cluster's port available to portcheck again.
+// actor is recorded in the cluster's history as the one who deleted it.
+func deleteService(ctx context.Context, actor, userID, name string) error {
+	cluster, err := store.GetCluster(userID, name)
+	if err != nil {
+		return err
+	}
+	path := servicePath(userID, cluster.Type, name)
+	if _, err := os.Stat(filepath.Join(path, "docker-compose.yml")); err == nil {
+		// an existing volume and an attached network are declared external, which down -v
+		// leaves alone
+		if _, err = runner.Run(ctx, "docker-compose", append(composeFiles(path, cluster.ComposeProject), withStopTimeout("down", "-v")...)...); err != nil {
+			return err
+		}
+	}
+	if cluster.ExistingVolume != "" {
+		logger(ctx).Printf("INFO: keeping volume %s of cluster %s", cluster.ExistingVolume, name)
+	}
+	if dnsEnabled && cluster.DNSStatus == dnsCreated {
+		if err = disconnectService(ctx, service{UserID: userID, Db: dbCluster{Name: name, Subdomain: cluster.Subdomain, Domain: cluster.Domain}}); err != nil {
+			return fmt.Errorf("deleting DNS record %v", err)
+		}
+	}
+	if cluster.TLSDir != "" {
+		// the key must not outlive the cluster, even if the directory was moved elsewhere
+		if err := os.RemoveAll(cluster.TLSDir); err != nil {
+			return fmt.Errorf("removing TLS directory %v", err)
+		}
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("removing service directory %v", err)
+	}
+	if err := os.RemoveAll(filepath.Dir(dataPath(userID, cluster.Type, name))); err != nil {
+		return fmt.Errorf("removing data directory %v", err)
+	}
+	if err = store.DeleteCluster(userID, name); err != nil {
+		return err
+	}
+	portMu.Lock()
+	notifyPortFreed()
+	portMu.Unlock()
+	forgetStats(userID, name)
+	audit(actor, userID, name, cluster.ClusterID, auditDelete, "")
+	return nil
+}
+
+// StartReaper periodically deletes clusters whose requested Duration has passed, and purges
+// deleted clusters past their retention. It does nothing unless SPINUP_REAP_INTERVAL is set.
+func StartReaper() {
+	if reapInterval <= 0 {
+		return
+	}
+	log.Printf("INFO: reaping expired clusters every %v", reapInterval)
+	go func() {
+		ticker := time.NewTicker(reapInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reapExpired(time.Now())
+			purgeDeleted(time.Now())
+		}
+	}()
+}
+
+func reapExpired(now time.Time) {
+	clusters, err := store.ExpiredClusters(now)
+	if err != nil {
+		log.Printf("ERROR: reaper reading expired clusters %v", err)
+		return
+	}
+	for _, c := range clusters {
+		if err = deleteService(context.Background(), reaperActor, c.UserID, c.Name); err != nil {
+			log.Printf("ERROR: reaper deleting %s of %s %v", c.Name, c.UserID, err)
+			continue
+		}
+		log.Printf("INFO: reaped expired service %s of user %s", c.Name, c.UserID)
+	}
+}
+
+// purgeDeleted removes the deleted clusters whose retention has run out by now.
+func purgeDeleted(now time.Time) {
+	if deleteRetention <= 0 {
+		return
+	}
+	clusters, err := store.DeletedClusters(now.Add(-deleteRetention))
+	if err != nil {
+		log.Printf("ERROR: reaper reading deleted clusters %v", err)
+		return
+	}
+	for _, c := range clusters {
+		if err = deleteService(context.Background(), reaperActor, c.UserID, c.Name); err != nil {
+			log.Printf("ERROR: reaper purging %s of %s %v", c.Name, c.UserID, err)
+			continue
+		}
+		log.Printf("INFO: purged deleted service %s of user %s", c.Name, c.UserID)
+	}
+}
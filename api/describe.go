@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// describeResponse reports what is actually running for a cluster, which can drift from
+// what was requested (e.g. postgres:13 resolving to a newer minor over time).
+type describeResponse struct {
+	Name          string
+	ContainerID   string
+	Image         string
+	ImageID       string
+	RepoDigests   []string
+	ServerVersion string
+	// external docker network the cluster is attached to, if any
+	Network string `json:",omitempty"`
+	// only reported for postgres, 0 for the server default
+	MaxConnections    int `json:",omitempty"`
+	ActiveConnections int `json:",omitempty"`
+	// encoding and locale set at create, empty for the image defaults
+	Encoding string `json:",omitempty"`
+	Locale   string `json:",omitempty"`
+	// schedule and outcome of the scheduled backups, empty when the cluster isn't backed up
+	BackupSchedule   string `json:",omitempty"`
+	LastBackupAt     int64  `json:",omitempty"`
+	LastBackupStatus string `json:",omitempty"`
+}
+
+func DescribeService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	authHeader := req.Header.Get("Authorization")
+	userId, err := validateToken(authHeader)
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	res, err := describeContainer(req.Context(), cluster.ClusterID)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: inspecting container %s %v", cluster.ClusterID, err)
+		http.Error(w, "Error inspecting cluster", 500)
+		return
+	}
+	res.Name, res.Network = cluster.Name, cluster.Network
+	// a stopped cluster can still be described, just without the server version
+	if res.ServerVersion, err = serverVersion(req.Context(), cluster); err != nil {
+		logger(req.Context()).Printf("WARN: getting server version of %s %v", cluster.ClusterID, err)
+	}
+	if cluster.Type == "postgres" {
+		res.MaxConnections = cluster.MaxConnections
+		res.Encoding, res.Locale = cluster.Encoding, cluster.Locale
+		res.BackupSchedule = cluster.BackupSchedule
+		res.LastBackupAt, res.LastBackupStatus = cluster.LastBackupAt, cluster.LastBackupStatus
+		if res.ActiveConnections, err = activeConnections(req.Context(), cluster); err != nil {
+			logger(req.Context()).Printf("WARN: counting connections of %s %v", cluster.ClusterID, err)
+		}
+	}
+	jsonBody, err := json.Marshal(res)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling describe response %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
+
+func describeContainer(ctx context.Context, containerID string) (describeResponse, error) {
+	res := describeResponse{ContainerID: containerID}
+	output, err := runner.Run(ctx, "docker", "inspect", containerID)
+	if err != nil {
+		return res, err
+	}
+	var containers []struct {
+		Image  string
+		Config struct {
+			Image string
+		}
+	}
+	if err = json.Unmarshal(output, &containers); err != nil || len(containers) == 0 {
+		return res, fmt.Errorf("decoding docker inspect output %v", err)
+	}
+	res.Image = containers[0].Config.Image
+	res.ImageID = containers[0].Image
+
+	output, err = runner.Run(ctx, "docker", "image", "inspect", res.ImageID)
+	if err != nil {
+		return res, err
+	}
+	var images []struct {
+		RepoDigests []string
+	}
+	if err = json.Unmarshal(output, &images); err != nil || len(images) == 0 {
+		return res, fmt.Errorf("decoding docker image inspect output %v", err)
+	}
+	res.RepoDigests = images[0].RepoDigests
+	return res, nil
+}
+
+func serverVersion(ctx context.Context, cluster clusterInfo) (string, error) {
+	t, ok := dbTypes[cluster.Type]
+	if !ok {
+		return "", fmt.Errorf("unknown type %s", cluster.Type)
+	}
+	args := append([]string{"exec", cluster.ClusterID}, t.versionCommand(cluster.Username)...)
+	output, err := runner.Run(ctx, "docker", args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// activeConnections counts the backends of a postgres cluster, including the one counting.
+func activeConnections(ctx context.Context, cluster clusterInfo) (int, error) {
+	output, err := runner.Run(ctx, "docker", "exec", cluster.ClusterID, "psql", "-U", cluster.Username, "-tAc", "SELECT count(*) FROM pg_stat_activity")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
@@ -0,0 +1,514 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dns status of a cluster as recorded in metadata
+const (
+	dnsCreated = "created"
+	// the cluster is running but its record still has to be created, see RetryDNS
+	dnsPending = "pending"
+)
+
+var (
+	// dnsEnabled turns on creating a DNS record for every cluster
+	dnsEnabled bool
+	// dnsProviderName is the SPINUP_DNS_PROVIDER records are managed with: cloudflare, route53 or webhook
+	dnsProviderName = "cloudflare"
+	// dnsFailHard makes a create fail when its DNS record can't be created
+	dnsFailHard bool
+	publicIP    = "34.203.202.32"
+	domain      = "spinup.host"
+)
+
+// zones are the zone ids of the base domains records can be created under, from
+// SPINUP_DNS_ZONES_FILE. SPINUP_DOMAIN is always one of them, with CF_ZONE_ID or SPINUP_DNS_ZONE_ID.
+var zones = map[string]string{}
+
+// loadZones reads a YAML file mapping base domains to the ids of their zones, e.g.
+//
+//	spinup.host: 0123456789abcdef
+//	db.example.com: fedcba9876543210
+func loadZones(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var decoded map[string]string
+	if err = yaml.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("parsing %s %v", path, err)
+	}
+	loaded := map[string]string{}
+	for d, id := range decoded {
+		if id == "" {
+			return nil, fmt.Errorf("%s has an empty zone id for %s", path, d)
+		}
+		// requests are matched in lower case
+		loaded[strings.ToLower(d)] = id
+	}
+	return loaded, nil
+}
+
+// baseDomain is the domain the record of s is created under.
+func baseDomain(s service) string {
+	if s.Db.Domain != "" {
+		return s.Db.Domain
+	}
+	return domain
+}
+
+// zoneOf is the id of the zone the record of s is in.
+func zoneOf(s service) string {
+	return zones[baseDomain(s)]
+}
+
+// recordName is the full name of the record of s.
+func recordName(s service) string {
+	return dnsName(s) + "." + baseDomain(s)
+}
+
+// dnsVerifyTimeout is how long a new record is resolved until it points at publicIP, from
+// SPINUP_DNS_VERIFY_TIMEOUT. Records aren't verified when zero.
+var dnsVerifyTimeout time.Duration
+
+// dnsVerifyBlock makes a create wait for the verification of its record instead of verifying
+// it in the background, from SPINUP_DNS_VERIFY_BLOCK.
+var dnsVerifyBlock bool
+
+// dnsVerifyInterval is how often a record is resolved while it is verified.
+const dnsVerifyInterval = 2 * time.Second
+
+// dnsTimeout caps how long a single DNS operation, including its retries, may take.
+const dnsTimeout = 30 * time.Second
+
+// cloudflareTransport retries rate limited and failed Cloudflare requests. The retries of
+// cloudflare-go itself are turned off as they neither honor Retry-After nor the context.
+var cloudflareTransport = retryTransport{
+	next:       http.DefaultTransport,
+	maxRetries: 5,
+	minDelay:   500 * time.Millisecond,
+	maxDelay:   10 * time.Second,
+}
+
+// dnsEditPermission is listed in a zone's permissions when the token can edit its records.
+const dnsEditPermission = "#dns_records:edit"
+
+// checkDNSProvider makes sure the records of every zone can be managed with the provider of
+// SPINUP_DNS_PROVIDER.
+func checkDNSProvider(ctx context.Context) error {
+	switch p := dnsProvider.(type) {
+	case cloudflareProvider:
+		return checkCloudflare(ctx)
+	case *route53Provider:
+		ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+		for _, d := range sortedZones() {
+			if err := p.checkZone(ctx, zones[d]); err != nil {
+				return err
+			}
+		}
+	case *webhookProvider:
+		// the webhook has no zones to read, listing the records of a name it manages shows it answers
+		ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+		for _, d := range sortedZones() {
+			if _, err := p.ListRecords(ctx, zones[d], "A", d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortedZones are the base domains of zones in order, so the checks fail the same way every start.
+func sortedZones() []string {
+	domains := make([]string, 0, len(zones))
+	for d := range zones {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// zoneIDVariable is the environment variable the zone of SPINUP_DOMAIN is read from.
+func zoneIDVariable() string {
+	if dnsProviderName == "cloudflare" {
+		return "CF_ZONE_ID"
+	}
+	return "SPINUP_DNS_ZONE_ID"
+}
+
+// checkCloudflare verifies that the token is active, can read every configured zone and may
+// edit their DNS records, so that a bad token shows up at startup rather than on the first create.
+func checkCloudflare(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	token, err := api.VerifyAPIToken(ctx)
+	if err != nil {
+		return fmt.Errorf("verifying CF_AUTHORIZATION_TOKEN %v", err)
+	}
+	if token.Status != "active" {
+		return fmt.Errorf("CF_AUTHORIZATION_TOKEN is %s", token.Status)
+	}
+	for _, d := range sortedZones() {
+		if err = checkZone(ctx, zones[d]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkZone(ctx context.Context, zoneID string) error {
+	zone, err := api.ZoneDetails(ctx, zoneID)
+	if err != nil {
+		return fmt.Errorf("reading zone %s with CF_AUTHORIZATION_TOKEN %v", zoneID, err)
+	}
+	for _, p := range zone.Permissions {
+		if p == dnsEditPermission {
+			return nil
+		}
+	}
+	return fmt.Errorf("CF_AUTHORIZATION_TOKEN can't edit the DNS records of zone %s (%s)", zone.Name, zoneID)
+}
+
+// dnsNameTemplate renders the name of the record of a new cluster within its zone instead of
+// <userID>-<dbName>, from SPINUP_DNS_NAME_TEMPLATE.
+var dnsNameTemplate *template.Template
+
+// dnsNameData are the fields SPINUP_DNS_NAME_TEMPLATE is rendered with.
+type dnsNameData struct {
+	UserID string
+	DbName string
+	Type   string
+}
+
+func parseDNSNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("SPINUP_DNS_NAME_TEMPLATE").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// an unknown field only fails once the template is executed
+	if err = tmpl.Execute(ioutil.Discard, dnsNameData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// templatedDNSName renders dnsNameTemplate for s and checks the result is a name the zone of s
+// can hold: lowercase DNS labels separated by dots.
+func templatedDNSName(s service) (string, error) {
+	var b strings.Builder
+	if err := dnsNameTemplate.Execute(&b, dnsNameData{UserID: s.UserID, DbName: s.Db.Name, Type: s.Db.Type}); err != nil {
+		return "", fmt.Errorf("rendering SPINUP_DNS_NAME_TEMPLATE %v", err)
+	}
+	name := strings.ToLower(b.String())
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabel.MatchString(label) {
+			return "", fmt.Errorf("SPINUP_DNS_NAME_TEMPLATE renders %q for this cluster, which isn't a DNS name: every label between dots must be at most 63 letters, digits or hyphens, not starting or ending with a hyphen", name)
+		}
+	}
+	// a full name is at most 253 characters
+	if len(name)+1+len(baseDomain(s)) > 253 {
+		return "", fmt.Errorf("SPINUP_DNS_NAME_TEMPLATE renders %q for this cluster, which is too long for a DNS name under %s", name, baseDomain(s))
+	}
+	return name, nil
+}
+
+// dnsName is the name of the service's record within the zone, <userID>-<dbName> unless the
+// user asked for a subdomain of their own. A name rendered from SPINUP_DNS_NAME_TEMPLATE is
+// recorded as the subdomain of the cluster, so changing the template doesn't rename the records
+// of existing clusters.
+func dnsName(s service) string {
+	if s.Db.Subdomain != "" {
+		return s.Db.Subdomain
+	}
+	return s.UserID + "-" + s.Db.Name
+}
+
+// subdomainTaken reports whether the zone of s already has a record named like its subdomain.
+func subdomainTaken(ctx context.Context, s service) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	records, err := dnsProvider.ListRecords(ctx, zoneOf(s), "", recordName(s))
+	if err != nil {
+		return false, err
+	}
+	return len(records) > 0, nil
+}
+
+// errDNSConflict is returned when the record of a cluster exists and points somewhere else.
+var errDNSConflict = errors.New("DNS record exists and points elsewhere")
+
+// recordOwner returns another cluster whose record is the record of s, if there is one. The
+// default names can collide, user a-b's cluster c and user a's cluster b-c are both a-b-c, and
+// the record of one cluster must neither be taken over nor deleted for the other.
+func recordOwner(s service) (clusterInfo, bool, error) {
+	var owner clusterInfo
+	found := false
+	name := recordName(s)
+	err := store.EachCluster(func(c clusterInfo) error {
+		if found || c.DNSStatus != dnsCreated || (c.UserID == s.UserID && c.Name == s.Db.Name) {
+			return nil
+		}
+		if recordName(service{UserID: c.UserID, Db: dbCluster{Name: c.Name, Subdomain: c.Subdomain, Domain: c.Domain}}) == name {
+			owner, found = c, true
+		}
+		return nil
+	})
+	return owner, found, err
+}
+
+// connectService creates the record of the service. A record which already points at
+// publicIP, e.g. left by a create which didn't finish, is taken over unless another cluster
+// owns it. One pointing elsewhere isn't spinup's to change, SyncDNS repoints the record of a
+// recorded cluster.
+func connectService(ctx context.Context, s service) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	owner, owned, err := recordOwner(s)
+	if err != nil {
+		return err
+	}
+	if owned {
+		return fmt.Errorf("%s: %w, it belongs to cluster %s of %s", recordName(s), errDNSConflict, owner.Name, owner.UserID)
+	}
+	ip := currentPublicIP()
+	records, err := dnsProvider.ListRecords(ctx, zoneOf(s), "A", recordName(s))
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Content == ip {
+			logger(ctx).Printf("INFO: DNS record of %s already points at %s", dnsName(s), ip)
+			return nil
+		}
+	}
+	if len(records) > 0 {
+		return fmt.Errorf("%s: %w, to %s", recordName(s), errDNSConflict, records[0].Content)
+	}
+	return createRecord(ctx, s, ip)
+}
+
+func createRecord(ctx context.Context, s service, ip string) error {
+	err := dnsProvider.CreateRecord(ctx, zoneOf(s), DNSRecord{Type: "A", Name: recordName(s), Content: ip})
+	if err != nil {
+		return err
+	}
+	logger(ctx).Printf("INFO: DNS record created for %s ", dnsName(s))
+	return nil
+}
+
+// verifyDNS resolves the record of s until it points at publicIP, for at most
+// dnsVerifyTimeout, and reports whether it did.
+func verifyDNS(ctx context.Context, s service) bool {
+	ctx, cancel := context.WithTimeout(ctx, dnsVerifyTimeout)
+	defer cancel()
+	name := recordName(s)
+	ip := currentPublicIP()
+	ticker := time.NewTicker(dnsVerifyInterval)
+	defer ticker.Stop()
+	for {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		for _, a := range addrs {
+			if a == ip {
+				return true
+			}
+		}
+		if err != nil {
+			logger(ctx).Printf("INFO: %s doesn't resolve yet %v", name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// verifyDNSInBackground verifies the record of a created cluster and records when it resolves.
+func verifyDNSInBackground(s service) {
+	if verifyDNS(context.Background(), s) {
+		if err := store.SetDNSReady(s.UserID, s.Db.Name, true); err != nil {
+			log.Printf("ERROR: recording DNS of %s of %s as ready %v", s.Db.Name, s.UserID, err)
+		}
+		return
+	}
+	log.Printf("WARN: DNS record of %s of %s doesn't resolve to %s after %v", s.Db.Name, s.UserID, currentPublicIP(), dnsVerifyTimeout)
+}
+
+// disconnectService removes the DNS records of the service, if there are any and no other
+// cluster owns them.
+func disconnectService(ctx context.Context, s service) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	owner, owned, err := recordOwner(s)
+	if err != nil {
+		return err
+	}
+	if owned {
+		logger(ctx).Printf("WARN: keeping DNS record of %s, it belongs to cluster %s of %s", dnsName(s), owner.Name, owner.UserID)
+		return nil
+	}
+	records, err := dnsProvider.ListRecords(ctx, zoneOf(s), "A", recordName(s))
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err = dnsProvider.DeleteRecord(ctx, zoneOf(s), r.ID); err != nil {
+			return err
+		}
+	}
+	logger(ctx).Printf("INFO: DNS record deleted for %s ", dnsName(s))
+	return nil
+}
+
+// syncService makes the record of the service point at publicIP, creating it if it's gone and
+// updating it if it exists, unless another cluster owns it.
+func syncService(ctx context.Context, s service) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	owner, owned, err := recordOwner(s)
+	if err != nil {
+		return err
+	}
+	if owned {
+		return fmt.Errorf("%s: %w, it belongs to cluster %s of %s", recordName(s), errDNSConflict, owner.Name, owner.UserID)
+	}
+	records, err := dnsProvider.ListRecords(ctx, zoneOf(s), "A", recordName(s))
+	if err != nil {
+		return err
+	}
+	ip := currentPublicIP()
+	if len(records) == 0 {
+		return createRecord(ctx, s, ip)
+	}
+	for _, r := range records {
+		if r.Content == ip {
+			continue
+		}
+		err = dnsProvider.UpdateRecord(ctx, zoneOf(s), DNSRecord{ID: r.ID, Type: "A", Name: recordName(s), Content: ip})
+		if err != nil {
+			return err
+		}
+	}
+	logger(ctx).Printf("INFO: DNS record synced for %s ", dnsName(s))
+	return nil
+}
+
+// SyncDNS recreates or updates the DNS record of one of the user's clusters, e.g. after the
+// record was deleted in Cloudflare by accident.
+func SyncDNS(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	if !dnsEnabled {
+		http.Error(w, "DNS is disabled", http.StatusConflict)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	s := service{UserID: userId, Db: dbCluster{Name: cluster.Name, Subdomain: cluster.Subdomain, Domain: cluster.Domain}}
+	if err = syncService(req.Context(), s); err != nil {
+		logger(req.Context()).Printf("ERROR: syncing DNS for %s %v", dnsName(s), err)
+		if errors.Is(err, errDNSConflict) {
+			http.Error(w, fmt.Sprintf("DNS record %s belongs to another cluster", recordName(s)), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error syncing DNS record", http.StatusBadGateway)
+		return
+	}
+	if err = store.SetDNSStatus(userId, name, dnsCreated); err != nil {
+		logger(req.Context()).Printf("ERROR: updating DNS status of %s %v", dnsName(s), err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type retryDNSResult struct {
+	UserID string
+	Name   string
+	Error  string `json:",omitempty"`
+}
+
+// RetryDNS creates the records of every cluster whose DNS creation failed during create.
+func RetryDNS(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	if !dnsEnabled {
+		http.Error(w, "DNS is disabled", http.StatusConflict)
+		return
+	}
+	users, err := store.Users()
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: listing users %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	results := []retryDNSResult{}
+	for _, u := range users {
+		clusters, err := store.ListClusters(u)
+		if err != nil {
+			logger(req.Context()).Printf("ERROR: reading clusters of %s %v", u, err)
+			continue
+		}
+		for _, c := range clusters {
+			if c.DNSStatus != dnsPending {
+				continue
+			}
+			result := retryDNSResult{UserID: u, Name: c.Name}
+			s := service{UserID: u, Db: dbCluster{Name: c.Name, Subdomain: c.Subdomain, Domain: c.Domain}}
+			if err = connectService(req.Context(), s); err != nil {
+				logger(req.Context()).Printf("ERROR: retrying DNS for %s %v", dnsName(s), err)
+				result.Error = err.Error()
+			} else if err = store.SetDNSStatus(u, c.Name, dnsCreated); err != nil {
+				logger(req.Context()).Printf("ERROR: updating DNS status of %s %v", dnsName(s), err)
+				result.Error = err.Error()
+			}
+			results = append(results, result)
+		}
+	}
+	jsonBody, err := json.Marshal(results)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling retry DNS results %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// fakeCloudflare serves the DNS record endpoints of the Cloudflare API for one zone.
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records []cloudflare.DNSRecord
+	created int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasSuffix(req.URL.Path, "/dns_records") {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		var list []cloudflare.DNSRecord
+		q := req.URL.Query()
+		for _, r := range f.records {
+			if (q.Get("name") == "" || r.Name == q.Get("name")) && (q.Get("type") == "" || r.Type == q.Get("type")) {
+				list = append(list, r)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"result":      list,
+			"result_info": map[string]int{"page": 1, "per_page": 100, "total_pages": 1, "count": len(list), "total_count": len(list)},
+		})
+	case "POST":
+		var r cloudflare.DNSRecord
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.created++
+		r.ID = "created"
+		f.records = append(f.records, r)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": r})
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+// useFakeCloudflare makes the package manage its records with a Cloudflare client of f.
+func useFakeCloudflare(t *testing.T, f *fakeCloudflare) {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	api, err := cloudflare.NewWithAPIToken("test-token", cloudflare.UsingRetryPolicy(0, 0, 0), cloudflare.UsingRateLimit(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.BaseURL = server.URL
+	useDNSProvider(t, cloudflareProvider{api: api})
+}
+
+func TestConnectServiceDuplicateRecords(t *testing.T) {
+	name := recordName(testService)
+	for _, tt := range []struct {
+		name        string
+		existing    []cloudflare.DNSRecord
+		wantErr     error
+		wantCreated int
+	}{
+		{name: "no record", wantCreated: 1},
+		{
+			name:     "record to this host",
+			existing: []cloudflare.DNSRecord{{ID: "1", Type: "A", Name: name, Content: currentPublicIP()}},
+		},
+		{
+			name: "one of several records to this host",
+			existing: []cloudflare.DNSRecord{
+				{ID: "1", Type: "A", Name: name, Content: "198.51.100.7"},
+				{ID: "2", Type: "A", Name: name, Content: currentPublicIP()},
+			},
+		},
+		{
+			name:     "record elsewhere",
+			existing: []cloudflare.DNSRecord{{ID: "1", Type: "A", Name: name, Content: "198.51.100.7"}},
+			wantErr:  errDNSConflict,
+		},
+		{
+			name:        "record of another name",
+			existing:    []cloudflare.DNSRecord{{ID: "1", Type: "A", Name: "bob-db." + domain, Content: "198.51.100.7"}},
+			wantCreated: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCloudflare{records: tt.existing}
+			useFakeCloudflare(t, fake)
+			err := connectService(context.Background(), testService)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("connectService: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want %v, got %v", tt.wantErr, err)
+			}
+			if fake.created != tt.wantCreated {
+				t.Errorf("want %d records created, created %d", tt.wantCreated, fake.created)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// DNSRecord is a record of a cluster as a DNSProvider sees it.
+type DNSRecord struct {
+	ID      string
+	Type    string
+	Name    string
+	Content string
+}
+
+// DNSProvider manages the records of clusters in the zones of SPINUP_DNS_ZONES_FILE. spinup
+// talks to Cloudflare by default, or to Route53 or a webhook with SPINUP_DNS_PROVIDER; a program
+// embedding the package can supply its own with SetDNSProvider, e.g. MemoryDNSProvider to
+// exercise the DNS handling without a real provider.
+type DNSProvider interface {
+	// ListRecords returns the records of zoneID named name, of any type when recordType is empty.
+	ListRecords(ctx context.Context, zoneID, recordType, name string) ([]DNSRecord, error)
+	CreateRecord(ctx context.Context, zoneID string, r DNSRecord) error
+	// UpdateRecord replaces the record with the id of r.
+	UpdateRecord(ctx context.Context, zoneID string, r DNSRecord) error
+	DeleteRecord(ctx context.Context, zoneID, id string) error
+}
+
+// dnsProvider creates the records of every cluster.
+var dnsProvider DNSProvider
+
+// SetDNSProvider replaces the provider of SPINUP_DNS_PROVIDER records are managed with. It must be called
+// before the server handles requests.
+func SetDNSProvider(p DNSProvider) {
+	dnsProvider = p
+}
+
+// cloudflareProvider is the DNSProvider over the Cloudflare API.
+type cloudflareProvider struct {
+	api *cloudflare.API
+}
+
+func (c cloudflareProvider) ListRecords(ctx context.Context, zoneID, recordType, name string) ([]DNSRecord, error) {
+	records, err := c.api.DNSRecords(ctx, zoneID, cloudflare.DNSRecord{Type: recordType, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]DNSRecord, 0, len(records))
+	for _, r := range records {
+		list = append(list, DNSRecord{ID: r.ID, Type: r.Type, Name: r.Name, Content: r.Content})
+	}
+	return list, nil
+}
+
+func (c cloudflareProvider) CreateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	_, err := c.api.CreateDNSRecord(ctx, zoneID, cloudflare.DNSRecord{Type: r.Type, Name: r.Name, Content: r.Content})
+	return err
+}
+
+func (c cloudflareProvider) UpdateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	return c.api.UpdateDNSRecord(ctx, zoneID, r.ID, cloudflare.DNSRecord{Type: r.Type, Name: r.Name, Content: r.Content})
+}
+
+func (c cloudflareProvider) DeleteRecord(ctx context.Context, zoneID, id string) error {
+	return c.api.DeleteDNSRecord(ctx, zoneID, id)
+}
+
+// MemoryDNSProvider keeps records in memory, a fake for tests and for running spinup with DNS
+// but without Cloudflare. The zero value is ready to use.
+type MemoryDNSProvider struct {
+	mu      sync.Mutex
+	nextID  int
+	records map[string][]DNSRecord
+}
+
+func (m *MemoryDNSProvider) ListRecords(ctx context.Context, zoneID, recordType, name string) ([]DNSRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []DNSRecord
+	for _, r := range m.records[zoneID] {
+		if r.Name == name && (recordType == "" || r.Type == recordType) {
+			list = append(list, r)
+		}
+	}
+	return list, nil
+}
+
+func (m *MemoryDNSProvider) CreateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.records == nil {
+		m.records = map[string][]DNSRecord{}
+	}
+	m.nextID++
+	r.ID = strconv.Itoa(m.nextID)
+	m.records[zoneID] = append(m.records[zoneID], r)
+	return nil
+}
+
+func (m *MemoryDNSProvider) UpdateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, old := range m.records[zoneID] {
+		if old.ID == r.ID {
+			m.records[zoneID][i] = r
+			return nil
+		}
+	}
+	return fmt.Errorf("record %s not found in zone %s", r.ID, zoneID)
+}
+
+func (m *MemoryDNSProvider) DeleteRecord(ctx context.Context, zoneID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	records := m.records[zoneID]
+	for i, r := range records {
+		if r.ID == id {
+			m.records[zoneID] = append(records[:i], records[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("record %s not found in zone %s", id, zoneID)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// fakeDNSProvider keeps records like MemoryDNSProvider, records the calls made to it and fails
+// every call with err when it is set.
+type fakeDNSProvider struct {
+	MemoryDNSProvider
+	mu    sync.Mutex
+	calls []string
+	err   error
+}
+
+func (f *fakeDNSProvider) call(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, name)
+	return f.err
+}
+
+func (f *fakeDNSProvider) ListRecords(ctx context.Context, zoneID, recordType, name string) ([]DNSRecord, error) {
+	if err := f.call("list"); err != nil {
+		return nil, err
+	}
+	return f.MemoryDNSProvider.ListRecords(ctx, zoneID, recordType, name)
+}
+
+func (f *fakeDNSProvider) CreateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	if err := f.call("create"); err != nil {
+		return err
+	}
+	return f.MemoryDNSProvider.CreateRecord(ctx, zoneID, r)
+}
+
+func (f *fakeDNSProvider) UpdateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	if err := f.call("update"); err != nil {
+		return err
+	}
+	return f.MemoryDNSProvider.UpdateRecord(ctx, zoneID, r)
+}
+
+func (f *fakeDNSProvider) DeleteRecord(ctx context.Context, zoneID, id string) error {
+	if err := f.call("delete"); err != nil {
+		return err
+	}
+	return f.MemoryDNSProvider.DeleteRecord(ctx, zoneID, id)
+}
+
+// useDNSProvider makes the package manage its records with p for the rest of the test.
+func useDNSProvider(t *testing.T, p DNSProvider) {
+	previous := dnsProvider
+	dnsProvider = p
+	t.Cleanup(func() { dnsProvider = previous })
+}
+
+var testService = service{UserID: "alice", Db: dbCluster{Name: "db", Type: "postgres"}}
+
+// records returns the A records of s the provider holds.
+func records(t *testing.T, p DNSProvider, s service) []DNSRecord {
+	t.Helper()
+	list, err := p.ListRecords(context.Background(), zoneOf(s), "A", recordName(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestConnectServiceCreatesRecord(t *testing.T) {
+	fake := &fakeDNSProvider{}
+	useDNSProvider(t, fake)
+	if err := connectService(context.Background(), testService); err != nil {
+		t.Fatalf("connectService: %v", err)
+	}
+	list := records(t, fake, testService)
+	if len(list) != 1 || list[0].Name != "alice-db."+domain || list[0].Content != currentPublicIP() {
+		t.Fatalf("want one A record of alice-db.%s to %s, got %+v", domain, currentPublicIP(), list)
+	}
+	taken, err := subdomainTaken(context.Background(), testService)
+	if err != nil || !taken {
+		t.Errorf("want the name taken after connectService, got %v %v", taken, err)
+	}
+}
+
+func TestDisconnectServiceRemovesRecords(t *testing.T) {
+	fake := &fakeDNSProvider{}
+	useDNSProvider(t, fake)
+	ctx := context.Background()
+	for _, ip := range []string{currentPublicIP(), "198.51.100.7"} {
+		if err := fake.CreateRecord(ctx, zoneOf(testService), DNSRecord{Type: "A", Name: recordName(testService), Content: ip}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := disconnectService(ctx, testService); err != nil {
+		t.Fatalf("disconnectService: %v", err)
+	}
+	if list := records(t, fake, testService); len(list) != 0 {
+		t.Errorf("want no records left, got %+v", list)
+	}
+}
+
+func TestSyncServiceRepointsRecord(t *testing.T) {
+	fake := &fakeDNSProvider{}
+	useDNSProvider(t, fake)
+	ctx := context.Background()
+	if err := fake.CreateRecord(ctx, zoneOf(testService), DNSRecord{Type: "A", Name: recordName(testService), Content: "198.51.100.7"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncService(ctx, testService); err != nil {
+		t.Fatalf("syncService: %v", err)
+	}
+	list := records(t, fake, testService)
+	if len(list) != 1 || list[0].Content != currentPublicIP() {
+		t.Errorf("want the record repointed at %s, got %+v", currentPublicIP(), list)
+	}
+}
+
+func TestConnectServiceProviderFails(t *testing.T) {
+	unavailable := errors.New("provider unavailable")
+	fake := &fakeDNSProvider{err: unavailable}
+	useDNSProvider(t, fake)
+	if err := connectService(context.Background(), testService); !errors.Is(err, unavailable) {
+		t.Fatalf("want the error of the provider, got %v", err)
+	}
+	if len(fake.calls) != 1 || fake.calls[0] != "list" {
+		t.Errorf("want nothing created after a failed list, called %q", fake.calls)
+	}
+}
+
+func TestRecordOfAnotherUsersCluster(t *testing.T) {
+	owner := clusterInfo{UserID: "a-b", ClusterID: "cid", Name: "c", Type: "postgres", DNSStatus: dnsCreated}
+	if err := store.InsertCluster(owner); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DeleteCluster(owner.UserID, owner.Name) })
+	fake := &fakeDNSProvider{}
+	useDNSProvider(t, fake)
+	ctx := context.Background()
+	other := service{UserID: "a", Db: dbCluster{Name: "b-c", Type: "postgres"}}
+	if err := fake.CreateRecord(ctx, zoneOf(other), DNSRecord{Type: "A", Name: recordName(other), Content: currentPublicIP()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectService(ctx, other); !errors.Is(err, errDNSConflict) {
+		t.Errorf("want the record of cluster c of a-b refused to b-c of a, got %v", err)
+	}
+	if err := syncService(ctx, other); !errors.Is(err, errDNSConflict) {
+		t.Errorf("want the record of cluster c of a-b not synced for b-c of a, got %v", err)
+	}
+	if err := disconnectService(ctx, other); err != nil {
+		t.Fatalf("disconnectService: %v", err)
+	}
+	if list := records(t, fake, other); len(list) != 1 {
+		t.Errorf("want the record of cluster c of a-b kept, got %+v", list)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// dockerHost is the address of the remote docker host from DOCKER_HOST or DOCKER_CONTEXT,
+// empty when the clusters run on this host.
+var dockerHost string
+
+// dockerContext is the DOCKER_CONTEXT docker-compose is pointed at, docker reads it itself.
+var dockerContext string
+
+// remoteDockerHost finds the address of the docker host the docker commands talk to, empty
+// for the local daemon.
+func remoteDockerHost(ctx context.Context) (string, error) {
+	endpoint := os.Getenv("DOCKER_HOST")
+	if endpoint == "" && dockerContext != "" {
+		output, err := runner.Run(ctx, "docker", "context", "inspect", "--format", "{{.Endpoints.docker.Host}}", dockerContext)
+		if err != nil {
+			return "", err
+		}
+		endpoint = strings.TrimSpace(string(output))
+	}
+	if endpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing docker endpoint %q %v", endpoint, err)
+	}
+	switch u.Scheme {
+	case "unix", "npipe":
+		return "", nil
+	case "tcp", "ssh":
+		if u.Hostname() == "" {
+			return "", fmt.Errorf("docker endpoint %q has no host", endpoint)
+		}
+		return u.Hostname(), nil
+	}
+	return "", fmt.Errorf("docker endpoint %q has unsupported scheme %q", endpoint, u.Scheme)
+}
+
+// checkDockerHost makes sure the docker daemon answers.
+func checkDockerHost(ctx context.Context) error {
+	if _, err := runner.Run(ctx, "docker", "version", "--format", "{{.Server.Version}}"); err != nil {
+		return fmt.Errorf("connecting to docker host %s %v", dockerHost, err)
+	}
+	return nil
+}
+
+// hostName is the host clients reach the clusters at without DNS.
+func hostName() string {
+	if dockerHost != "" {
+		return dockerHost
+	}
+	return "localhost"
+}
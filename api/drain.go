@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// drain tracks the creates in flight, so a shutdown can wait for them after it stopped
+// accepting new ones. The other endpoints are served until the server itself shuts down.
+var drain struct {
+	sync.Mutex
+	draining bool
+	inflight int
+	// closed once draining and no create is in flight
+	done chan struct{}
+}
+
+// beginCreate registers a create, or answers with 503 once the server is draining and returns
+// false. A create which began must call endCreate when it is done.
+func beginCreate(w http.ResponseWriter) bool {
+	drain.Lock()
+	defer drain.Unlock()
+	if drain.draining {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "spinup is shutting down and doesn't accept new clusters, try again later", http.StatusServiceUnavailable)
+		return false
+	}
+	drain.inflight++
+	return true
+}
+
+func endCreate() {
+	drain.Lock()
+	defer drain.Unlock()
+	drain.inflight--
+	if drain.draining && drain.inflight == 0 {
+		close(drain.done)
+	}
+}
+
+// Drain stops accepting creates and waits until the creates in flight are done, or until ctx
+// is. It is called on shutdown before the server stops, and returns ctx.Err() when the creates
+// didn't finish in time.
+func Drain(ctx context.Context) error {
+	drain.Lock()
+	if !drain.draining {
+		drain.draining = true
+		drain.done = make(chan struct{})
+		if drain.inflight == 0 {
+			close(drain.done)
+		} else {
+			log.Printf("INFO: waiting for %d creates in flight", drain.inflight)
+		}
+	}
+	done := drain.done
+	drain.Unlock()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// driftReport is what differs between the metadata of the clusters and the host.
+type driftReport struct {
+	// cluster directories without metadata, left by creates which didn't finish
+	OrphanedDirs []orphanedDir
+	// containers started by spinup whose cluster has neither metadata nor a directory
+	OrphanedContainers []orphanedContainer
+	// A records pointing at this host under the default name of an orphaned cluster
+	OrphanedDNSRecords []orphanedRecord
+	// clusters in metadata whose container is gone
+	MissingContainers []missingCluster
+	// clusters in metadata whose docker-compose file is gone
+	MissingFiles []missingCluster
+	// to pass as confirm to prune exactly this drift
+	ConfirmToken string
+	// set once the orphans were removed, with the errors removing some of them
+	Pruned bool     `json:",omitempty"`
+	Errors []string `json:",omitempty"`
+}
+
+type orphanedContainer struct {
+	ID   string
+	Name string
+	// the cluster label of the container, <userID>/<name>
+	Cluster string
+}
+
+type orphanedRecord struct {
+	ZoneID  string
+	ID      string
+	Name    string
+	Content string
+}
+
+type missingCluster struct {
+	UserID    string
+	Name      string
+	ClusterID string
+}
+
+// reconcileTimeout caps how long a drift report, including a prune, may take.
+const reconcileTimeout = 5 * time.Minute
+
+// AdminReconcile reports the drift between the metadata and the host as JSON without changing
+// anything. With prune=true, which has to be a POST, the orphans of the report are removed:
+// directories, containers and DNS records. confirm must be the ConfirmToken of a report of the
+// same drift, so only what was reviewed is removed. Clusters in metadata are never removed, as
+// the metadata may be the only record of them; delete them through the API.
+func AdminReconcile(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET", "POST") {
+		return
+	}
+	prune := req.URL.Query().Get("prune") == "true"
+	if prune && req.Method != "POST" {
+		http.Error(w, "prune=true must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), reconcileTimeout)
+	defer cancel()
+	report, err := findDrift(ctx)
+	if err != nil {
+		logger(ctx).Printf("ERROR: finding drift %v", err)
+		http.Error(w, "Error finding drift", 500)
+		return
+	}
+	if prune {
+		if req.URL.Query().Get("confirm") != report.ConfirmToken {
+			http.Error(w, "confirm doesn't match the current drift, review the report again", http.StatusConflict)
+			return
+		}
+		pruneDrift(ctx, &report)
+	}
+	writeJSON(w, req, report)
+}
+
+// findDrift compares the metadata with the cluster directories, the containers spinup started
+// and the DNS records of orphaned clusters.
+func findDrift(ctx context.Context) (driftReport, error) {
+	report := driftReport{
+		OrphanedContainers: []orphanedContainer{},
+		OrphanedDNSRecords: []orphanedRecord{},
+		MissingContainers:  []missingCluster{},
+		MissingFiles:       []missingCluster{},
+	}
+	var err error
+	if report.OrphanedDirs, err = orphanedDirs(); err != nil {
+		return report, err
+	}
+	output, err := runner.Run(ctx, "docker", "ps", "-a", "--no-trunc", "--filter", "label="+managedLabel+"=spinup", "--format", "{{.ID}}\t{{.Names}}\t{{.Label \""+clusterLabel+"\"}}")
+	if err != nil {
+		return report, err
+	}
+	var containerIDs []string
+	// orphans by <userID>/<name>, the containers of an orphaned directory go with it
+	orphans := map[string]bool{}
+	for _, o := range report.OrphanedDirs {
+		orphans[o.UserID+"/"+o.Name] = true
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		containerIDs = append(containerIDs, fields[0])
+		if orphans[fields[2]] {
+			continue
+		}
+		parts := strings.SplitN(fields[2], "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if _, err := store.GetCluster(parts[0], parts[1]); !errors.Is(err, sql.ErrNoRows) {
+			if err != nil {
+				return report, err
+			}
+			continue
+		}
+		report.OrphanedContainers = append(report.OrphanedContainers, orphanedContainer{ID: fields[0], Name: fields[1], Cluster: fields[2]})
+	}
+	err = store.EachCluster(func(c clusterInfo) error {
+		m := missingCluster{UserID: c.UserID, Name: c.Name, ClusterID: c.ClusterID}
+		if !exists(filepath.Join(servicePath(c.UserID, c.Type, c.Name), "docker-compose.yml")) {
+			report.MissingFiles = append(report.MissingFiles, m)
+		}
+		for _, id := range containerIDs {
+			if c.ClusterID != "" && strings.HasPrefix(id, c.ClusterID) {
+				return nil
+			}
+		}
+		report.MissingContainers = append(report.MissingContainers, m)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if dnsEnabled {
+		if err = findOrphanedRecords(ctx, &report); err != nil {
+			return report, err
+		}
+	}
+	report.ConfirmToken = driftToken(report)
+	return report, nil
+}
+
+// findOrphanedRecords adds the records of the orphaned clusters of report. Records can only be
+// looked up by name, so those of orphans with a custom subdomain or domain aren't found. Both
+// the default name and the one of SPINUP_DNS_NAME_TEMPLATE are looked up.
+func findOrphanedRecords(ctx context.Context, report *driftReport) error {
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var candidates []service
+	for _, o := range report.OrphanedDirs {
+		candidates = append(candidates, service{UserID: o.UserID, Db: dbCluster{Name: o.Name}})
+	}
+	for _, o := range report.OrphanedContainers {
+		if parts := strings.SplitN(o.Cluster, "/", 2); len(parts) == 2 {
+			candidates = append(candidates, service{UserID: parts[0], Db: dbCluster{Name: parts[1]}})
+		}
+	}
+	if dnsNameTemplate != nil {
+		for _, s := range candidates {
+			if name, err := templatedDNSName(s); err == nil {
+				s.Db.Subdomain = name
+				candidates = append(candidates, s)
+			}
+		}
+	}
+	seen := map[string]bool{}
+	ip := currentPublicIP()
+	for _, s := range candidates {
+		name := recordName(s)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		records, err := dnsProvider.ListRecords(ctx, zoneOf(s), "A", name)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			// a record pointing elsewhere isn't this host's to remove
+			if r.Content == ip {
+				report.OrphanedDNSRecords = append(report.OrphanedDNSRecords, orphanedRecord{ZoneID: zoneOf(s), ID: r.ID, Name: r.Name, Content: r.Content})
+			}
+		}
+	}
+	return nil
+}
+
+// driftToken identifies the drift of report, so a prune can be tied to the report it was
+// reviewed from.
+func driftToken(report driftReport) string {
+	report.ConfirmToken = ""
+	body, _ := json.Marshal(report)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:16])
+}
+
+// pruneDrift removes the orphans of report, recording the errors of those it couldn't remove
+// in it.
+func pruneDrift(ctx context.Context, report *driftReport) {
+	fail := func(err error) {
+		logger(ctx).Printf("ERROR: pruning drift %v", err)
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, o := range report.OrphanedDirs {
+		if err := rollbackCreate(ctx, o.UserID, o.dir); err != nil {
+			fail(err)
+			continue
+		}
+		logger(ctx).Printf("INFO: pruned unfinished create of %s of user %s", o.Name, o.UserID)
+	}
+	for _, o := range report.OrphanedContainers {
+		if _, err := runner.Run(ctx, "docker", "rm", "-f", "-v", o.ID); err != nil {
+			fail(err)
+			continue
+		}
+		logger(ctx).Printf("INFO: pruned orphaned container %s of %s", o.Name, o.Cluster)
+	}
+	for _, r := range report.OrphanedDNSRecords {
+		if err := dnsProvider.DeleteRecord(ctx, r.ZoneID, r.ID); err != nil {
+			fail(err)
+			continue
+		}
+		logger(ctx).Printf("INFO: pruned orphaned DNS record %s", r.Name)
+	}
+	report.Pruned = true
+}
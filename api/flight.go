@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// createFlight collapses concurrent creates of the same cluster into one. Until the first of
+// them records the cluster in metadata, a second create of the same name passes the check for
+// an existing cluster and would provision it a second time.
+var createFlight singleflight.Group
+
+// flightRequests are the hashes of the requests in flight by user/name, and how many callers
+// wait for each, so a different request for a name in flight isn't handed the result of
+// another.
+var flightRequests = struct {
+	sync.Mutex
+	byKey map[string]*flightRequest
+}{byKey: map[string]*flightRequest{}}
+
+type flightRequest struct {
+	hash    [sha256.Size]byte
+	waiters int
+	// ctx is the context the create runs on. It isn't the context of any caller, so one
+	// giving up doesn't fail the create for the others; cancel ends it once all gave up.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is set once the create returned
+	done bool
+}
+
+// createOnce creates the service of s, unless an identical create of it is in flight, in
+// which case it waits for that one and returns its result. A create of the same name with
+// another request fails with 409 CONFLICT, like it would once the first one recorded the
+// cluster. A caller whose ctx is done stops waiting, the create is only cancelled when every
+// caller did, and the last one waits for it to be rolled back.
+func createOnce(ctx context.Context, s service) (serviceResponse, error) {
+	key := s.UserID + "/" + s.Db.Name
+	body, err := json.Marshal(s)
+	if err != nil {
+		return serviceResponse{}, err
+	}
+	hash := sha256.Sum256(body)
+	flightRequests.Lock()
+	fr, ok := flightRequests.byKey[key]
+	// without waiters the create is being cancelled and rolled back
+	if ok && (fr.hash != hash || fr.waiters == 0) {
+		flightRequests.Unlock()
+		return serviceResponse{}, &serviceError{status: http.StatusConflict, msg: "a create of a cluster with this name is in progress"}
+	}
+	if !ok {
+		fr = &flightRequest{hash: hash}
+		flightCtx := detach(ctx)
+		if id := ctx.Value(jobKey); id != nil {
+			// so a cancelled job still rolls the create back between its stages
+			flightCtx = context.WithValue(flightCtx, jobKey, id)
+		}
+		fr.ctx, fr.cancel = context.WithCancel(flightCtx)
+		flightRequests.byKey[key] = fr
+	}
+	fr.waiters++
+	flightRequests.Unlock()
+	// leave reports whether the caller was the last to give up on the unfinished create
+	leave := func() bool {
+		flightRequests.Lock()
+		defer flightRequests.Unlock()
+		if fr.waiters--; fr.waiters > 0 {
+			return false
+		}
+		fr.cancel()
+		if !fr.done {
+			return true
+		}
+		if flightRequests.byKey[key] == fr {
+			delete(flightRequests.byKey, key)
+		}
+		return false
+	}
+	results := createFlight.DoChan(key, func() (interface{}, error) {
+		res, err := createService(fr.ctx, s)
+		flightRequests.Lock()
+		fr.done = true
+		if fr.waiters == 0 && flightRequests.byKey[key] == fr {
+			delete(flightRequests.byKey, key)
+		}
+		flightRequests.Unlock()
+		return res, err
+	})
+	select {
+	case r := <-results:
+		leave()
+		if r.Shared {
+			logger(ctx).Printf("INFO: shared the result of a concurrent create of %s", key)
+		}
+		return r.Val.(serviceResponse), r.Err
+	case <-ctx.Done():
+		if leave() {
+			r := <-results
+			return r.Val.(serviceResponse), r.Err
+		}
+		logger(ctx).Printf("INFO: stopped waiting for the create of %s %v", key, ctx.Err())
+		return serviceResponse{}, ctx.Err()
+	}
+}
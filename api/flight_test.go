@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingRunner holds the first command it runs until release is closed, so a create stays
+// in flight while the test starts others.
+type blockingRunner struct {
+	fakeRunner
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingRunner() *blockingRunner {
+	return &blockingRunner{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (b *blockingRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	first := false
+	b.once.Do(func() { first = true })
+	if first {
+		close(b.started)
+		<-b.release
+	}
+	return b.fakeRunner.Run(ctx, name, args...)
+}
+
+// waitForWaiters waits until n callers wait for the create of key.
+func waitForWaiters(t *testing.T, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		flightRequests.Lock()
+		fr, ok := flightRequests.byKey[key]
+		waiters := 0
+		if ok {
+			waiters = fr.waiters
+		}
+		flightRequests.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d callers didn't join the create of %s", n, key)
+}
+
+func flightService() service {
+	return service{UserID: "alice", Architecture: "amd64", Db: dbCluster{Name: "flight", Type: "postgres"}}
+}
+
+func TestCreateOnceSharesConcurrentCreates(t *testing.T) {
+	blocking := newBlockingRunner()
+	// no container comes up, so the shared create fails once it provisioned the cluster
+	blocking.on("ps -q", "", errors.New("no such service"))
+	useRunner(t, blocking)
+	t.Cleanup(func() { store.DeleteCluster("alice", "flight") })
+
+	const callers = 5
+	type result struct {
+		res serviceResponse
+		err error
+	}
+	results := make(chan result, callers)
+	create := func() {
+		res, err := createOnce(context.Background(), flightService())
+		results <- result{res, err}
+	}
+	go create()
+	<-blocking.started
+	for i := 1; i < callers; i++ {
+		go create()
+	}
+	waitForWaiters(t, "alice/flight", callers)
+	close(blocking.release)
+
+	first := <-results
+	for i := 1; i < callers; i++ {
+		r := <-results
+		if fmt.Sprint(r.err) != fmt.Sprint(first.err) || r.res != first.res {
+			t.Errorf("want every caller to get the result of the one create, got %+v %v and %+v %v", first.res, first.err, r.res, r.err)
+		}
+	}
+	if ups := blocking.ran(" up -d"); len(ups) != 1 {
+		t.Errorf("want the cluster provisioned once, ran %q", ups)
+	}
+	flightRequests.Lock()
+	defer flightRequests.Unlock()
+	if _, ok := flightRequests.byKey["alice/flight"]; ok {
+		t.Error("want the create forgotten once every caller returned")
+	}
+}
+
+func TestCreateOnceConflictingRequest(t *testing.T) {
+	blocking := newBlockingRunner()
+	useRunner(t, blocking)
+	t.Cleanup(func() { store.DeleteCluster("alice", "flight") })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		createOnce(context.Background(), flightService())
+	}()
+	<-blocking.started
+	other := flightService()
+	other.Db.Memory = "1g"
+	_, err := createOnce(context.Background(), other)
+	var serr *serviceError
+	if !errors.As(err, &serr) || serr.status != http.StatusConflict {
+		t.Errorf("want 409 for another request of a name in flight, got %v", err)
+	}
+	close(blocking.release)
+	<-done
+}
+
+func TestCreateOnceOutlivesACallerGivingUp(t *testing.T) {
+	blocking := newBlockingRunner()
+	blocking.on("ps -q", "", errors.New("no such service"))
+	useRunner(t, blocking)
+	t.Cleanup(func() { store.DeleteCluster("alice", "flight") })
+
+	// a job, whose cancellation the create checks for between its stages
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), jobKey, "job"))
+	gaveUp := make(chan error, 1)
+	go func() {
+		_, err := createOnce(ctx, flightService())
+		gaveUp <- err
+	}()
+	<-blocking.started
+	shared := make(chan error, 1)
+	go func() {
+		_, err := createOnce(context.Background(), flightService())
+		shared <- err
+	}()
+	waitForWaiters(t, "alice/flight", 2)
+	cancel()
+	if err := <-gaveUp; !errors.Is(err, context.Canceled) {
+		t.Errorf("want the caller which gave up to stop waiting, got %v", err)
+	}
+	close(blocking.release)
+	// no container comes up, so the create which carried on fails
+	err := <-shared
+	var serr *serviceError
+	if !errors.As(err, &serr) || serr.status != http.StatusInternalServerError {
+		t.Errorf("want the create to carry on for the other caller, got %v", err)
+	}
+}
+
+func TestCreateOnceCancelledByEveryCaller(t *testing.T) {
+	blocking := newBlockingRunner()
+	useRunner(t, blocking)
+	t.Cleanup(func() { store.DeleteCluster("alice", "flight") })
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), jobKey, "job"))
+	done := make(chan error, 1)
+	go func() {
+		_, err := createOnce(ctx, flightService())
+		done <- err
+	}()
+	<-blocking.started
+	cancel()
+	waitForWaiters(t, "alice/flight", 0)
+	_, err := createOnce(context.Background(), flightService())
+	var serr *serviceError
+	if !errors.As(err, &serr) || serr.status != http.StatusConflict {
+		t.Errorf("want 409 while the cancelled create is rolled back, got %v", err)
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("want the last caller to wait for the rollback, it returned %v", err)
+	default:
+	}
+	close(blocking.release)
+	if err = <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("want the create cancelled once every caller gave up, got %v", err)
+	}
+	flightRequests.Lock()
+	defer flightRequests.Unlock()
+	if _, ok := flightRequests.byKey["alice/flight"]; ok {
+		t.Error("want the create forgotten once it was rolled back")
+	}
+}
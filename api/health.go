@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthPortThreshold is the share of the port range in use, in percent, from which spinup
+// reports itself degraded, from SPINUP_HEALTH_PORT_THRESHOLD.
+var healthPortThreshold = 90
+
+// healthTimeout bounds the checks of docker and the DNS provider, so a scrape answers quickly.
+const healthTimeout = 5 * time.Second
+
+type healthResponse struct {
+	// ok, or unavailable when the metadata store can't be read
+	Status string
+	// whether spinup serves requests but some of them are likely to fail, see Details
+	Degraded bool
+	Details  []string   `json:",omitempty"`
+	Ports    *portUsage `json:",omitempty"`
+	// clusters in metadata, including the deleted ones still retained
+	Clusters int
+	// clusters with a running container, only known when docker is reachable
+	Running *int `json:",omitempty"`
+	Docker  componentHealth
+	// only checked when DNS is enabled
+	DNS *componentHealth `json:",omitempty"`
+}
+
+type portUsage struct {
+	// ports of clusters and of creates in flight within the range
+	Used  int
+	Total int
+}
+
+type componentHealth struct {
+	Reachable bool
+	Error     string `json:",omitempty"`
+}
+
+// Health reports whether spinup can serve requests, which needs the metadata store, along with
+// gauges for monitoring: the ports in use, the number of clusters and whether docker and the
+// DNS provider answer. It answers 200 while the store can be read, with Degraded set when
+// creates are likely to fail.
+func Health(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	clusters, err := store.CountClusters()
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: health check reading metadata store %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJSON(w, req, healthResponse{Status: "unavailable", Degraded: true, Details: []string{"metadata store can't be read"}})
+		return
+	}
+	res := healthResponse{Status: "ok", Clusters: clusters}
+	ctx, cancel := context.WithTimeout(req.Context(), healthTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		running, err := runningClusters(ctx)
+		if err != nil {
+			res.Docker.Error = err.Error()
+			return
+		}
+		res.Docker.Reachable = true
+		res.Running = &running
+	}()
+	if dnsEnabled {
+		res.DNS = &componentHealth{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := checkDNSProvider(ctx); err != nil {
+				res.DNS.Error = err.Error()
+				return
+			}
+			res.DNS.Reachable = true
+		}()
+	}
+	if res.Ports, err = usedPorts(); err != nil {
+		logger(req.Context()).Printf("ERROR: health check reading allocated ports %v", err)
+		res.Details = append(res.Details, "allocated ports can't be read")
+	} else if res.Ports.Used*100 >= res.Ports.Total*healthPortThreshold {
+		res.Details = append(res.Details, fmt.Sprintf("%d of %d ports are in use", res.Ports.Used, res.Ports.Total))
+	}
+	wg.Wait()
+	if !res.Docker.Reachable {
+		res.Details = append(res.Details, "docker is unreachable")
+	}
+	if res.DNS != nil && !res.DNS.Reachable {
+		res.Details = append(res.Details, dnsProviderName+" DNS provider is unreachable")
+	}
+	res.Degraded = len(res.Details) > 0
+	writeJSON(w, req, res)
+}
+
+// usedPorts counts the ports of the range which are allocated to clusters or reserved by
+// creates in flight.
+func usedPorts() (*portUsage, error) {
+	allocated, err := store.AllocatedPorts()
+	if err != nil {
+		return nil, err
+	}
+	usage := &portUsage{Total: endPort - firstPort}
+	portMu.Lock()
+	defer portMu.Unlock()
+	for port := firstPort; port < endPort; port++ {
+		_, isAllocated := allocated[port]
+		_, isReserved := reservedPorts[port]
+		if isAllocated || isReserved {
+			usage.Used++
+		}
+	}
+	return usage, nil
+}
+
+// runningClusters counts the clusters with a running container, by the cluster label of
+// their containers.
+func runningClusters(ctx context.Context) (int, error) {
+	output, err := runner.Run(ctx, "docker", "ps", "--filter", "label=host.spinup.cluster", "--filter", "status=running", "--format", `{{.Label "host.spinup.cluster"}}`)
+	if err != nil {
+		return 0, err
+	}
+	clusters := map[string]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			clusters[line] = true
+		}
+	}
+	return len(clusters), nil
+}
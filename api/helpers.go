@@ -1,17 +1,23 @@
 package api
 
 import (
+	"compress/gzip"
+	crand "crypto/rand"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/golang/gddo/httputil/header"
 )
@@ -31,6 +37,78 @@ func (mr *malformedRequest) Error() string {
 	return mr.msg
 }
 
+// maxJSONBody is the largest JSON body accepted, after decompression.
+const maxJSONBody = 1048576
+
+// maxUploadBytes is the largest body accepted by the endpoints which take uploads rather than
+// a JSON object, like an import, from SPINUP_MAX_UPLOAD_BYTES. It is enforced while the upload
+// is read, so it is never held in memory as a whole.
+var maxUploadBytes int64 = 1 << 30
+
+// contentEncodings are the Content-Encodings accepted on request bodies, from SPINUP_CONTENT_ENCODINGS.
+var contentEncodings = map[string]bool{"gzip": true}
+
+var errBodyTooLarge = errors.New("http: request body too large")
+
+// limitedReader fails with errBodyTooLarge instead of ending the body early like io.LimitReader.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// requestBody returns the body of r decompressed according to its Content-Encoding. Both the
+// body as sent and the decompressed body are limited to max bytes, so a small compressed body
+// can't expand into an unbounded one.
+func requestBody(w http.ResponseWriter, r *http.Request, max int64) (io.Reader, error) {
+	body := http.MaxBytesReader(w, r.Body, max)
+	r.Body = body
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch {
+	case encoding == "" || encoding == "identity":
+		return body, nil
+	case !contentEncodings[encoding]:
+		msg := fmt.Sprintf("Content-Encoding %s is not supported", encoding)
+		return nil, &malformedRequest{status: http.StatusUnsupportedMediaType, msg: msg}
+	}
+	// gzip is the only encoding spinup knows
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		msg := "Request body is not valid gzip"
+		return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg}
+	}
+	return &limitedReader{r: gz, n: max}, nil
+}
+
+// allowMethod checks the method of req against the methods a handler serves, and reports
+// whether the handler should go on. OPTIONS is answered with the allowed methods, any other
+// method with 405 METHOD NOT ALLOWED, both with an Allow header.
+func allowMethod(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", ")+", OPTIONS")
+	if req.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+	return false
+}
+
 func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	if r.Header.Get("Content-Type") != "" {
 		value, _ := header.ParseValueAndParams(r.Header, "Content-Type")
@@ -40,12 +118,15 @@ func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 		}
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	body, err := requestBody(w, r, maxJSONBody)
+	if err != nil {
+		return err
+	}
 
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
-	err := dec.Decode(&dst)
+	err = dec.Decode(&dst)
 	if err != nil {
 		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
@@ -72,7 +153,7 @@ func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 			msg := "Request body must not be empty"
 			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
 
-		case err.Error() == "http: request body too large":
+		case errors.Is(err, errBodyTooLarge) || err.Error() == "http: request body too large":
 			msg := "Request body must not be larger than 1MB"
 			return &malformedRequest{status: http.StatusRequestEntityTooLarge, msg: msg}
 
@@ -111,7 +192,8 @@ func createDockerComposeFile(absolutepath string, s service) error {
 	}
 
 	defer f.Close() // don't forget to close the file when finished.
-	templ, err := template.ParseFS(dockerTempl, "docker-compose-template.yml")
+	t := dbTypes[s.Db.Type]
+	templ, err := template.ParseFS(dockerTempl, "templates/"+t.template)
 	if err != nil {
 		return fmt.Errorf("ERROR: parsing template file %v", err)
 	}
@@ -122,13 +204,93 @@ func createDockerComposeFile(absolutepath string, s service) error {
 		Architecture string
 		Type         string
 		Port         int
-		Secret       string
+		Username     string
+		DataDir      string
+		Pooler       bool
+		PoolerPort   int
+		PoolerImage  string
+		// Metrics runs the exporter on MetricsPort of MetricsBind
+		Metrics       bool
+		MetricsPort   int
+		MetricsBind   string
+		ExporterImage string
+		Image         string
+		ReplicaSet    bool
+		// MaxConnections is 0 to keep the server default
+		MaxConnections int
+		// ExistingVolume is mounted instead of DataDir when set
+		ExistingVolume string
+		// RunAsUser is the UID:GID of the database, the image default when empty
+		RunAsUser string
+		// MemoryLimit is the memory limit of the database in bytes, unbounded when 0
+		MemoryLimit int64
+		// CPUShares is the CPU weight of the database for a reservation, the default when 0
+		CPUShares int64
+		// CPUSet are the host cores the database is pinned to, any core when empty
+		CPUSet string
+		// TLS mounts the certificate of the cluster and turns on ssl
+		TLS bool
+		// Cluster is <userID>/<name>, the label of the cluster's containers
+		Cluster string
+		// ComposeVersion is the compose file format, SPINUP_COMPOSE_VERSION
+		ComposeVersion string
+		// Name and CreatedAt label the containers along with UserID
+		Name      string
+		CreatedAt string
+		// LogDriver and LogOptions set the docker logging of the containers, the daemon's
+		// default when LogDriver is empty
+		LogDriver  string
+		LogOptions map[string]string
+		// InitdbArgs are the POSTGRES_INITDB_ARGS setting the encoding and locale
+		InitdbArgs string
+		// Network is an external network the containers join besides the default one
+		Network string
+		// Profiles declares the compose profiles of the optional services
+		Profiles bool
 	}{
 		s.UserID,
 		s.Architecture,
 		s.Db.Type,
 		s.Db.Port,
-		"replaceme",
+		s.Db.Username,
+		dataPath(s.UserID, s.Db.Type, s.Db.Name),
+		s.Db.Pooler,
+		s.Db.PoolerPort,
+		poolerImage,
+		s.Db.Metrics,
+		s.Db.MetricsPort,
+		metricsBindAddress,
+		exporterImage,
+		t.image(s),
+		s.Db.ReplicaSet,
+		s.Db.MaxConnections,
+		s.Db.ExistingVolume,
+		s.Db.RunAsUser,
+		0,
+		0,
+		s.Db.CPUSet,
+		s.Db.TLS,
+		s.UserID + "/" + s.Db.Name,
+		composeVersion,
+		s.Db.Name,
+		time.Now().UTC().Format(time.RFC3339),
+		containerLogDriver,
+		containerLogOptions,
+		initdbArgs(s.Db),
+		s.Db.Network,
+		profilesSupported,
+	}
+	if s.Db.Memory != "" {
+		// validated by createService
+		data.MemoryLimit, _ = parseSize("memory", s.Db.Memory)
+	}
+	if s.Db.CPUs != "" {
+		// validated by createService
+		cpus, _ := strconv.ParseFloat(s.Db.CPUs, 64)
+		data.CPUShares = cpuShares(cpus)
+	}
+	if s.Db.ExistingVolume != "" {
+		data.DataDir = s.Db.ExistingVolume
 	}
 	err = templ.Execute(f, data)
 	if err != nil {
@@ -136,3 +298,36 @@ func createDockerComposeFile(absolutepath string, s service) error {
 	}
 	return nil
 }
+
+// initdbArgs are the arguments of initdb for the encoding and locale of db, empty for the defaults.
+func initdbArgs(db dbCluster) string {
+	var args []string
+	if db.Encoding != "" {
+		args = append(args, "--encoding="+db.Encoding)
+	}
+	if db.Locale != "" {
+		args = append(args, "--locale="+db.Locale)
+	}
+	return strings.Join(args, " ")
+}
+
+// writeMongoKeyfile writes the key the members of a mongo replica set authenticate each other with.
+func writeMongoKeyfile(path string) error {
+	key := make([]byte, 756)
+	if _, err := crand.Read(key); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, "mongo-keyfile"), []byte(base64.StdEncoding.EncodeToString(key)), 0400)
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating directory %s %v", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".spinup-write-check")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// renderCompose renders the compose file of s and returns its services.
+func renderCompose(t *testing.T, s service) map[string]struct {
+	Labels      map[string]string
+	Ports       []string
+	Environment map[string]string
+} {
+	t.Helper()
+	dir := t.TempDir()
+	if err := createDockerComposeFile(dir, s); err != nil {
+		t.Fatalf("createDockerComposeFile: %v", err)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file struct {
+		Services map[string]struct {
+			Labels      map[string]string
+			Ports       []string
+			Environment map[string]string
+		}
+	}
+	if err = yaml.Unmarshal(body, &file); err != nil {
+		t.Fatalf("parsing the rendered compose file: %v\n%s", err, body)
+	}
+	return file.Services
+}
+
+func TestComposeLabels(t *testing.T) {
+	for name, typ := range dbTypes {
+		t.Run(name, func(t *testing.T) {
+			s := service{
+				UserID:       "alice",
+				Architecture: "amd64",
+				Db: dbCluster{
+					Name:        "db",
+					Type:        name,
+					Port:        5432,
+					Username:    typ.defaultUsername,
+					Pooler:      typ.pooler,
+					PoolerPort:  6432,
+					Metrics:     typ.metrics,
+					MetricsPort: 9187,
+				},
+			}
+			services := renderCompose(t, s)
+			want := 1
+			if typ.pooler {
+				want++
+			}
+			if typ.metrics {
+				want++
+			}
+			if _, ok := services[typ.service]; !ok || len(services) != want {
+				t.Fatalf("want %s and %d services in the rendered file, got %d", typ.service, want, len(services))
+			}
+			for service, c := range services {
+				for label, want := range map[string]string{
+					clusterLabel:        "alice/db",
+					"spinup.managed_by": "spinup",
+					"spinup.user_id":    "alice",
+					"spinup.db_name":    "db",
+				} {
+					if got := c.Labels[label]; got != want {
+						t.Errorf("service %s: want label %s=%q, got %q", service, label, want, got)
+					}
+				}
+				if _, err := time.Parse(time.RFC3339, c.Labels["spinup.created_at"]); err != nil {
+					t.Errorf("service %s: spinup.created_at isn't an RFC 3339 time: %v", service, err)
+				}
+			}
+		})
+	}
+}
+
+func TestComposeExporterPort(t *testing.T) {
+	s := service{UserID: "alice", Architecture: "amd64", Db: dbCluster{Name: "db", Type: "postgres", Port: 5432, Metrics: true, MetricsPort: 9187}}
+	services := renderCompose(t, s)
+	if ports := services["exporter"].Ports; len(ports) != 1 || ports[0] != "127.0.0.1:9187:9187" {
+		t.Errorf("want the exporter only published on the loopback address, got %q", ports)
+	}
+
+	previous := metricsBindAddress
+	metricsBindAddress = "10.0.0.5"
+	t.Cleanup(func() { metricsBindAddress = previous })
+	services = renderCompose(t, s)
+	if ports := services["exporter"].Ports; len(ports) != 1 || ports[0] != "10.0.0.5:9187:9187" {
+		t.Errorf("want the exporter published on SPINUP_METRICS_BIND_ADDRESS, got %q", ports)
+	}
+}
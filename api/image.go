@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// pull policies of SPINUP_PULL_POLICY
+const (
+	// pull the images before every create
+	pullAlways = "always"
+	// pull only the images which aren't on the host yet
+	pullMissing = "missing"
+	// never pull, creates fail when an image isn't on the host
+	pullNever = "never"
+)
+
+var pullPolicy = pullMissing
+
+const poolerImage = "edoburu/pgbouncer"
+
+const exporterImage = "quay.io/prometheuscommunity/postgres-exporter"
+
+// imageError is returned when an image of a service isn't available, so that clients can tell
+// it apart from docker-compose up failing.
+type imageError struct {
+	image string
+	// missing is set when the image isn't on the host and the pull policy forbids pulling it
+	missing bool
+	err     error
+}
+
+func (e *imageError) Error() string {
+	if e.missing {
+		return fmt.Sprintf("image %s is not on this host and SPINUP_PULL_POLICY is never", e.image)
+	}
+	return fmt.Sprintf("pulling image %s %v", e.image, e.err)
+}
+
+// serviceImages lists the images the generated docker-compose file of s uses.
+func serviceImages(s service) []string {
+	images := []string{dbTypes[s.Db.Type].image(s)}
+	if s.Db.Pooler {
+		images = append(images, poolerImage)
+	}
+	if s.Db.Metrics {
+		images = append(images, exporterImage)
+	}
+	return images
+}
+
+// pullImages makes sure the images of s are on the host according to pullPolicy.
+func pullImages(s service) error {
+	for _, image := range serviceImages(s) {
+		if pullPolicy != pullAlways && imageExists(image) {
+			continue
+		}
+		if pullPolicy == pullNever {
+			return &imageError{image: image, missing: true}
+		}
+		if err := pullImage(image); err != nil {
+			return &imageError{image: image, err: err}
+		}
+	}
+	return nil
+}
+
+func imageExists(image string) bool {
+	_, err := runner.Run(context.Background(), "docker", "image", "inspect", image)
+	return err == nil
+}
+
+// pullImage runs docker pull, logging its progress as it goes.
+func pullImage(image string) error {
+	log.Printf("INFO: pulling image %s", image)
+	err := runLines(context.Background(), func(line string) {
+		log.Printf("INFO: pulling image %s: %s", image, line)
+	}, "docker", "pull", image)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: pulled image %s", image)
+	return nil
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// states of a job
+const (
+	// waiting for a slot of the operation, e.g. of SPINUP_MAX_CONCURRENT_BACKUPS
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// kinds of jobs
+const (
+	jobCreate  = "create"
+	jobDelete  = "delete"
+	jobClone   = "clone"
+	jobBackup  = "backup"
+	jobRestore = "restore"
+)
+
+// jobRetention is how long finished jobs are kept.
+const jobRetention = 7 * 24 * time.Hour
+
+// job tracks a long operation which runs in the background, so the client which started it
+// can poll for its outcome instead of waiting on the request. Jobs are kept in the metadata
+// store and outlive a restart, but the work of an unfinished job doesn't.
+type job struct {
+	ID     string
+	UserID string
+	// what the job does, one of create, delete, clone, backup or restore
+	Kind string
+	// the cluster the job works on
+	Name      string
+	State     string
+	CreatedAt int64
+	UpdatedAt int64
+	// the response of the operation once it succeeded
+	Result json.RawMessage `json:",omitempty"`
+	// the message and status code of the operation's error once it failed
+	Error  string `json:",omitempty"`
+	Status int    `json:",omitempty"`
+}
+
+// errJobInterrupted is the error of the jobs which were unfinished when spinup stopped.
+const errJobInterrupted = "interrupted by a restart of spinup"
+
+// jobCancels are the functions canceling the context of the unfinished jobs by id.
+var jobCancels = struct {
+	sync.Mutex
+	byID map[string]context.CancelFunc
+}{byID: map[string]context.CancelFunc{}}
+
+// startJob records a job of kind on the cluster name of userID and runs fn in the
+// background, once it got a slot of sem unless sem is nil. The job is queued until then. ctx
+// is detached from the request, so fn keeps running after it was answered, but it is canceled
+// by CancelJob. done is called once the job is over, whether fn ran or not, unless it is nil.
+func startJob(ctx context.Context, userID, kind, name string, sem *semaphore.Weighted, done func(), fn func(ctx context.Context) (interface{}, error)) (job, error) {
+	now := time.Now()
+	if err := store.DeleteJobs(now.Add(-jobRetention).Unix()); err != nil {
+		logger(ctx).Printf("WARN: removing finished jobs %v", err)
+	}
+	j := job{
+		// random like a request id
+		ID:        newRequestID(),
+		UserID:    userID,
+		Kind:      kind,
+		Name:      name,
+		State:     jobQueued,
+		CreatedAt: now.Unix(),
+		UpdatedAt: now.Unix(),
+	}
+	if sem == nil {
+		j.State = jobRunning
+	}
+	if err := store.InsertJob(j); err != nil {
+		return j, err
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(detach(ctx), jobKey, j.ID))
+	jobCancels.Lock()
+	jobCancels.byID[j.ID] = cancel
+	jobCancels.Unlock()
+	go func() {
+		j := j
+		defer func() {
+			jobCancels.Lock()
+			delete(jobCancels.byID, j.ID)
+			jobCancels.Unlock()
+			cancel()
+			if done != nil {
+				done()
+			}
+		}()
+		if sem != nil {
+			if err := sem.Acquire(ctx, 1); err != nil {
+				finishJob(ctx, &j, nil, err)
+				return
+			}
+			defer sem.Release(1)
+			j.State, j.UpdatedAt = jobRunning, time.Now().Unix()
+			if err := store.UpdateJob(j); err != nil {
+				logger(ctx).Printf("ERROR: recording %s job %s of %s as running %v", j.Kind, j.ID, j.Name, err)
+			}
+		}
+		res, err := fn(ctx)
+		finishJob(ctx, &j, res, err)
+	}()
+	return j, nil
+}
+
+// wasCancelled reports whether ctx is the context of a job which was cancelled. Operations
+// which run as jobs check it between their stages, and remove what they did so far when it
+// was.
+func wasCancelled(ctx context.Context) bool {
+	return ctx.Value(jobKey) != nil && errors.Is(ctx.Err(), context.Canceled)
+}
+
+// finishJob records the outcome of the job j.
+func finishJob(ctx context.Context, j *job, res interface{}, err error) {
+	j.UpdatedAt = time.Now().Unix()
+	if err == nil && res != nil {
+		if j.Result, err = json.Marshal(res); err != nil {
+			logger(ctx).Printf("ERROR: marshalling result of job %s %v", j.ID, err)
+		}
+	}
+	if err == nil {
+		j.State = jobSucceeded
+	} else if wasCancelled(ctx) {
+		j.State, j.Result = jobCancelled, nil
+		j.Error = "cancelled"
+	} else {
+		j.State, j.Result = jobFailed, nil
+		var se *serviceError
+		if errors.As(err, &se) {
+			j.Error, j.Status = se.msg, se.status
+		} else {
+			logger(ctx).Printf("ERROR: %s job %s of %s for user %s %v", j.Kind, j.ID, j.Name, j.UserID, err)
+			j.Error, j.Status = "Internal server error", http.StatusInternalServerError
+		}
+	}
+	if err = store.UpdateJob(*j); err != nil {
+		logger(ctx).Printf("ERROR: recording %s job %s of %s as %s %v", j.Kind, j.ID, j.Name, j.State, err)
+	}
+	logger(ctx).Printf("INFO: %s job %s of %s for user %s %s", j.Kind, j.ID, j.Name, j.UserID, j.State)
+}
+
+// writeJobStarted answers a request which started the job j with 202 ACCEPTED and the job.
+func writeJobStarted(w http.ResponseWriter, req *http.Request, j job) {
+	jsonBody, err := json.Marshal(j)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling job %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/getjob?id="+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonBody)
+}
+
+// GetJob returns a job of the user, with the result or error of its operation once it is
+// done.
+func GetJob(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	j, err := store.GetJob(userId, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading job %s of %s %v", id, userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	writeJSON(w, req, j)
+}
+
+// ListJobs returns the jobs of the user, newest first. Finished jobs are kept for a week.
+func ListJobs(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	jobs, err := store.ListJobs(userId)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: listing jobs of %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	// the results are left for GetJob, they can be large and hold connection strings
+	for i := range jobs {
+		jobs[i].Result = nil
+	}
+	writeJSON(w, req, jobs)
+}
+
+// CancelJob cancels a queued or running job of the user. A job is cancelled between the stages
+// of its operation, so the response only means the job was asked to stop; it is cancelled once
+// GetJob reports it so. What a cancelled create or clone provisioned is removed again. Deletes
+// can't be cancelled, they would leave the cluster half removed.
+func CancelJob(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+	j, err := store.GetJob(userId, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading job %s of %s %v", id, userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if j.Kind == jobDelete {
+		http.Error(w, "a delete can't be cancelled", http.StatusConflict)
+		return
+	}
+	jobCancels.Lock()
+	cancel, ok := jobCancels.byID[id]
+	jobCancels.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("job is already %s", j.State), http.StatusConflict)
+		return
+	}
+	cancel()
+	logger(req.Context()).Printf("INFO: cancelling %s job %s of %s for user %s", j.Kind, j.ID, j.Name, userId)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -1,26 +1,70 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
-func fatal(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 // Create a struct that will be encoded to a JWT.
 // We add jwt.StandardClaims as an embedded type, to provide fields like expiry time
 type claims struct {
 	Text string `json:"text"`
 	jwt.StandardClaims
+	// every claim of a parsed token, to find jwtUserClaim in
+	raw map[string]interface{}
+}
+
+// jwtUserClaim names the claim holding the user id, from SPINUP_JWT_USER_CLAIM. spinup issues
+// it as text, other identity providers use e.g. sub or uid.
+var jwtUserClaim = "text"
+
+func (c *claims) UnmarshalJSON(data []byte) error {
+	type fields claims
+	if err := json.Unmarshal(data, (*fields)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.raw)
+}
+
+// userID returns the user id in the jwtUserClaim of the token.
+func (c *claims) userID() (string, error) {
+	switch v := c.raw[jwtUserClaim].(type) {
+	case string:
+		if v != "" {
+			return v, nil
+		}
+	case float64:
+		// numeric ids as some providers issue them
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("token has no %s claim with the user id", jwtUserClaim)
+}
+
+// jwtLeeway is how far exp, nbf and iat may be off to account for clock skew between the
+// issuer and spinup, from SPINUP_JWT_LEEWAY.
+var jwtLeeway = 60 * time.Second
+
+// Valid is jwt.StandardClaims.Valid with jwtLeeway applied to the time based claims.
+func (c *claims) Valid() error {
+	now := time.Now().Unix()
+	leeway := int64(jwtLeeway.Seconds())
+	if !c.VerifyExpiresAt(now-leeway, false) {
+		return jwt.NewValidationError(fmt.Sprintf("token is expired by %v", time.Duration(now-c.ExpiresAt)*time.Second), jwt.ValidationErrorExpired)
+	}
+	if !c.VerifyIssuedAt(now+leeway, false) {
+		return jwt.NewValidationError("token used before issued", jwt.ValidationErrorIssuedAt)
+	}
+	if !c.VerifyNotBefore(now+leeway, false) {
+		return jwt.NewValidationError("token is not valid yet", jwt.ValidationErrorNotValidYet)
+	}
+	return nil
 }
 
 func stringToJWT(text string) (string, error) {
@@ -28,14 +72,14 @@ func stringToJWT(text string) (string, error) {
 	// here, we have kept it as 2 days
 	log.Println("string to JWTify:", text)
 	expirationTime := time.Now().Add(48 * time.Hour)
-	// Create the JWT claims, which includes the text and expiry time
-	claims := &claims{
-		Text: text,
-		StandardClaims: jwt.StandardClaims{
-			// In JWT, the expiry time is expressed as unix milliseconds
-			ExpiresAt: expirationTime.Unix(),
-		},
+	// Create the JWT claims, which includes the text and expiry time. The user id is also put
+	// in jwtUserClaim, so the token passes validation whatever claim that is.
+	claims := jwt.MapClaims{
+		"text": text,
+		// In JWT, the expiry time is expressed as unix milliseconds
+		"exp": expirationTime.Unix(),
 	}
+	claims[jwtUserClaim] = text
 	// Declare the token with the algorithm used for signing, and the claims
 	token := jwt.NewWithClaims(jwt.SigningMethodPS512, claims)
 	// Create the JWT string
@@ -47,42 +91,40 @@ func stringToJWT(text string) (string, error) {
 }
 
 func JWTToString(tokenString string) (string, error) {
-	keyFunc := func(t *jwt.Token) (interface{}, error) {
-		return verifyKey, nil
-	}
-	claims := &claims{}
 	log.Println("JWT to string:", tokenString)
-	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+	claims, err := parseToken(tokenString)
 	if err != nil {
 		return "", err
 	}
-	if !token.Valid {
-		return "", errors.New("invalid token")
+	userID, err := claims.userID()
+	if err != nil {
+		return "", err
 	}
-	log.Println("claims:", claims.Text)
-	return claims.Text, nil
+	log.Println("claims:", userID)
+	return userID, nil
 }
 
-// TODO: vicky to remove this handler after the testing
-func JWT(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	data := query.Get("data")
-	if data == "" {
-		fmt.Println("data is empty")
+// parseToken verifies the signature and time claims of a token and returns its claims.
+func parseToken(tokenString string) (*claims, error) {
+	keyFunc := func(t *jwt.Token) (interface{}, error) {
+		return verifyKey, nil
 	}
-	jwtToken, err := stringToJWT(data)
+	claims := &claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
 	}
-	w.Write([]byte(jwtToken))
+	return claims, nil
 }
 
 func JWTDecode(w http.ResponseWriter, r *http.Request) {
 	jwttoken := r.Header.Get("jwttoken")
 	text, err := JWTToString(jwttoken)
 	if err != nil {
-		log.Printf("error jwtdecode %v", err)
+		logger(r.Context()).Printf("error jwtdecode %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
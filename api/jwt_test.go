@@ -0,0 +1,63 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// signedToken signs a token for user alice with the time claims of c.
+func signedToken(t *testing.T, c jwt.MapClaims) string {
+	t.Helper()
+	c["text"] = "alice"
+	token, err := jwt.NewWithClaims(jwt.SigningMethodPS512, c).SignedString(signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTLeeway(t *testing.T) {
+	previous := jwtLeeway
+	jwtLeeway = 10 * time.Second
+	t.Cleanup(func() { jwtLeeway = previous })
+	now := time.Now()
+	for _, tt := range []struct {
+		name    string
+		claims  jwt.MapClaims
+		wantErr uint32
+	}{
+		{name: "valid", claims: jwt.MapClaims{"exp": now.Add(time.Hour).Unix()}},
+		{name: "expired within the leeway", claims: jwt.MapClaims{"exp": now.Add(-3 * time.Second).Unix()}},
+		{name: "expired beyond the leeway", claims: jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()}, wantErr: jwt.ValidationErrorExpired},
+		{name: "issued ahead within the leeway", claims: jwt.MapClaims{"iat": now.Add(3 * time.Second).Unix()}},
+		{name: "issued ahead beyond the leeway", claims: jwt.MapClaims{"iat": now.Add(30 * time.Second).Unix()}, wantErr: jwt.ValidationErrorIssuedAt},
+		{name: "not before within the leeway", claims: jwt.MapClaims{"nbf": now.Add(3 * time.Second).Unix()}},
+		{name: "not before beyond the leeway", claims: jwt.MapClaims{"nbf": now.Add(30 * time.Second).Unix()}, wantErr: jwt.ValidationErrorNotValidYet},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, err := JWTToString(signedToken(t, tt.claims))
+			if tt.wantErr == 0 {
+				if err != nil || userID != "alice" {
+					t.Fatalf("want alice, got %q %v", userID, err)
+				}
+				return
+			}
+			var verr *jwt.ValidationError
+			if !errors.As(err, &verr) || verr.Errors&tt.wantErr == 0 {
+				t.Fatalf("want validation error %d, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestJWTWithoutLeeway(t *testing.T) {
+	previous := jwtLeeway
+	jwtLeeway = 0
+	t.Cleanup(func() { jwtLeeway = previous })
+	if _, err := JWTToString(signedToken(t, jwt.MapClaims{"exp": time.Now().Add(-3 * time.Second).Unix()})); err == nil {
+		t.Fatal("want a token expired 3s ago rejected without leeway")
+	}
+}
@@ -1,71 +1,110 @@
 package api
 
 import (
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
-	"fmt"
-	"io/fs"
-	"log"
 	"net/http"
-	"os"
+	"strings"
 )
 
 func ListCluster(w http.ResponseWriter, req *http.Request) {
-	if (*req).Method != "GET" {
-		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+	if !allowMethod(w, req, "GET") {
 		return
 	}
 	authHeader := req.Header.Get("Authorization")
 	userId, err := validateToken(authHeader)
-	log.Println("listcluster")
+	logger(req.Context()).Println("listcluster")
 	if err != nil {
-		log.Printf("error validating token %v", err)
+		logger(req.Context()).Printf("error validating token %v", err)
 		http.Error(w, "error validating token", 500)
 	}
-	dbPath := projectDir + "/" + userId
-	clusterInfos := ReadClusterInfo(dbPath, userId)
+	clusterInfos, err := store.ListClusters(userId)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading clusterInfos of %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
 	clusterByte, err := json.Marshal(clusterInfos)
 	if err != nil {
-		log.Printf("ERROR: marshalling clusterInfos %v", err)
+		logger(req.Context()).Printf("ERROR: marshalling clusterInfos %v", err)
 		http.Error(w, "Internal server error ", 500)
 		return
 	}
-	w.Write(clusterByte)
+	writeWithETag(w, req, clusterByte)
+}
+
+// writeWithETag writes body with an ETag of its contents, or only 304 NOT MODIFIED when the
+// client's If-None-Match already has it, so polling clients don't download unchanged lists.
+func writeWithETag(w http.ResponseWriter, req *http.Request, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, match := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		// a weak match is enough, the body is only compared for equality
+		if match = strings.TrimPrefix(strings.TrimSpace(match), "W/"); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write(body)
 }
 
 type clusterInfo struct {
+	UserID    string
 	ClusterID string
 	Name      string
 	Port      int
-}
-
-func ReadClusterInfo(path, dbName string) []clusterInfo {
-	dsn := path + "/" + dbName + ".db"
-	if _, err := os.Stat(dsn); errors.Is(err, fs.ErrNotExist) {
-		log.Printf("INFO: no sqlite database")
-		return nil
-	}
-	db, err := sql.Open("sqlite3", dsn)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-	rows, err := db.Query("select clusterId, name, port from clusterInfo")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer rows.Close()
-	var clusterIds []string
-	var clusterInfos []clusterInfo
-	var cluster clusterInfo
-	for rows.Next() {
-		err = rows.Scan(&cluster.ClusterID, &cluster.Name, &cluster.Port)
-		if err != nil {
-			log.Fatal(err)
-		}
-		clusterInfos = append(clusterInfos, cluster)
-	}
-	fmt.Println(clusterIds)
-	return clusterInfos
+	// unix time after which the reaper deletes the cluster, 0 if it never expires
+	ExpiresAt int64
+	Username  string
+	DNSStatus string
+	// 0 when the cluster doesn't have a pooler
+	PoolerPort int
+	// 0 when the cluster doesn't have a metrics exporter
+	MetricsPort int
+	// name of the record within the zone, empty when it is <userID>-<dbName>. Set by the
+	// request or rendered from SPINUP_DNS_NAME_TEMPLATE.
+	Subdomain string
+	// base domain of the record, empty for SPINUP_DOMAIN
+	Domain string
+	Type   string
+	// 0 when the server default applies
+	MaxConnections int
+	Tags           []string
+	// unix time the cluster was created at, 0 for clusters created before it was recorded
+	CreatedAt int64
+	// docker volume the cluster was attached to, empty when spinup created its storage
+	ExistingVolume string
+	// external docker network the cluster is attached to, which spinup doesn't remove with it
+	Network string
+	// compose project of the cluster's containers, empty for clusters created before it was
+	// set, whose project is named after their directory
+	ComposeProject string
+	// image the cluster was created with, as resolved from its type and version
+	Image string
+	// unix time the cluster was deleted at while its data is retained, 0 if it isn't deleted
+	DeletedAt int64
+	// storage allocated to the cluster, empty when none was requested
+	Storage string
+	// memory limit of the cluster's container, empty when it is unbounded
+	Memory string
+	// directory of the cluster's TLS certificate and key, empty without TLS
+	TLSDir string
+	// whether the DNS record was seen resolving to the cluster, with SPINUP_DNS_VERIFY_TIMEOUT
+	DNSReady bool
+	// cluster id of the cluster this one was cloned from, empty when it wasn't cloned
+	ClonedFrom string
+	// encoding and locale the postgres cluster was initialized with, empty for the image defaults
+	Encoding string
+	Locale   string
+	// cron expression of the scheduled backups, empty when the cluster isn't backed up
+	BackupSchedule string
+	// unix time and status of the last scheduled backup, 0 and empty before the first one
+	LastBackupAt     int64
+	LastBackupStatus string
+	// postgres session timeouts like 30s, empty for the server default
+	StatementTimeout                string
+	IdleInTransactionSessionTimeout string
 }
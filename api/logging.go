@@ -0,0 +1,58 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"strconv"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logOutput opens the destination of the logs from SPINUP_LOG_OUTPUT: stdout, stderr, syslog
+// or the path of a file which is rotated by size.
+func logOutput(dest string) (io.Writer, error) {
+	switch dest {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "syslog":
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "spinup")
+	}
+	f := &lumberjack.Logger{Filename: dest, MaxSize: 100}
+	settings := []struct {
+		name string
+		dst  *int
+	}{
+		{"SPINUP_LOG_MAX_SIZE", &f.MaxSize},
+		{"SPINUP_LOG_MAX_BACKUPS", &f.MaxBackups},
+		{"SPINUP_LOG_MAX_AGE", &f.MaxAge},
+	}
+	for _, s := range settings {
+		v, ok := os.LookupEnv(s.name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a number of at least 0, got %q", s.name, v)
+		}
+		*s.dst = n
+	}
+	// open it now, so a path which can't be written fails the startup rather than the first log
+	if _, err := f.Write(nil); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// setLogOutput sends the logs to w. syslog stamps the time of its messages itself.
+func setLogOutput(dest string, w io.Writer) {
+	if dest == "syslog" {
+		log.SetFlags(0)
+	}
+	log.SetOutput(w)
+}
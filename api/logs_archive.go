@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxLogArchiveBytes bounds the logs collected for an archive, before compression. Only the
+// newest logs are kept beyond it.
+const maxLogArchiveBytes = 16 << 20
+
+// DownloadLogs returns the logs of every container of a cluster, the database and its pooler or
+// exporter, as a gzipped attachment to pass on, e.g. to support. Unlike /streamlogs it is a
+// snapshot of the logs so far. Beyond maxLogArchiveBytes the oldest lines are left out, with a
+// notice at the top of the archive.
+func DownloadLogs(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	cluster, ok := requestedCluster(w, req)
+	if !ok {
+		return
+	}
+	path := servicePath(cluster.UserID, cluster.Type, cluster.Name)
+	if _, err := os.Stat(filepath.Join(path, "docker-compose.yml")); err != nil {
+		logger(req.Context()).Printf("ERROR: collecting logs of %s of %s %v", cluster.Name, cluster.UserID, err)
+		http.Error(w, "cluster's docker-compose file not found", http.StatusNotFound)
+		return
+	}
+	logs, truncated, err := collectLogs(req.Context(), path, cluster.ComposeProject)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: collecting logs of %s of %s %v", cluster.Name, cluster.UserID, err)
+		http.Error(w, "Error collecting logs", 500)
+		return
+	}
+	file := fmt.Sprintf("%s-logs-%s.log.gz", cluster.Name, time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+file+`"`)
+	gz := gzip.NewWriter(w)
+	if truncated {
+		fmt.Fprintf(gz, "[spinup] the logs were larger than %d bytes, only the newest are included\n", maxLogArchiveBytes)
+	}
+	gz.Write(logs)
+	if err = gz.Close(); err != nil {
+		logger(req.Context()).Printf("WARN: sending logs of %s of %s %v", cluster.Name, cluster.UserID, err)
+	}
+}
+
+// collectLogs returns the newest maxLogArchiveBytes of the logs of the compose project at path,
+// starting at a whole line, and whether older lines were left out. At most twice that is held
+// while the logs are read.
+func collectLogs(ctx context.Context, path, project string) ([]byte, bool, error) {
+	var logs []byte
+	truncated := false
+	keepNewest := func() {
+		// copied, so the older logs don't stay behind the slice
+		logs = append([]byte(nil), logs[len(logs)-maxLogArchiveBytes:]...)
+		if i := bytes.IndexByte(logs, '\n'); i >= 0 {
+			logs = logs[i+1:]
+		}
+		truncated = true
+	}
+	err := runLines(ctx, func(line string) {
+		logs = append(append(logs, line...), '\n')
+		if len(logs) > 2*maxLogArchiveBytes {
+			keepNewest()
+		}
+	}, "docker-compose", append(composeFiles(path, project), "logs", "--no-color", "--timestamps")...)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(logs) > maxLogArchiveBytes {
+		keepNewest()
+	}
+	return logs, truncated, nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testProjectDir is the SPINUP_PROJECT_DIR of the tests. It is set up while the package
+// variables are initialized, which happens before the init of the package reads the
+// environment.
+var testProjectDir = setupTestEnv()
+
+// setupTestEnv gives init a project directory with signing keys and a DNS provider which
+// doesn't leave the host, so the tests neither need a configured host nor a network.
+func setupTestEnv() string {
+	dir, err := ioutil.TempDir("", "spinup-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writePEM := func(name, kind string, der []byte) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			log.Fatal(err)
+		}
+	}
+	writePEM("app.rsa", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	writePEM("app.rsa.pub", "PUBLIC KEY", pub)
+	for k, v := range map[string]string{
+		"SPINUP_PROJECT_DIR":     dir,
+		"ARCHITECTURE":           "amd64",
+		"SPINUP_DNS_PROVIDER":    "webhook",
+		"SPINUP_DNS_ZONE_ID":     "test-zone",
+		"SPINUP_DNS_WEBHOOK_URL": "http://127.0.0.1:1",
+		"SPINUP_PUBLIC_IP":       "203.0.113.1",
+	} {
+		os.Setenv(k, v)
+	}
+	// settings of the host running the tests which would move the state out of dir
+	for _, k := range []string{"SPINUP_ENV_FILE", "SPINUP_DATA_DIR", "SPINUP_BACKUP_DIR", "SPINUP_METADATA_SHARDS", "SPINUP_LOG_OUTPUT", "SPINUP_DNS_ENABLED"} {
+		os.Unsetenv(k)
+	}
+	return dir
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	os.RemoveAll(testProjectDir)
+	os.Exit(code)
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxOverrideBytes bounds the size of a user supplied docker-compose override.
+const maxOverrideBytes = 64 * 1024
+
+const overrideFileName = "docker-compose.override.yml"
+
+// overrideServiceKeys are the keys a service of a compose override may set, enough to add a
+// service like pgAdmin or tune one. Anything else is refused, as keys like privileged,
+// network_mode, pid, cap_add, devices, volumes_from, build or env_file reach into the host or
+// into other clusters, and ports would publish host ports outside those allocated to clusters.
+var overrideServiceKeys = map[string]bool{
+	"image":             true,
+	"command":           true,
+	"entrypoint":        true,
+	"environment":       true,
+	"expose":            true,
+	"volumes":           true,
+	"depends_on":        true,
+	"restart":           true,
+	"healthcheck":       true,
+	"working_dir":       true,
+	"user":              true,
+	"hostname":          true,
+	"stop_grace_period": true,
+	"tmpfs":             true,
+	"read_only":         true,
+	"shm_size":          true,
+	"mem_limit":         true,
+	"cpus":              true,
+	"tty":               true,
+	"stdin_open":        true,
+}
+
+// overrideVolumeKeys are the keys a volume of a compose override may set. external and name
+// would attach the existing volume of another cluster, driver_opts of the local driver bind a
+// host directory.
+var overrideVolumeKeys = map[string]bool{
+	"driver": true,
+}
+
+// validateOverride checks a user supplied docker-compose override before it is written to disk.
+// Overrides may add services (e.g. pgAdmin) but must not mount anything from the host or escape
+// the isolation of the cluster, see overrideServiceKeys.
+func validateOverride(override string) error {
+	if len(override) > maxOverrideBytes {
+		return fmt.Errorf("compose override must not be larger than %d bytes", maxOverrideBytes)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(override), &doc); err != nil {
+		return fmt.Errorf("compose override is not valid yaml: %v", err)
+	}
+	// docker-compose fills in ${VAR} from the environment of spinup, which holds its DNS, AWS
+	// and OAuth credentials
+	if interpolates(&doc) {
+		return fmt.Errorf("$ is not allowed in compose override")
+	}
+	var compose map[string]yaml.Node
+	if err := doc.Decode(&compose); err != nil {
+		return fmt.Errorf("compose override is not valid yaml: %v", err)
+	}
+	for key := range compose {
+		// networks, secrets and configs name things outside the cluster, x- are extension fields
+		if key != "version" && key != "services" && key != "volumes" && !strings.HasPrefix(key, "x-") {
+			return fmt.Errorf("%s are not allowed in compose override", key)
+		}
+	}
+	var services map[string]map[string]yaml.Node
+	if err := decodeOverrideKey(compose, "services", &services); err != nil {
+		return err
+	}
+	for name, svc := range services {
+		for key, value := range svc {
+			if !overrideServiceKeys[key] {
+				return fmt.Errorf("service %s: %s is not allowed in compose override", name, key)
+			}
+			if key != "volumes" {
+				continue
+			}
+			var volumes []yaml.Node
+			if err := value.Decode(&volumes); err != nil {
+				return fmt.Errorf("service %s: volumes must be a list: %v", name, err)
+			}
+			for _, v := range volumes {
+				if isHostMount(v) {
+					return fmt.Errorf("service %s: host mounts are not allowed in compose override", name)
+				}
+			}
+		}
+	}
+	var volumes map[string]map[string]yaml.Node
+	if err := decodeOverrideKey(compose, "volumes", &volumes); err != nil {
+		return err
+	}
+	for name, vol := range volumes {
+		for key, value := range vol {
+			if !overrideVolumeKeys[key] {
+				return fmt.Errorf("volume %s: %s is not allowed in compose override", name, key)
+			}
+			if key == "driver" && value.Value != "local" {
+				return fmt.Errorf("volume %s: only the local driver is allowed in compose override", name)
+			}
+		}
+	}
+	return nil
+}
+
+// interpolates reports whether a scalar below n contains a $, which docker-compose would
+// interpolate.
+func interpolates(n *yaml.Node) bool {
+	if n.Kind == yaml.ScalarNode && strings.Contains(n.Value, "$") {
+		return true
+	}
+	for _, c := range n.Content {
+		if interpolates(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeOverrideKey decodes the top level key of a compose override into v, when it is set.
+func decodeOverrideKey(compose map[string]yaml.Node, key string, v interface{}) error {
+	node, ok := compose[key]
+	if !ok {
+		return nil
+	}
+	if err := node.Decode(v); err != nil {
+		return fmt.Errorf("compose override %s are not valid: %v", key, err)
+	}
+	return nil
+}
+
+// isHostMount reports whether a compose volume entry, in short or long syntax, binds a host path.
+func isHostMount(v yaml.Node) bool {
+	switch v.Kind {
+	case yaml.ScalarNode:
+		parts := strings.SplitN(v.Value, ":", 2)
+		if len(parts) == 1 {
+			// anonymous volume, only a container path
+			return false
+		}
+		return strings.HasPrefix(parts[0], ".") || strings.ContainsAny(parts[0], "/~$")
+	case yaml.MappingNode:
+		var long struct {
+			Type   string `yaml:"type"`
+			Source string `yaml:"source"`
+		}
+		if err := v.Decode(&long); err != nil {
+			return true
+		}
+		return long.Type != "volume" && long.Type != "tmpfs"
+	}
+	return true
+}
+
+// composeProjectChars are the characters docker-compose keeps in a project name
+var composeProjectChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// composeProject names the compose project of a cluster. Without it the project is named after
+// the cluster's directory, which is the same for clusters of the same name of different users.
+// <userID>-<name> alone isn't unique either, user a-b's cluster c and user a's cluster b-c
+// would share it, as would Bob's and bob's clusters once lowercased, so it ends in a hash of
+// the user and the name, which can't contain the / separating them. A delete runs down -v on
+// the project, so a shared one would remove the containers and volumes of another user.
+func composeProject(userID, name string) string {
+	sum := sha256.Sum256([]byte(userID + "/" + name))
+	return composeProjectChars.ReplaceAllString(strings.ToLower(userID+"-"+name), "") + "-" + hex.EncodeToString(sum[:6])
+}
+
+func writeOverrideFile(path, override string) error {
+	return os.WriteFile(filepath.Join(path, overrideFileName), []byte(override), 0644)
+}
+
+// composeFiles returns the -f arguments for every compose file of the service at path, and
+// -p for its compose project unless project is empty. The override is only included when the
+// user supplied one, followed by the --profile arguments of the enabled profiles.
+func composeFiles(path, project string) []string {
+	args := []string{"-f", filepath.Join(path, "docker-compose.yml")}
+	if project != "" {
+		args = append(args, "-p", project)
+	}
+	if dockerContext != "" {
+		args = append([]string{"--context", dockerContext}, args...)
+	}
+	if _, err := os.Stat(filepath.Join(path, overrideFileName)); err == nil {
+		args = append(args, "-f", filepath.Join(path, overrideFileName))
+	}
+	return append(args, profileArgs(path)...)
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestComposeProjectUnique(t *testing.T) {
+	for _, pair := range [][2][2]string{
+		{{"alice", "db"}, {"bob", "db"}},
+		{{"a-b", "c"}, {"a", "b-c"}},
+		{{"a_b", "c"}, {"a", "b_c"}},
+		{{"Bob", "db"}, {"bob", "db"}},
+		{{"bob", "DB"}, {"bob", "db"}},
+	} {
+		a, b := pair[0], pair[1]
+		if composeProject(a[0], a[1]) == composeProject(b[0], b[1]) {
+			t.Errorf("cluster %s of %s and cluster %s of %s share the compose project %s", a[1], a[0], b[1], b[0], composeProject(a[0], a[1]))
+		}
+	}
+}
+
+func TestComposeProjectName(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	for _, c := range [][2]string{{"alice", "db"}, {"Bob", "Orders_DB"}, {"0user", "x-1"}} {
+		project := composeProject(c[0], c[1])
+		if !valid.MatchString(project) {
+			t.Errorf("composeProject(%q, %q) = %q, which docker-compose doesn't accept", c[0], c[1], project)
+		}
+		if again := composeProject(c[0], c[1]); again != project {
+			t.Errorf("composeProject(%q, %q) changed from %q to %q", c[0], c[1], project, again)
+		}
+	}
+}
+
+// TestComposeProjectOfTwoUsers creates clusters of two users, of the same name and of names
+// which once collided, and checks that neither the provisioning nor the cleanup of one runs on
+// the project of the other.
+func TestComposeProjectOfTwoUsers(t *testing.T) {
+	for _, clusters := range [][2][2]string{
+		{{"alice", "db"}, {"bob", "db"}},
+		{{"a-b", "c"}, {"a", "b-c"}},
+	} {
+		var projects []string
+		for _, c := range clusters {
+			user, name := c[0], c[1]
+			// no container comes up, so the create is rolled back with down -v
+			fake := (&fakeRunner{}).on("ps -q", "", errors.New("no such service"))
+			useRunner(t, fake)
+			createService(context.Background(), service{UserID: user, Architecture: "amd64", Db: dbCluster{Name: name, Type: "postgres"}})
+			store.DeleteCluster(user, name)
+			ups, downs := fake.ran(" up -d"), fake.ran(" down -v")
+			if len(ups) != 1 || len(downs) != 1 {
+				t.Fatalf("want cluster %s of %s started and removed once, ran %q", name, user, fake.commands)
+			}
+			project := composeProject(user, name)
+			for _, cmd := range []string{ups[0], downs[0]} {
+				if !strings.Contains(cmd, " -p "+project+" ") {
+					t.Errorf("want %q of cluster %s of %s run on project %s", cmd, name, user, project)
+				}
+			}
+			projects = append(projects, project)
+		}
+		if projects[0] == projects[1] {
+			t.Errorf("clusters %v share the compose project %s", clusters, projects[0])
+		}
+	}
+}
+
+func TestValidateOverride(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		override string
+		ok       bool
+	}{
+		{name: "pgadmin", ok: true, override: `
+version: "3.9"
+services:
+  pgadmin:
+    image: dpage/pgadmin4
+    environment:
+      PGADMIN_DEFAULT_EMAIL: admin@example.com
+    expose:
+      - "80"
+    volumes:
+      - pgadmin:/var/lib/pgadmin
+      - type: tmpfs
+        target: /tmp
+    depends_on:
+      - postgres
+volumes:
+  pgadmin:
+`},
+		{name: "tuning the database", ok: true, override: "services:\n  postgres:\n    shm_size: 256m\n    command: postgres -c work_mem=64MB\n"},
+		{name: "local volume driver", ok: true, override: "volumes:\n  data:\n    driver: local\n"},
+		{name: "extension field", ok: true, override: "x-env: &env\n  TZ: UTC\nservices:\n  pgadmin:\n    image: dpage/pgadmin4\n    environment: *env\n"},
+		{name: "bind mount", override: "services:\n  pgadmin:\n    volumes:\n      - /etc:/host-etc\n"},
+		{name: "relative bind mount", override: "services:\n  pgadmin:\n    volumes:\n      - ./data:/data\n"},
+		{name: "long bind mount", override: "services:\n  pgadmin:\n    volumes:\n      - type: bind\n        source: /\n        target: /host\n"},
+		{name: "privileged", override: "services:\n  postgres:\n    privileged: true\n"},
+		{name: "host network", override: "services:\n  pgadmin:\n    network_mode: host\n"},
+		{name: "host pid", override: "services:\n  pgadmin:\n    pid: host\n"},
+		{name: "cap_add", override: "services:\n  pgadmin:\n    cap_add:\n      - SYS_ADMIN\n"},
+		{name: "devices", override: "services:\n  pgadmin:\n    devices:\n      - /dev/sda:/dev/sda\n"},
+		{name: "volumes_from", override: "services:\n  pgadmin:\n    volumes_from:\n      - container:bob-db-postgres-1\n"},
+		{name: "build", override: "services:\n  pgadmin:\n    build: /\n"},
+		{name: "env_file", override: "services:\n  pgadmin:\n    env_file: /etc/spinup.env\n"},
+		{name: "labels", override: "services:\n  postgres:\n    labels:\n      host.spinup.cluster: bob/db\n"},
+		{name: "external volume", override: "volumes:\n  data:\n    external: true\n"},
+		{name: "volume of another cluster by name", override: "volumes:\n  data:\n    name: bob-db_pgdata\n"},
+		{name: "volume driver_opts", override: "volumes:\n  data:\n    driver_opts:\n      type: none\n      o: bind\n      device: /etc\n"},
+		{name: "volume plugin", override: "volumes:\n  data:\n    driver: sshfs\n"},
+		{name: "volume labels", override: "volumes:\n  data:\n    labels:\n      a: b\n"},
+		{name: "ports", override: "services:\n  pgadmin:\n    ports:\n      - \"22:80\"\n"},
+		{name: "interpolated environment", override: "services:\n  pgadmin:\n    environment:\n      X: \"${CF_AUTHORIZATION_TOKEN}\"\n"},
+		{name: "interpolated image", override: "services:\n  pgadmin:\n    image: $AWS_SECRET_ACCESS_KEY\n"},
+		{name: "interpolated command", override: "services:\n  postgres:\n    command:\n      - echo\n      - ${CLIENT_SECRET}\n"},
+		{name: "interpolated key", override: "services:\n  pgadmin:\n    environment:\n      ${SPINUP_DNS_WEBHOOK_TOKEN}: x\n"},
+		{name: "networks", override: "networks:\n  other:\n    external: true\n"},
+		{name: "secrets", override: "secrets:\n  key:\n    file: /etc/shadow\n"},
+		{name: "not yaml", override: "services: [\n"},
+		{name: "services not a map", override: "services: 1\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateOverride(tt.override)
+			if tt.ok && err != nil {
+				t.Errorf("want the override allowed, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("want the override refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	// layoutFlat keeps a cluster in <root>/<userID>/<name>
+	layoutFlat = "flat"
+	// layoutType keeps a cluster in <root>/<userID>/<type>/<name>
+	layoutType = "type"
+)
+
+// layout is how the directories of clusters are organized under the project and data
+// directories, from SPINUP_LAYOUT.
+var layout = layoutFlat
+
+// clusterDir is the directory of a cluster under root according to layout.
+func clusterDir(root, userID, dbType, name string) string {
+	if layout == layoutType {
+		return filepath.Join(root, userID, dbType, name)
+	}
+	return filepath.Join(root, userID, name)
+}
+
+// servicePath is the directory holding the compose files of a cluster. Every operation on the
+// files of a cluster finds them through it.
+func servicePath(userID, dbType, dbName string) string {
+	return clusterDir(projectDir, userID, dbType, dbName)
+}
+
+// dataPath is where the data directory of a cluster is mounted from.
+func dataPath(userID, dbType, name string) string {
+	return filepath.Join(clusterDir(dataDir, userID, dbType, name), "data")
+}
+
+// serviceDir is a cluster directory found on disk.
+type serviceDir struct {
+	dbType string
+	name   string
+	path   string
+}
+
+// serviceDirs lists the cluster directories of a user on disk. Their type is only known with
+// the type layout.
+func serviceDirs(userID string) ([]serviceDir, error) {
+	userPath := filepath.Join(projectDir, userID)
+	if layout != layoutType {
+		return subdirs(userPath, "")
+	}
+	var dirs []serviceDir
+	for dbType := range dbTypes {
+		typeDirs, err := subdirs(filepath.Join(userPath, dbType), dbType)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		dirs = append(dirs, typeDirs...)
+	}
+	return dirs, nil
+}
+
+func subdirs(path, dbType string) ([]serviceDir, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []serviceDir
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, serviceDir{dbType: dbType, name: e.Name(), path: filepath.Join(path, e.Name())})
+		}
+	}
+	return dirs, nil
+}
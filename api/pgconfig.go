@@ -0,0 +1,82 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pgConfigFile is the postgres config spinup writes next to the compose file of a postgres
+// cluster. The server reads it instead of the postgresql.conf of its data directory, which it
+// includes first, so the settings of spinup take precedence and can be changed later by
+// rewriting the file and reloading the server.
+const pgConfigFile = "postgresql.conf"
+
+// pgDataConfig is the config initdb writes in the data directory of the postgres image.
+const pgDataConfig = "/var/lib/postgresql/data/postgresql.conf"
+
+// pgTimeouts are the session timeouts of a postgres cluster, as durations like 30s, empty for
+// the server default.
+type pgTimeouts struct {
+	StatementTimeout                string
+	IdleInTransactionSessionTimeout string
+}
+
+// parsePGTimeout parses a timeout setting into the milliseconds postgres takes. 0 disables the
+// timeout.
+func parsePGTimeout(field, v string) (int64, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration like 30s or 5m, got %q", field, v)
+	}
+	if d%time.Millisecond != 0 {
+		return 0, fmt.Errorf("%s must be whole milliseconds, got %q", field, v)
+	}
+	if d/time.Millisecond > math.MaxInt32 {
+		return 0, fmt.Errorf("%s must be at most %v, got %q", field, time.Duration(math.MaxInt32)*time.Millisecond, v)
+	}
+	return int64(d / time.Millisecond), nil
+}
+
+func validatePGTimeouts(dbType string, t pgTimeouts) error {
+	if t.StatementTimeout == "" && t.IdleInTransactionSessionTimeout == "" {
+		return nil
+	}
+	if dbType != "postgres" {
+		return fmt.Errorf("StatementTimeout and IdleInTransactionSessionTimeout are only supported for postgres")
+	}
+	if t.StatementTimeout != "" {
+		if _, err := parsePGTimeout("StatementTimeout", t.StatementTimeout); err != nil {
+			return err
+		}
+	}
+	if t.IdleInTransactionSessionTimeout != "" {
+		if _, err := parsePGTimeout("IdleInTransactionSessionTimeout", t.IdleInTransactionSessionTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createConfigfile writes the postgres config of the cluster at path. The file is bind mounted
+// into the running container, so it is rewritten in place rather than replaced.
+func createConfigfile(path string, t pgTimeouts) error {
+	lines := []string{
+		"# written by spinup, changed with /updateservice",
+		fmt.Sprintf("include_if_exists = '%s'", pgDataConfig),
+	}
+	// validated before, by validatePGTimeouts
+	if t.StatementTimeout != "" {
+		ms, _ := parsePGTimeout("StatementTimeout", t.StatementTimeout)
+		lines = append(lines, fmt.Sprintf("statement_timeout = %d", ms))
+	}
+	if t.IdleInTransactionSessionTimeout != "" {
+		ms, _ := parsePGTimeout("IdleInTransactionSessionTimeout", t.IdleInTransactionSessionTimeout)
+		lines = append(lines, fmt.Sprintf("idle_in_transaction_session_timeout = %d", ms))
+	}
+	// the server may run as another user than spinup
+	return ioutil.WriteFile(filepath.Join(path, pgConfigFile), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pingTimeout bounds each step of a ping, so a cluster that hangs answers quickly too.
+const pingTimeout = 3 * time.Second
+
+type pingResponse struct {
+	Name string
+	// the address spinup connected to, the host and port of the cluster as seen from spinup
+	Address string
+	// whether the port accepted a TCP connection
+	Reachable bool
+	// how long the TCP connection took to open, in milliseconds
+	ConnectMs float64 `json:",omitempty"`
+	// whether the database answered a query, only set with query=true
+	QueryOK *bool `json:",omitempty"`
+	// how long the query took, in milliseconds
+	QueryMs float64 `json:",omitempty"`
+	// why the connection or the query failed
+	Error string `json:",omitempty"`
+}
+
+// PingService checks from spinup's side whether a cluster accepts connections and, with
+// query=true, answers a query. A client that can't reach a cluster which pings fine has a
+// network problem of its own. The ping is answered with 200 either way, the result is in the
+// body.
+func PingService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	res := pingCluster(req.Context(), cluster, req.URL.Query().Get("query") == "true")
+	jsonBody, err := json.Marshal(res)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling ping response %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+func pingCluster(ctx context.Context, c clusterInfo, query bool) pingResponse {
+	res := pingResponse{Name: c.Name, Address: net.JoinHostPort(hostName(), strconv.Itoa(c.Port))}
+	dialCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(dialCtx, "tcp", res.Address)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.ConnectMs = milliseconds(time.Since(start))
+	res.Reachable = true
+	conn.Close()
+	if !query {
+		return res
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	start = time.Now()
+	// the version query is the cheapest every type has, it runs in the container like readyQuery
+	args := append([]string{"exec", c.ClusterID}, dbTypes[c.Type].versionCommand(c.Username)...)
+	_, err = runner.Run(queryCtx, "docker", args...)
+	ok := err == nil
+	res.QueryOK = &ok
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.QueryMs = milliseconds(time.Since(start))
+	return res
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"testing"
+)
+
+// TestPortReallocatedAfterDelete creates a cluster, deletes it and creates another, which gets
+// the port of the deleted cluster back.
+func TestPortReallocatedAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	port, err := allocatePort(ctx)
+	if err == errPortsOccupied {
+		t.Skip("the ports of clusters are taken on this host")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertCluster(clusterInfo{UserID: "alice", ClusterID: "port-test", Name: "db", Port: port, Type: "postgres"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.DeleteCluster("alice", "db") })
+	// the container bound it
+	releasePort(port)
+
+	next, err := allocatePort(ctx)
+	if err != nil && err != errPortsOccupied {
+		t.Fatal(err)
+	}
+	if err == nil {
+		releasePort(next)
+		if next == port {
+			t.Fatalf("port %d of a recorded cluster was allocated again", port)
+		}
+	}
+
+	if err = store.DeleteCluster("alice", "db"); err != nil {
+		t.Fatal(err)
+	}
+	again, err := allocatePort(ctx)
+	if err != nil {
+		t.Fatalf("allocating after the delete: %v", err)
+	}
+	releasePort(again)
+	if again != port {
+		t.Errorf("want port %d of the deleted cluster, got %d", port, again)
+	}
+}
+
+func TestReservedPortNotAllocatedTwice(t *testing.T) {
+	ctx := context.Background()
+	port, err := allocatePort(ctx)
+	if err == errPortsOccupied {
+		t.Skip("the ports of clusters are taken on this host")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := allocatePort(ctx)
+	if err == nil {
+		releasePort(next)
+	}
+	releasePort(port)
+	if err == nil && next == port {
+		t.Fatalf("port %d allocated twice before its container bound it", port)
+	}
+	again, err := allocatePort(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releasePort(again)
+	if again != port {
+		t.Errorf("want released port %d allocated again, got %d", port, again)
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// preset is a named bundle of cluster settings, requested with Db.Preset.
+type preset struct {
+	Name           string `yaml:"-"`
+	Memory         string `yaml:"memory"`
+	Storage        string `yaml:"storage"`
+	MajVersion     uint   `yaml:"majVersion"`
+	MinVersion     uint   `yaml:"minVersion"`
+	MaxConnections int    `yaml:"maxConnections"`
+}
+
+// presets are read from SPINUP_PRESETS_FILE, by name.
+var presets = map[string]preset{}
+
+// loadPresets reads a YAML file mapping preset names to their settings, e.g.
+//
+//	small:
+//	  memory: 256MB
+//	  maxConnections: 20
+func loadPresets(path string) (map[string]preset, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]preset{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(&loaded); err != nil {
+		return nil, fmt.Errorf("parsing %s %v", path, err)
+	}
+	for name, p := range loaded {
+		p.Name = name
+		loaded[name] = p
+	}
+	return loaded, nil
+}
+
+// applyPreset fills the settings of db which the request left out from its preset.
+func applyPreset(db *dbCluster) error {
+	if db.Preset == "" {
+		return nil
+	}
+	p, ok := presets[db.Preset]
+	if !ok {
+		return fmt.Errorf("unknown preset %q", db.Preset)
+	}
+	if db.Memory == "" {
+		db.Memory = p.Memory
+	}
+	if db.Storage == "" {
+		db.Storage = p.Storage
+	}
+	if db.MajVersion == 0 && db.MinVersion == 0 && db.Version == "" {
+		db.MajVersion, db.MinVersion = p.MajVersion, p.MinVersion
+	}
+	if db.MaxConnections == 0 {
+		db.MaxConnections = p.MaxConnections
+	}
+	return nil
+}
+
+// defaultMemory and defaultStorage are used for clusters which get no memory or storage from
+// their request or preset, by type with "" for the other types. They are read from
+// SPINUP_DEFAULT_MEMORY and SPINUP_DEFAULT_STORAGE.
+var defaultMemory, defaultStorage = map[string]string{}, map[string]string{}
+
+// parseTypeDefaults parses a size for every type, like 1G, or sizes by type, like
+// postgres=1G,mongo=2G,512M where the size without a type is for the other types.
+func parseTypeDefaults(field, v string) (map[string]string, error) {
+	defaults := map[string]string{}
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		dbType, size := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			dbType, size = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			if _, ok := dbTypes[dbType]; !ok {
+				return nil, fmt.Errorf("unknown type %q", dbType)
+			}
+		}
+		if _, err := parseSize(field, size); err != nil {
+			return nil, err
+		}
+		if _, ok := defaults[dbType]; ok {
+			return nil, fmt.Errorf("%s is set twice for %q", field, dbType)
+		}
+		defaults[dbType] = size
+	}
+	return defaults, nil
+}
+
+// applyDefaults fills the memory and storage of db which neither the request nor its preset set.
+func applyDefaults(db *dbCluster) {
+	if db.Memory == "" {
+		db.Memory = typeDefault(defaultMemory, db.Type)
+	}
+	if db.Storage == "" {
+		db.Storage = typeDefault(defaultStorage, db.Type)
+	}
+}
+
+// defaultVersions are the versions of clusters whose request and preset name none, by type,
+// from SPINUP_DEFAULT_<TYPE>_VERSION. Types without one run the latest image.
+var defaultVersions = map[string]string{}
+
+// applyDefaultVersion sets the version of db to the default of its type when neither the
+// request nor its preset set one. A clone runs the image of its source instead.
+func applyDefaultVersion(db *dbCluster) error {
+	if db.MajVersion != 0 || db.MinVersion != 0 || db.Version != "" || db.image != "" {
+		return nil
+	}
+	v, ok := defaultVersions[db.Type]
+	if !ok {
+		return nil
+	}
+	db.Version = v
+	return parseVersion(db)
+}
+
+func typeDefault(defaults map[string]string, dbType string) string {
+	if v, ok := defaults[dbType]; ok {
+		return v
+	}
+	return defaults[""]
+}
+
+// ListPresets lists the presets a cluster can be created from.
+func ListPresets(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	if _, err := validateToken(req.Header.Get("Authorization")); err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	list := []preset{}
+	for _, p := range presets {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	jsonBody, err := json.Marshal(list)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling presets %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
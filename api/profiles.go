@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// profilesFileName lists the compose profiles enabled for a cluster, one per line, next to its
+// docker-compose.yml. Every docker-compose command of the cluster passes them.
+const profilesFileName = "profiles"
+
+// profiles of the optional services, which db.pooler and db.metrics enable as well
+const (
+	poolerProfile  = "pooler"
+	metricsProfile = "metrics"
+)
+
+// profilesSupported is whether docker-compose knows profiles, which came with 1.28.0. The
+// templates only declare them when it does. Assumed when the release isn't known.
+var profilesSupported = true
+
+// templateProfileLine matches the profiles of a service in a template, e.g. profiles: ["pooler"]
+var templateProfileLine = regexp.MustCompile(`(?m)^\s+profiles: \[(.*)\]`)
+
+// templateProfiles returns the profiles the services of template declare.
+func templateProfiles(template string) (map[string]bool, error) {
+	body, err := dockerTempl.ReadFile("templates/" + template)
+	if err != nil {
+		return nil, err
+	}
+	profiles := map[string]bool{}
+	for _, m := range templateProfileLine.FindAllStringSubmatch(string(body), -1) {
+		for _, p := range strings.Split(m[1], ",") {
+			profiles[strings.Trim(strings.TrimSpace(p), `"`)] = true
+		}
+	}
+	return profiles, nil
+}
+
+// validateProfiles checks the profiles of db against those its template declares and enables
+// the services behind them: the pooler and metrics profiles and db.pooler and db.metrics imply
+// each other.
+func validateProfiles(t dbType, db *dbCluster) error {
+	if len(db.Profiles) > 0 && !profilesSupported {
+		return fmt.Errorf("profiles need docker-compose 1.28.0 or later")
+	}
+	known, err := templateProfiles(t.template)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	var profiles []string
+	for _, p := range db.Profiles {
+		if !known[p] {
+			var names []string
+			for k := range known {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			if len(names) == 0 {
+				return fmt.Errorf("profile %q isn't defined, %s clusters have no profiles", p, db.Type)
+			}
+			return fmt.Errorf("profile %q isn't defined, %s clusters have %s", p, db.Type, strings.Join(names, ", "))
+		}
+		if !seen[p] {
+			seen[p] = true
+			profiles = append(profiles, p)
+		}
+	}
+	for _, o := range []struct {
+		profile string
+		on      *bool
+	}{{poolerProfile, &db.Pooler}, {metricsProfile, &db.Metrics}} {
+		if seen[o.profile] {
+			*o.on = true
+		} else if *o.on && profilesSupported {
+			profiles = append(profiles, o.profile)
+		}
+	}
+	db.Profiles = profiles
+	return nil
+}
+
+func writeProfilesFile(path string, profiles []string) error {
+	return ioutil.WriteFile(filepath.Join(path, profilesFileName), []byte(strings.Join(profiles, "\n")+"\n"), 0644)
+}
+
+// profileArgs returns the --profile arguments for the profiles enabled for the service at
+// path, none when it has no profiles file.
+func profileArgs(path string) []string {
+	body, err := ioutil.ReadFile(filepath.Join(path, profilesFileName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// the services of the profiles are left out, which compose reports on its own
+			log.Printf("WARN: reading profiles of %s %v", path, err)
+		}
+		return nil
+	}
+	var args []string
+	for _, p := range strings.Fields(string(body)) {
+		args = append(args, "--profile", p)
+	}
+	return args
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// publicIPAuto is set by SPINUP_PUBLIC_IP=auto. The address records point at is then detected
+// at startup and again on every SIGHUP, for hosts whose address changes.
+var publicIPAuto bool
+
+// defaultPublicIPTarget is dialed to find the outbound address without SPINUP_PUBLIC_IP_TARGET.
+// Dialing UDP only picks a route, nothing is sent.
+const defaultPublicIPTarget = "1.1.1.1:53"
+
+// publicIPMu guards publicIP, which a SIGHUP can change while clusters are created.
+var publicIPMu sync.RWMutex
+
+func currentPublicIP() string {
+	publicIPMu.RLock()
+	defer publicIPMu.RUnlock()
+	return publicIP
+}
+
+func setPublicIP(ip string) (old string) {
+	publicIPMu.Lock()
+	defer publicIPMu.Unlock()
+	old, publicIP = publicIP, ip
+	return old
+}
+
+// detectPublicIP finds the IPv4 address of the host, the first one of SPINUP_PUBLIC_IP_INTERFACE
+// or else the one connections to SPINUP_PUBLIC_IP_TARGET leave from. Behind NAT that is the
+// private address, SPINUP_PUBLIC_IP has to be set instead.
+func detectPublicIP() (string, error) {
+	if name := os.Getenv("SPINUP_PUBLIC_IP_INTERFACE"); name != "" {
+		return interfaceIP(name)
+	}
+	target := os.Getenv("SPINUP_PUBLIC_IP_TARGET")
+	if target == "" {
+		target = defaultPublicIPTarget
+	}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return "", fmt.Errorf("finding the route to %s %v", target, err)
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	// the records are A records
+	if ip.To4() == nil {
+		return "", fmt.Errorf("connections to %s leave from %s, which isn't an IPv4 address", target, ip)
+	}
+	return ip.String(), nil
+}
+
+// interfaceIP returns the first global IPv4 address of the network interface name.
+func interfaceIP(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("reading addresses of %s %v", name, err)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if ok && ipNet.IP.To4() != nil && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("interface %s has no global IPv4 address", name)
+}
+
+// redetectPublicIP detects the address again with SPINUP_PUBLIC_IP=auto. The old address is
+// kept when detection fails. Existing records aren't changed, SyncDNS points them at the new one.
+func redetectPublicIP() {
+	if !publicIPAuto {
+		return
+	}
+	ip, err := detectPublicIP()
+	if err != nil {
+		log.Printf("ERROR: detecting public ip, keeping %s %v", currentPublicIP(), err)
+		return
+	}
+	if old := setPublicIP(ip); old != ip {
+		log.Printf("INFO: public ip changed from %s to %s", old, ip)
+	}
+}
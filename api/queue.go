@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// queueCreates makes creates wait for a port when all are occupied, from SPINUP_QUEUE_CREATES.
+var queueCreates bool
+
+var (
+	// queueDepth is how many creates may wait for a port at once, from SPINUP_QUEUE_DEPTH
+	queueDepth = 10
+	// queueTimeout is how long a create waits for a port, from SPINUP_QUEUE_TIMEOUT
+	queueTimeout = time.Minute
+)
+
+// queued counts the creates waiting in waitForPort, guarded by portMu.
+var queued int
+
+// portFreed is closed and replaced whenever a port may have been freed, guarded by portMu.
+var portFreed = make(chan struct{})
+
+// portRecheckInterval is how often waiting creates look for a port without being notified,
+// for ports freed by something other than spinup.
+const portRecheckInterval = 5 * time.Second
+
+// notifyPortFreed wakes the creates waiting for a port. portMu must be held.
+func notifyPortFreed() {
+	close(portFreed)
+	portFreed = make(chan struct{})
+}
+
+// waitForPort waits for a free port until ctx is done or queueTimeout runs out. portMu must be
+// held, it is released while waiting.
+func waitForPort(ctx context.Context) (int, error) {
+	if queued >= queueDepth {
+		return 0, errPortsOccupied
+	}
+	queued++
+	defer func() { queued-- }()
+	ctx, cancel := context.WithTimeout(ctx, queueTimeout)
+	defer cancel()
+	logger(ctx).Printf("INFO: waiting for a free port, %d creates waiting", queued)
+	for {
+		freed := portFreed
+		portMu.Unlock()
+		recheck := time.NewTimer(portRecheckInterval)
+		var done bool
+		select {
+		case <-freed:
+		case <-recheck.C:
+		case <-ctx.Done():
+			done = true
+		}
+		recheck.Stop()
+		portMu.Lock()
+		if done {
+			return 0, errPortsOccupied
+		}
+		port, err := portcheck()
+		if err != errPortsOccupied {
+			return port, err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// readyTCP only waits for the database port to accept connections
+	readyTCP = "tcp"
+	// readyQuery waits for the database to answer a query
+	readyQuery = "query"
+)
+
+var (
+	// readyTimeout is how long a create waits for the cluster to become ready, from
+	// SPINUP_READY_TIMEOUT. A create doesn't wait when it is 0.
+	readyTimeout time.Duration
+	// readyInitialDelay gives the container time to start before the first check
+	readyInitialDelay = time.Second
+	readyInterval     = time.Second
+	// readyCheck is readyTCP or readyQuery, from SPINUP_READY_CHECK
+	readyCheck = readyTCP
+)
+
+// maxReadyTimeout bounds the timeout a request can ask for, to stay well within the write
+// timeout of the server.
+const maxReadyTimeout = 2 * time.Minute
+
+// parseReadyTimeout returns the timeout a create waits for readiness with, the one of the
+// request if it sets one.
+func parseReadyTimeout(requested string) (time.Duration, error) {
+	if requested == "" {
+		return readyTimeout, nil
+	}
+	timeout, err := time.ParseDuration(requested)
+	if err != nil || timeout < 0 || timeout > maxReadyTimeout {
+		return 0, fmt.Errorf("readyTimeout must be a duration between 0s and %v, got %q", maxReadyTimeout, requested)
+	}
+	return timeout, nil
+}
+
+// waitForReady polls the cluster until it is ready, timeout runs out or ctx is done.
+func waitForReady(ctx context.Context, s service, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	wait := readyInitialDelay
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		err := checkReady(ctx, s)
+		if err == nil {
+			return true
+		}
+		logger(ctx).Printf("DEBUG: %s of %s not ready yet %v", s.Db.Name, s.UserID, err)
+		wait = readyInterval
+	}
+}
+
+func checkReady(ctx context.Context, s service) error {
+	if readyCheck == readyQuery {
+		args := append([]string{"exec", s.Db.ID}, dbTypes[s.Db.Type].versionCommand(s.Db.Username)...)
+		_, err := runner.Run(ctx, "docker", args...)
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(hostName(), strconv.Itoa(s.Db.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
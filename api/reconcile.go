@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ReconcileOnStartup cleans up after a crash. The metadata row is written last by a create,
+// so a cluster directory without one is a create which didn't finish: its containers are
+// stopped and its directories removed, so that a new create of the same name starts clean.
+// Rows whose cluster directory is gone are only logged, as they may hold the only record of
+// a cluster. Uploads left behind are removed.
+func ReconcileOnStartup() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	removeStaleUploads()
+	orphans, err := orphanedDirs()
+	if err != nil {
+		log.Printf("ERROR: reconcile reading %s %v", projectDir, err)
+		return
+	}
+	for _, o := range orphans {
+		log.Printf("WARN: reconcile found unfinished create of %s for user %s, rolling it back", o.Name, o.UserID)
+		if err = rollbackCreate(ctx, o.UserID, o.dir); err != nil {
+			log.Printf("ERROR: reconcile rolling back %s of %s %v", o.Name, o.UserID, err)
+			continue
+		}
+		log.Printf("INFO: reconcile rolled back %s of user %s", o.Name, o.UserID)
+	}
+	err = store.EachCluster(func(c clusterInfo) error {
+		if !exists(filepath.Join(servicePath(c.UserID, c.Type, c.Name), "docker-compose.yml")) {
+			log.Printf("WARN: reconcile found cluster %s of user %s without its docker-compose file, it can only be deleted", c.Name, c.UserID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: reconcile reading clusters %v", err)
+	}
+}
+
+// orphanedDir is the directory of a cluster without metadata, left by a create which didn't
+// finish.
+type orphanedDir struct {
+	UserID string
+	Name   string
+	Path   string
+	dir    serviceDir
+}
+
+// orphanedDirs finds the cluster directories with a compose file but without metadata.
+func orphanedDirs() ([]orphanedDir, error) {
+	users, err := os.ReadDir(projectDir)
+	if err != nil {
+		return nil, err
+	}
+	orphans := []orphanedDir{}
+	for _, u := range users {
+		if !u.IsDir() {
+			continue
+		}
+		dirs, err := serviceDirs(u.Name())
+		if err != nil {
+			log.Printf("ERROR: reconcile reading clusters of %s %v", u.Name(), err)
+			continue
+		}
+		for _, d := range dirs {
+			if !exists(filepath.Join(d.path, "docker-compose.yml")) {
+				continue
+			}
+			_, err := store.GetCluster(u.Name(), d.name)
+			if !errors.Is(err, sql.ErrNoRows) {
+				if err != nil {
+					log.Printf("ERROR: reconcile reading cluster %s of %s %v", d.name, u.Name(), err)
+				}
+				continue
+			}
+			orphans = append(orphans, orphanedDir{UserID: u.Name(), Name: d.name, Path: d.path, dir: d})
+		}
+	}
+	return orphans, nil
+}
+
+// rollbackCreate removes the containers and directories of a create which didn't finish.
+func rollbackCreate(ctx context.Context, userID string, d serviceDir) error {
+	// an unfinished create has no row to read the project from, it used the one of today
+	project := composeProject(userID, d.name)
+	unmanaged, err := unmanagedContainers(ctx, project, d.path)
+	if err != nil {
+		return err
+	}
+	if len(unmanaged) > 0 {
+		return fmt.Errorf("compose project %s has containers spinup doesn't manage, remove them by hand: %s", project, strings.Join(unmanaged, ", "))
+	}
+	if _, err = runner.Run(ctx, "docker-compose", append(composeFiles(d.path, project), withStopTimeout("down", "-v")...)...); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(d.path); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Dir(dataPath(userID, d.dbType, d.name)))
+}
+
+// unmanagedContainers are the containers of the compose project which don't carry
+// managedLabel, e.g. ones a user started under the same project name. Services added by a
+// compose override don't have the label either, they are told apart by being started from
+// the cluster's directory dir.
+func unmanagedContainers(ctx context.Context, project, dir string) ([]string, error) {
+	format := "{{.Names}}\t{{.Label \"" + managedLabel + "\"}}\t{{.Label \"com.docker.compose.project.working_dir\"}}"
+	output, err := runner.Run(ctx, "docker", "ps", "-a", "--filter", "label=com.docker.compose.project="+project, "--format", format)
+	if err != nil {
+		return nil, err
+	}
+	var unmanaged []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 || fields[1] == "spinup" || fields[2] == dir {
+			continue
+		}
+		unmanaged = append(unmanaged, fields[0])
+	}
+	return unmanaged, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// envFile is read at startup and again on every SIGHUP, from SPINUP_ENV_FILE. Its variables
+// take precedence over the environment of the process, which can't change once it runs.
+var envFile string
+
+// maintenance is 1 while new clusters are rejected, see SPINUP_MAINTENANCE.
+var maintenance int32
+
+// allowedUsers holds the map[string]bool of the users which may provision clusters, from
+// SPINUP_ALLOWED_USERS. A nil map allows every user with a valid token.
+var allowedUsers atomic.Value
+
+// loadEnvFile sets the KEY=VALUE lines of path as environment variables. Blank lines and
+// lines starting with # are skipped.
+func loadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		if err = os.Setenv(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// applyReloadable applies the settings which can change without a restart.
+func applyReloadable() {
+	setMaintenance(os.Getenv("SPINUP_MAINTENANCE") == "true")
+	setAllowedUsers(os.Getenv("SPINUP_ALLOWED_USERS"))
+}
+
+// setAllowedUsers applies the comma-separated list of users allowed to provision clusters.
+// An empty list or * allows everyone.
+func setAllowedUsers(list string) {
+	var users map[string]bool
+	for _, u := range strings.Split(list, ",") {
+		u = strings.TrimSpace(u)
+		if u == "*" {
+			users = nil
+			break
+		}
+		if u == "" {
+			continue
+		}
+		if users == nil {
+			users = map[string]bool{}
+		}
+		users[u] = true
+	}
+	previous, _ := allowedUsers.Load().(map[string]bool)
+	allowedUsers.Store(users)
+	switch {
+	case users == nil && previous != nil:
+		log.Println("INFO: every user may provision clusters")
+	case users != nil:
+		log.Printf("INFO: %d users may provision clusters", len(users))
+	}
+}
+
+// rejectUnlistedUser answers with 403 when userID isn't in SPINUP_ALLOWED_USERS and returns
+// whether it did.
+func rejectUnlistedUser(w http.ResponseWriter, userID string) bool {
+	users, _ := allowedUsers.Load().(map[string]bool)
+	if users == nil || users[userID] {
+		return false
+	}
+	log.Printf("WARN: user %s isn't allowed to provision clusters", userID)
+	http.Error(w, "user isn't allowed to provision clusters", http.StatusForbidden)
+	return true
+}
+
+func setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&maintenance, v) == v {
+		return
+	}
+	if on {
+		log.Println("WARN: maintenance mode on, new clusters are rejected")
+	} else {
+		log.Println("WARN: maintenance mode off")
+	}
+}
+
+// rejectInMaintenance answers with 503 while in maintenance mode and returns whether it did.
+func rejectInMaintenance(w http.ResponseWriter) bool {
+	if atomic.LoadInt32(&maintenance) == 0 {
+		return false
+	}
+	http.Error(w, "spinup is under maintenance and doesn't accept new clusters, try again later", http.StatusServiceUnavailable)
+	return true
+}
+
+// WatchReload re-reads SPINUP_ENV_FILE and reapplies the reloadable settings on every SIGHUP.
+func WatchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("INFO: reloading configuration on SIGHUP")
+			if envFile != "" {
+				if err := loadEnvFile(envFile); err != nil {
+					log.Printf("ERROR: reloading %s %v", envFile, err)
+					continue
+				}
+			}
+			applyReloadable()
+			redetectPublicIP()
+		}
+	}()
+}
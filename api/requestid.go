@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	// the id of the job a context belongs to
+	jobKey
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// incoming request ids are only taken over when they can't mess up a log line
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID tags every request with the X-Request-ID of the client, or a generated one. The id
+// is echoed in the response and prefixed to every log line of the request through logger.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		l := log.New(log.Writer(), "req="+id+" ", log.Flags()|log.Lmsgprefix)
+		// RemoteAddr is the client's even behind a load balancer with SPINUP_PROXY_PROTOCOL
+		l.Printf("INFO: %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), loggerKey, l)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("ERROR: generating request id %v", err)
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// detach returns a context with the logger of ctx which isn't canceled with it, for work
+// which outlives the request of ctx.
+func detach(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), loggerKey, logger(ctx))
+}
+
+// logger returns the logger of the request ctx belongs to, or the standard logger outside of one.
+func logger(ctx context.Context) *log.Logger {
+	if l, ok := ctx.Value(loggerKey).(*log.Logger); ok {
+		return l
+	}
+	return log.Default()
+}
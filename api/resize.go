@@ -0,0 +1,123 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type resizeRequest struct {
+	// the new storage of the cluster, e.g. 20G
+	Storage string
+}
+
+type resizeResponse struct {
+	Name    string
+	Storage string
+}
+
+// errCannotResize is returned for volumes spinup can't grow while the cluster runs.
+var errCannotResize = errors.New("volume can't be resized online")
+
+// ResizeVolume grows the storage allocated to a cluster and records it. The data directory
+// spinup creates for a cluster, like a plain local volume, is a directory on the host
+// filesystem and grows with it, so only the new size has to be recorded. Volumes of other
+// drivers have to be grown with the driver's tools first.
+func ResizeVolume(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	var rr resizeRequest
+	if err = decodeJSONBody(w, req, &rr); err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: decoding resize body %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	size, err := parseSize("storage", rr.Storage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cluster.Storage != "" {
+		// a size recorded before is valid, it passed the same check
+		current, _ := parseSize("storage", cluster.Storage)
+		if size < current {
+			http.Error(w, fmt.Sprintf("storage can only grow, the cluster has %s", cluster.Storage), http.StatusBadRequest)
+			return
+		}
+	}
+	if err = checkResizable(req.Context(), cluster); err != nil {
+		if errors.Is(err, errCannotResize) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: inspecting volume of %s %v", name, err)
+		http.Error(w, "Error inspecting volume", 500)
+		return
+	}
+	if err = store.SetStorage(userId, name, rr.Storage); err != nil {
+		logger(req.Context()).Printf("ERROR: recording storage of %s %v", name, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	from := cluster.Storage
+	if from == "" {
+		from = "unset"
+	}
+	audit(userId, userId, name, cluster.ClusterID, auditResize, fmt.Sprintf("storage %s to %s", from, rr.Storage))
+	logger(req.Context()).Printf("INFO: resized storage of %s for user %s to %s", name, userId, rr.Storage)
+	jsonBody, err := json.Marshal(resizeResponse{Name: name, Storage: rr.Storage})
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling resize response %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
+
+// checkResizable returns errCannotResize when the cluster's storage is a volume which doesn't
+// grow with the host filesystem, i.e. one of another driver or a local volume on a device.
+func checkResizable(ctx context.Context, c clusterInfo) error {
+	if c.ExistingVolume == "" {
+		return nil
+	}
+	output, err := runner.Run(ctx, "docker", "volume", "inspect", "--format", "{{.Driver}} {{len .Options}}", c.ExistingVolume)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 2 && fields[0] == "local" && fields[1] == "0" {
+		return nil
+	}
+	return fmt.Errorf("%w, volume %s has driver options, grow it with the tools of its driver and resize again", errCannotResize, c.ExistingVolume)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// RestoreService restores an uploaded dump into one of the user's clusters with the
+// restoreCommand of its type, pg_restore for postgres and mongorestore for mongo. The dump is
+// the dump part of a multipart/form-data body, in the format of the scheduled backups, and is
+// streamed to disk rather than held in memory. With SPINUP_REQUIRE_SIGNED_UPLOADS a signature
+// part must carry its detached signature. Objects of the dump which exist in the database are
+// dropped and recreated.
+func RestoreService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if cluster.DeletedAt > 0 {
+		http.Error(w, "cluster is deleted", http.StatusConflict)
+		return
+	}
+	if dbTypes[cluster.Type].restoreCommand == nil {
+		http.Error(w, "restoring isn't supported for "+cluster.Type, http.StatusBadRequest)
+		return
+	}
+	u, err := receiveUpload(w, req, "dump")
+	if err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: receiving dump for %s of %s %v", name, userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	// an async restore hands the upload to its job, which removes it when done
+	jobStarted := false
+	defer func() {
+		if !jobStarted {
+			os.Remove(u.path)
+		}
+	}()
+	if err = verifyUploadFile("dump", u); err != nil {
+		logger(req.Context()).Printf("ERROR: unverified dump for %s of %s %v", name, userId, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.URL.Query().Get("async") == "true" {
+		j, err := startJob(req.Context(), userId, jobRestore, name, nil, func() { os.Remove(u.path) }, func(ctx context.Context) (interface{}, error) {
+			return nil, restoreCluster(ctx, cluster, u)
+		})
+		if err != nil {
+			logger(req.Context()).Printf("ERROR: starting restore job of %s for %s %v", name, userId, err)
+			http.Error(w, "Internal server error ", 500)
+			return
+		}
+		jobStarted = true
+		writeJobStarted(w, req, j)
+		return
+	}
+	if err = restoreCluster(req.Context(), cluster, u); err != nil {
+		logger(req.Context()).Printf("ERROR: restoring dump into %s of %s %v", name, userId, err)
+		http.Error(w, "Error restoring dump", 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreCluster restores the dump of u into cluster and records it in the cluster's history.
+func restoreCluster(ctx context.Context, cluster clusterInfo, u upload) error {
+	script := fmt.Sprintf("docker exec -i %s %s < %s",
+		cluster.ClusterID, shellWords(dbTypes[cluster.Type].restoreCommand(cluster.Username)), shellQuote(u.path))
+	if _, err := runner.Run(ctx, "sh", "-c", script); err != nil {
+		return err
+	}
+	audit(cluster.UserID, cluster.UserID, cluster.Name, cluster.ClusterID, auditRestore, fmt.Sprintf("%d bytes", u.size))
+	logger(ctx).Printf("INFO: restored %d bytes into %s of user %s", u.size, cluster.Name, cluster.UserID)
+	return nil
+}
@@ -0,0 +1,28 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRestoreClusterRestores(t *testing.T) {
+	for _, tt := range []struct {
+		dbType, username, restore string
+	}{
+		{"postgres", "postgres", "docker exec -i cid pg_restore --clean --if-exists --no-owner --exit-on-error -U postgres -d postgres < '/tmp/dump'"},
+		{"mongo", "root", `docker exec -i cid sh -c 'exec mongorestore --quiet --archive --gzip --drop -u "$MONGO_INITDB_ROOT_USERNAME" -p "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin' < '/tmp/dump'`},
+	} {
+		t.Run(tt.dbType, func(t *testing.T) {
+			fake := &fakeRunner{}
+			useRunner(t, fake)
+			c := clusterInfo{UserID: "alice", ClusterID: "cid", Name: "db", Type: tt.dbType, Username: tt.username}
+			if err := restoreCluster(context.Background(), c, upload{path: "/tmp/dump", size: 4}); err != nil {
+				t.Fatalf("restoreCluster: %v", err)
+			}
+			if strings.Join(fake.commands, "\n") != "sh -c "+tt.restore {
+				t.Errorf("want the restore run as %q, ran %q", tt.restore, fake.commands)
+			}
+		})
+	}
+}
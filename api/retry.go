@@ -0,0 +1,105 @@
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// retryTransport retries requests which were rate limited (429) or failed on the server (5xx),
+// backing off exponentially with full jitter. A Retry-After sent by the server takes precedence
+// over the computed backoff. Retrying stops as soon as the request's context is done, so the
+// total time spent is capped by the caller. A request which isn't idempotent, like the POST
+// creating a record, may have taken effect once it was sent, so it is only retried when it was
+// rate limited or failed before it was sent; a retry could create a duplicate otherwise.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	minDelay   time.Duration
+	maxDelay   time.Duration
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			r = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+		var sent int32
+		if !idempotent[req.Method] {
+			r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+				WroteHeaders: func() { atomic.StoreInt32(&sent, 1) },
+			}))
+		}
+		resp, err := t.next.RoundTrip(r)
+		if attempt == t.maxRetries || req.Context().Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+		if atomic.LoadInt32(&sent) == 1 && (resp == nil || resp.StatusCode != http.StatusTooManyRequests) {
+			return resp, err
+		}
+		delay := t.backoff(attempt, resp)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logger(req.Context()).Printf("WARN: %s %s failed with %s, retry %d in %v", req.Method, req.URL.Path, reason, attempt+1, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// idempotent are the methods a request can be repeated with to the same effect.
+var idempotent = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func (t retryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if v := resp.Header.Get("Retry-After"); v != "" {
+			if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second
+			}
+			if at, err := http.ParseTime(v); err == nil {
+				return time.Until(at)
+			}
+		}
+	}
+	d := t.minDelay << uint(attempt)
+	if d <= 0 || d > t.maxDelay {
+		d = t.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
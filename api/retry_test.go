@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptedTransport answers the requests it gets with the next of its responses, and tells
+// whether the request was sent like a transport does once it wrote the headers.
+type scriptedTransport struct {
+	responses []scriptedResponse
+	calls     int
+}
+
+type scriptedResponse struct {
+	status int
+	err    error
+	// whether the request was sent before err
+	sent bool
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the last response repeats
+	r := s.responses[len(s.responses)-1]
+	if s.calls < len(s.responses) {
+		r = s.responses[s.calls]
+	}
+	s.calls++
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.WroteHeaders != nil && (r.err == nil || r.sent) {
+		trace.WroteHeaders()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &http.Response{StatusCode: r.status, Status: http.StatusText(r.status), Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	refused := errors.New("dial tcp: connection refused")
+	reset := errors.New("read: connection reset by peer")
+	for _, tt := range []struct {
+		name       string
+		method     string
+		responses  []scriptedResponse
+		wantCalls  int
+		wantStatus int
+	}{
+		{name: "GET after 5xx", method: "GET", responses: []scriptedResponse{{status: 503}, {status: 200}}, wantCalls: 2, wantStatus: 200},
+		{name: "GET after an error once sent", method: "GET", responses: []scriptedResponse{{err: reset, sent: true}, {status: 200}}, wantCalls: 2, wantStatus: 200},
+		{name: "DELETE after 5xx", method: "DELETE", responses: []scriptedResponse{{status: 502}, {status: 200}}, wantCalls: 2, wantStatus: 200},
+		{name: "POST after 429", method: "POST", responses: []scriptedResponse{{status: 429}, {status: 200}}, wantCalls: 2, wantStatus: 200},
+		{name: "POST after an error before sending", method: "POST", responses: []scriptedResponse{{err: refused}, {status: 200}}, wantCalls: 2, wantStatus: 200},
+		{name: "POST after 5xx", method: "POST", responses: []scriptedResponse{{status: 500}, {status: 200}}, wantCalls: 1, wantStatus: 500},
+		{name: "POST after an error once sent", method: "POST", responses: []scriptedResponse{{err: reset, sent: true}, {status: 200}}, wantCalls: 1},
+		{name: "PATCH after 5xx", method: "PATCH", responses: []scriptedResponse{{status: 503}, {status: 200}}, wantCalls: 1, wantStatus: 503},
+		{name: "gives up after the retries", method: "GET", responses: []scriptedResponse{{status: 503}}, wantCalls: 3, wantStatus: 503},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &scriptedTransport{responses: tt.responses}
+			transport := retryTransport{next: next, maxRetries: 2, minDelay: time.Millisecond, maxDelay: time.Millisecond}
+			req, err := http.NewRequest(tt.method, "http://api.example.com/zones/z/dns_records", strings.NewReader(`{"type":"A"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := transport.RoundTrip(req)
+			if next.calls != tt.wantCalls {
+				t.Errorf("want %d attempts, made %d", tt.wantCalls, next.calls)
+			}
+			if tt.wantStatus == 0 {
+				if err == nil {
+					t.Errorf("want the error of the attempt, got %d", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil || resp.StatusCode != tt.wantStatus {
+				t.Errorf("want %d, got %v %v", tt.wantStatus, resp, err)
+			}
+		})
+	}
+}
+
+func TestRetryTransportDoesntRepeatSentPOST(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		http.Error(w, "upstream timeout", http.StatusGatewayTimeout)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: retryTransport{next: http.DefaultTransport, maxRetries: 3, minDelay: time.Millisecond, maxDelay: time.Millisecond}}
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader(`{"type":"A"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls != 1 || resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("want the POST sent once and its 504 returned, sent %d times, got %d", calls, resp.StatusCode)
+	}
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	route53Endpoint = "https://route53.amazonaws.com/2013-04-01"
+	route53Region   = "us-east-1"
+	// ttl of the records spinup creates in Route53, which has no automatic ttl
+	route53TTL = 300
+)
+
+// route53Provider manages records in Route53 hosted zones, with the credentials of
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. The few calls spinup needs
+// are signed with Signature Version 4 here rather than pulling in the AWS SDK.
+type route53Provider struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func newRoute53Provider() (*route53Provider, error) {
+	p := &route53Provider{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if p.accessKey == "" || p.secretKey == "" {
+		return nil, errors.New("SPINUP_DNS_PROVIDER=route53 needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return p, nil
+}
+
+type route53RecordSet struct {
+	Name   string   `xml:"Name"`
+	Type   string   `xml:"Type"`
+	TTL    int      `xml:"TTL"`
+	Values []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53Change struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53ListResponse struct {
+	RecordSets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+}
+
+type route53Error struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// route53 record sets have no id, a record is identified by its type, name, ttl and value,
+// which a delete has to repeat exactly.
+func route53ID(rs route53RecordSet, value string) string {
+	return strings.Join([]string{rs.Type, rs.Name, strconv.Itoa(rs.TTL), value}, "|")
+}
+
+func parseRoute53ID(id string) (route53RecordSet, error) {
+	parts := strings.Split(id, "|")
+	if len(parts) != 4 {
+		return route53RecordSet{}, fmt.Errorf("%q is not a route53 record id", id)
+	}
+	ttl, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return route53RecordSet{}, fmt.Errorf("%q is not a route53 record id", id)
+	}
+	return route53RecordSet{Type: parts[0], Name: parts[1], TTL: ttl, Values: []string{parts[3]}}, nil
+}
+
+// fqdn is name as route53 returns it, with the trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+func (p *route53Provider) ListRecords(ctx context.Context, zoneID, recordType, name string) ([]DNSRecord, error) {
+	query := url.Values{"name": {fqdn(name)}, "maxitems": {"100"}}
+	if recordType != "" {
+		query.Set("type", recordType)
+	}
+	var res route53ListResponse
+	if err := p.do(ctx, "GET", "/hostedzone/"+route53Zone(zoneID)+"/rrset", query, nil, &res); err != nil {
+		return nil, err
+	}
+	var records []DNSRecord
+	// the listing starts at name and goes on with the names after it
+	for _, rs := range res.RecordSets {
+		if rs.Name != fqdn(name) || (recordType != "" && rs.Type != recordType) {
+			continue
+		}
+		for _, v := range rs.Values {
+			records = append(records, DNSRecord{ID: route53ID(rs, v), Type: rs.Type, Name: name, Content: v})
+		}
+	}
+	return records, nil
+}
+
+func (p *route53Provider) CreateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	return p.change(ctx, zoneID, route53Change{Action: "CREATE", RecordSet: route53RecordSet{Name: fqdn(r.Name), Type: r.Type, TTL: route53TTL, Values: []string{r.Content}}})
+}
+
+func (p *route53Provider) UpdateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	old, err := parseRoute53ID(r.ID)
+	if err != nil {
+		return err
+	}
+	return p.change(ctx, zoneID,
+		route53Change{Action: "DELETE", RecordSet: old},
+		route53Change{Action: "CREATE", RecordSet: route53RecordSet{Name: fqdn(r.Name), Type: r.Type, TTL: old.TTL, Values: []string{r.Content}}},
+	)
+}
+
+func (p *route53Provider) DeleteRecord(ctx context.Context, zoneID, id string) error {
+	old, err := parseRoute53ID(id)
+	if err != nil {
+		return err
+	}
+	return p.change(ctx, zoneID, route53Change{Action: "DELETE", RecordSet: old})
+}
+
+// checkZone makes sure the credentials can read the hosted zone zoneID.
+func (p *route53Provider) checkZone(ctx context.Context, zoneID string) error {
+	if err := p.do(ctx, "GET", "/hostedzone/"+route53Zone(zoneID), nil, nil, nil); err != nil {
+		return fmt.Errorf("reading hosted zone %s %v", zoneID, err)
+	}
+	return nil
+}
+
+// change applies the changes in one batch, which route53 applies all or none of.
+func (p *route53Provider) change(ctx context.Context, zoneID string, changes ...route53Change) error {
+	body, err := xml.Marshal(route53ChangeRequest{Changes: changes})
+	if err != nil {
+		return err
+	}
+	return p.do(ctx, "POST", "/hostedzone/"+route53Zone(zoneID)+"/rrset", nil, body, nil)
+}
+
+// route53Zone accepts hosted zone ids with or without their /hostedzone/ prefix.
+func route53Zone(zoneID string) string {
+	return strings.TrimPrefix(zoneID, "/hostedzone/")
+}
+
+func (p *route53Provider) do(ctx context.Context, method, path string, query url.Values, body []byte, dst interface{}) error {
+	u := route53Endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	p.sign(req, body, time.Now())
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		var e route53Error
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return fmt.Errorf("route53 %s: %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("route53 answered %s", res.Status)
+	}
+	if dst == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, dst)
+}
+
+// sign adds a Signature Version 4 Authorization header to req.
+func (p *route53Provider) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := map[string]string{"host": req.URL.Host, "x-amz-date": amzDate}
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+		headers["x-amz-security-token"] = p.sessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	// sigv4 wants spaces as %20, url.Values encodes them as +
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	payload := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := date + "/" + route53Region + "/route53/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+	key := hmacSHA256([]byte("AWS4"+p.secretKey), date)
+	for _, part := range []string{route53Region, "route53", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", p.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
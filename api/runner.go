@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Runner runs the docker and docker-compose commands spinup provisions clusters with. A
+// program embedding the package can supply its own with SetRunner, e.g. to run the commands
+// on another host over SSH, to sandbox them, or to fake them without a docker daemon.
+type Runner interface {
+	// Run runs name with args and returns its standard output. The error includes the
+	// standard error of the command when it fails.
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// lineRunner is implemented by runners which can hand out the output of a command while it
+// runs, used to log the progress of long commands like docker pull. A Runner only needs a
+// RunLines method of the same signature to be used this way.
+type lineRunner interface {
+	RunLines(ctx context.Context, onLine func(string), name string, args ...string) error
+}
+
+// runner runs every command of the package.
+var runner Runner = LocalRunner{}
+
+// SetRunner replaces the LocalRunner every command runs with by default. It must be called
+// before the server handles requests.
+func SetRunner(r Runner) {
+	runner = r
+}
+
+// LocalRunner runs commands on this host.
+type LocalRunner struct{}
+
+func (LocalRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return output, commandError(name, args, err, stderr.String())
+	}
+	return output, nil
+}
+
+func (LocalRunner) RunLines(ctx context.Context, onLine func(string), name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		onLine(scanner.Text())
+	}
+	if err = cmd.Wait(); err != nil {
+		return commandError(name, args, err, stderr.String())
+	}
+	return nil
+}
+
+// runLines runs a command through runner, handing out its output line by line. The lines only
+// come at the end when runner can't stream them.
+func runLines(ctx context.Context, onLine func(string), name string, args ...string) error {
+	if lr, ok := runner.(lineRunner); ok {
+		return lr.RunLines(ctx, onLine, name, args...)
+	}
+	output, err := runner.Run(ctx, name, args...)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			onLine(line)
+		}
+	}
+	return err
+}
+
+func commandError(name string, args []string, err error, stderr string) error {
+	sub := ""
+	if len(args) > 0 {
+		sub = " " + args[0]
+	}
+	return fmt.Errorf("%s%s %v: %s", name, sub, err, strings.TrimSpace(stderr))
+}
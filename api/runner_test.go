@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner stands in for docker and docker-compose. It records the commands it runs and
+// answers each with the first response whose pattern the command line contains, or with no
+// output when none does.
+type fakeRunner struct {
+	mu        sync.Mutex
+	commands  []string
+	responses []fakeResponse
+}
+
+type fakeResponse struct {
+	pattern string
+	output  string
+	err     error
+}
+
+// on answers the commands containing pattern with output and err.
+func (f *fakeRunner) on(pattern, output string, err error) *fakeRunner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{pattern, output, err})
+	return f
+}
+
+func (f *fakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, line)
+	for _, r := range f.responses {
+		if strings.Contains(line, r.pattern) {
+			return []byte(r.output), r.err
+		}
+	}
+	return nil, nil
+}
+
+// ran returns the commands run so far which contain pattern.
+func (f *fakeRunner) ran(pattern string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var matching []string
+	for _, c := range f.commands {
+		if strings.Contains(c, pattern) {
+			matching = append(matching, c)
+		}
+	}
+	return matching
+}
+
+// useRunner makes the package run its commands with r for the rest of the test.
+func useRunner(t *testing.T, r Runner) {
+	previous := runner
+	runner = r
+	t.Cleanup(func() { runner = previous })
+}
+
+func TestStartService(t *testing.T) {
+	fake := &fakeRunner{}
+	useRunner(t, fake)
+	path := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(path, "docker-compose.yml"), []byte("services: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := service{UserID: "alice", Db: dbCluster{Name: "db", Type: "postgres", ComposeProject: "alice-db"}}
+	if err := startService(context.Background(), s, path); err != nil {
+		t.Fatalf("startService: %v", err)
+	}
+	want := []string{
+		"which docker-compose",
+		"which docker",
+		"docker-compose -f " + filepath.Join(path, "docker-compose.yml") + " config -q",
+		"docker-compose -f " + filepath.Join(path, "docker-compose.yml") + " -p alice-db up -d",
+	}
+	if strings.Join(fake.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want commands %q, ran %q", want, fake.commands)
+	}
+}
+
+func TestStartServiceComposeFails(t *testing.T) {
+	useRunner(t, (&fakeRunner{}).on(" up -d", "", errors.New("docker-compose up exit status 1: port is already allocated")))
+	s := service{UserID: "alice", Db: dbCluster{Name: "db", Type: "postgres", ComposeProject: "alice-db"}}
+	err := startService(context.Background(), s, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "port is already allocated") {
+		t.Fatalf("want the stderr of docker-compose in the error, got %v", err)
+	}
+}
+
+func TestValidateSystemRequirements(t *testing.T) {
+	useRunner(t, (&fakeRunner{}).on("which docker-compose", "", errors.New("which exit status 1")))
+	if err := ValidateSystemRequirements(); err == nil {
+		t.Fatal("want an error without docker-compose")
+	}
+	useRunner(t, &fakeRunner{})
+	if err := ValidateSystemRequirements(); err != nil {
+		t.Fatalf("want no error with docker and docker-compose, got %v", err)
+	}
+}
+
+func TestServiceContainerID(t *testing.T) {
+	fake := (&fakeRunner{}).on("ps -q postgres", "0123abcd\n", nil)
+	useRunner(t, fake)
+	id, err := serviceContainerID(context.Background(), "/clusters/alice/db", "alice-db", "postgres")
+	if err != nil || id != "0123abcd" {
+		t.Fatalf("want 0123abcd, got %q %v", id, err)
+	}
+	if len(fake.ran("-p alice-db ps -q postgres")) != 1 {
+		t.Errorf("want ps of the project, ran %q", fake.commands)
+	}
+}
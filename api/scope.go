@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// adminScope is the scope or role a token needs for the admin endpoints.
+const adminScope = "admin"
+
+// hasScope reports whether the token grants scope, either in its scope claim, a space separated
+// list as in OAuth 2, or in its roles claim, a list or a single role.
+func (c *claims) hasScope(scope string) bool {
+	for _, name := range []string{"scope", "roles"} {
+		switch v := c.raw[name].(type) {
+		case string:
+			for _, s := range strings.Fields(v) {
+				if s == scope {
+					return true
+				}
+			}
+		case []interface{}:
+			for _, s := range v {
+				if s == scope {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// RequireScope only lets requests through to next whose token grants scope. The users in
+// SPINUP_ADMIN_USERS have the admin scope whatever their token says, which relies on tokens
+// only being issued to the users they name, by /githubAuth or an identity provider. A request
+// without a valid token gets 401, one whose token lacks the scope 403.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		reqToken, err := bearerToken(req.Header.Get("Authorization"))
+		var c *claims
+		if err == nil {
+			c, err = parseToken(reqToken)
+		}
+		var userID string
+		if err == nil {
+			userID, err = c.userID()
+		}
+		if err != nil {
+			logger(req.Context()).Printf("error validating token %v", err)
+			http.Error(w, "error validating token", http.StatusUnauthorized)
+			return
+		}
+		if !c.hasScope(scope) && !(scope == adminScope && adminUsers[userID]) {
+			logger(req.Context()).Printf("WARN: user %s without scope %s trying to access %s", userID, scope, req.URL.Path)
+			http.Error(w, scope+" access required", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// shardedStore spreads the metadata over several stores by a hash of the user id, so all the
+// clusters and history of a user live in one shard. Lookups across users ask every shard.
+type shardedStore struct {
+	shards []Store
+}
+
+func newShardedStore(shards []Store) *shardedStore {
+	return &shardedStore{shards: shards}
+}
+
+// shard returns the store the metadata of userID lives in. The number of shards can't change
+// without moving the users to their new shards.
+func (s *shardedStore) shard(userID string) Store {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *shardedStore) InsertCluster(c clusterInfo) error {
+	return s.shard(c.UserID).InsertCluster(c)
+}
+
+func (s *shardedStore) GetCluster(userID, name string) (clusterInfo, error) {
+	return s.shard(userID).GetCluster(userID, name)
+}
+
+func (s *shardedStore) ListClusters(userID string) ([]clusterInfo, error) {
+	return s.shard(userID).ListClusters(userID)
+}
+
+func (s *shardedStore) DeleteCluster(userID, name string) error {
+	return s.shard(userID).DeleteCluster(userID, name)
+}
+
+func (s *shardedStore) SetDNSStatus(userID, name, status string) error {
+	return s.shard(userID).SetDNSStatus(userID, name, status)
+}
+
+func (s *shardedStore) SetDNSReady(userID, name string, ready bool) error {
+	return s.shard(userID).SetDNSReady(userID, name, ready)
+}
+
+func (s *shardedStore) ExpiredClusters(now time.Time) ([]clusterInfo, error) {
+	var expired []clusterInfo
+	for _, shard := range s.shards {
+		clusters, err := shard.ExpiredClusters(now)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, clusters...)
+	}
+	return expired, nil
+}
+
+func (s *shardedStore) SetDeletedAt(userID, name string, deletedAt int64) error {
+	return s.shard(userID).SetDeletedAt(userID, name, deletedAt)
+}
+
+func (s *shardedStore) SetStorage(userID, name, storage string) error {
+	return s.shard(userID).SetStorage(userID, name, storage)
+}
+
+func (s *shardedStore) SetLastBackup(userID, name string, at int64, status string) error {
+	return s.shard(userID).SetLastBackup(userID, name, at, status)
+}
+
+func (s *shardedStore) SetTimeouts(userID, name, statementTimeout, idleTimeout string) error {
+	return s.shard(userID).SetTimeouts(userID, name, statementTimeout, idleTimeout)
+}
+
+func (s *shardedStore) DeletedClusters(before time.Time) ([]clusterInfo, error) {
+	var deleted []clusterInfo
+	for _, shard := range s.shards {
+		clusters, err := shard.DeletedClusters(before)
+		if err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, clusters...)
+	}
+	return deleted, nil
+}
+
+func (s *shardedStore) EachCluster(fn func(clusterInfo) error) error {
+	for _, shard := range s.shards {
+		if err := shard.EachCluster(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) CountClusters() (int, error) {
+	total := 0
+	for _, shard := range s.shards {
+		n, err := shard.CountClusters()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (s *shardedStore) Users() ([]string, error) {
+	var users []string
+	for _, shard := range s.shards {
+		u, err := shard.Users()
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u...)
+	}
+	// a user only lives in one shard, so there are no duplicates to drop
+	sort.Strings(users)
+	return users, nil
+}
+
+// AllocatedPorts are the ports of every shard, since the clusters of all users share the host.
+func (s *shardedStore) AllocatedPorts() (map[int]struct{}, error) {
+	ports := map[int]struct{}{}
+	for _, shard := range s.shards {
+		p, err := shard.AllocatedPorts()
+		if err != nil {
+			return nil, err
+		}
+		for port := range p {
+			ports[port] = struct{}{}
+		}
+	}
+	return ports, nil
+}
+
+func (s *shardedStore) InsertAuditEvent(e auditEvent) error {
+	return s.shard(e.UserID).InsertAuditEvent(e)
+}
+
+func (s *shardedStore) AuditEvents(userID, name string) ([]auditEvent, error) {
+	return s.shard(userID).AuditEvents(userID, name)
+}
+
+func (s *shardedStore) InsertJob(j job) error {
+	return s.shard(j.UserID).InsertJob(j)
+}
+
+func (s *shardedStore) UpdateJob(j job) error {
+	return s.shard(j.UserID).UpdateJob(j)
+}
+
+func (s *shardedStore) GetJob(userID, id string) (job, error) {
+	return s.shard(userID).GetJob(userID, id)
+}
+
+func (s *shardedStore) ListJobs(userID string) ([]job, error) {
+	return s.shard(userID).ListJobs(userID)
+}
+
+func (s *shardedStore) DeleteJobs(before int64) error {
+	for _, shard := range s.shards {
+		if err := shard.DeleteJobs(before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) FailRunningJobs(at int64, msg string) error {
+	for _, shard := range s.shards {
+		if err := shard.FailRunningJobs(at, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) Close() error {
+	var firstErr error
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// requireSignedUploads makes spinup reject uploaded artifacts, like compose overrides, which
+// don't come with a detached signature by uploadKey. From SPINUP_REQUIRE_SIGNED_UPLOADS.
+var requireSignedUploads bool
+
+// uploadKey is the public key uploads are verified with, from SPINUP_UPLOAD_PUBLIC_KEY.
+var uploadKey crypto.PublicKey
+
+// loadUploadKey reads a PEM encoded Ed25519, RSA or ECDSA public key.
+func loadUploadKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s has no PEM public key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s holds a %T, only Ed25519, RSA and ECDSA keys are supported", path, key)
+}
+
+var errBadSignature = errors.New("signature doesn't match")
+
+// verifyUpload checks sig, the base64 of a detached signature of data, when uploads must be
+// signed. Ed25519 signs data itself, RSA (PKCS #1 v1.5) and ECDSA its SHA-256. field names the
+// upload in the error.
+func verifyUpload(field string, data []byte, sig string) error {
+	if !requireSignedUploads {
+		return nil
+	}
+	if sig == "" {
+		return fmt.Errorf("%s must be signed, set %sSignature", field, field)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("%sSignature is not base64", field)
+	}
+	digest := sha256.Sum256(data)
+	ok := false
+	switch key := uploadKey.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, data, raw)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], raw) == nil
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, digest[:], raw)
+	}
+	if !ok {
+		return fmt.Errorf("%s: %v", field, errBadSignature)
+	}
+	return nil
+}
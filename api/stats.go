@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsCacheTTL is how long the stats of a cluster are served from the cache, so frequent
+// polls don't each run queries on the cluster.
+const statsCacheTTL = 5 * time.Second
+
+type serviceStats struct {
+	Name              string
+	ActiveConnections int
+	// size of the cluster's current database in bytes
+	DatabaseSize int64
+	// commits and rollbacks per second since the previous sample, unset for the first one
+	TransactionsPerSecond *float64 `json:",omitempty"`
+	UptimeSeconds         int64
+	// unix time the stats were gathered at
+	CollectedAt int64
+}
+
+type statsSample struct {
+	stats serviceStats
+	// transactions of every database of the cluster when the stats were gathered
+	xacts       int64
+	at          time.Time
+	containerID string
+}
+
+var (
+	statsMu    sync.Mutex
+	statsCache = map[string]statsSample{}
+)
+
+// ServiceStats reports live metrics of a postgres cluster.
+func ServiceStats(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if cluster.Type != "postgres" {
+		http.Error(w, "stats are only supported for postgres", http.StatusBadRequest)
+		return
+	}
+	stats, err := clusterStats(req.Context(), cluster, time.Now())
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: gathering stats of %s %v", cluster.ClusterID, err)
+		http.Error(w, "Error gathering stats", 500)
+		return
+	}
+	jsonBody, err := json.Marshal(stats)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling stats %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Write(jsonBody)
+}
+
+// clusterStats returns the stats of cluster, from the cache when they are recent enough.
+func clusterStats(ctx context.Context, cluster clusterInfo, now time.Time) (serviceStats, error) {
+	key := cluster.UserID + "/" + cluster.Name
+	statsMu.Lock()
+	prev, cached := statsCache[key]
+	statsMu.Unlock()
+	// a recreated cluster has a new container, whose counters start over
+	cached = cached && prev.containerID == cluster.ClusterID
+	if cached && now.Sub(prev.at) < statsCacheTTL {
+		return prev.stats, nil
+	}
+	sample, err := queryStats(ctx, cluster, now)
+	if err != nil {
+		return serviceStats{}, err
+	}
+	if cached && sample.xacts >= prev.xacts {
+		tps := float64(sample.xacts-prev.xacts) / now.Sub(prev.at).Seconds()
+		sample.stats.TransactionsPerSecond = &tps
+	}
+	statsMu.Lock()
+	statsCache[key] = sample
+	statsMu.Unlock()
+	return sample.stats, nil
+}
+
+// forgetStats drops the cached stats of a deleted cluster.
+func forgetStats(userID, name string) {
+	statsMu.Lock()
+	delete(statsCache, userID+"/"+name)
+	statsMu.Unlock()
+}
+
+func queryStats(ctx context.Context, cluster clusterInfo, now time.Time) (statsSample, error) {
+	query := "SELECT (SELECT count(*) FROM pg_stat_activity), pg_database_size(current_database()), " +
+		"(SELECT sum(xact_commit + xact_rollback) FROM pg_stat_database), " +
+		"extract(epoch FROM now() - pg_postmaster_start_time())::bigint"
+	output, err := runner.Run(ctx, "docker", "exec", cluster.ClusterID, "psql", "-U", cluster.Username, "-tAc", query)
+	if err != nil {
+		return statsSample{}, err
+	}
+	fields := strings.Split(strings.TrimSpace(string(output)), "|")
+	if len(fields) != 4 {
+		return statsSample{}, fmt.Errorf("unexpected stats output %q", output)
+	}
+	var values [4]int64
+	for i, f := range fields {
+		if values[i], err = strconv.ParseInt(f, 10, 64); err != nil {
+			return statsSample{}, fmt.Errorf("parsing stats output %q %v", output, err)
+		}
+	}
+	return statsSample{
+		stats: serviceStats{
+			Name:              cluster.Name,
+			ActiveConnections: int(values[0]),
+			DatabaseSize:      values[1],
+			UptimeSeconds:     values[3],
+			CollectedAt:       now.Unix(),
+		},
+		xacts:       values[2],
+		at:          now,
+		containerID: cluster.ClusterID,
+	}, nil
+}
@@ -0,0 +1,539 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store keeps the metadata of every cluster on this host.
+type Store interface {
+	InsertCluster(c clusterInfo) error
+	// GetCluster returns sql.ErrNoRows if the user doesn't have a cluster with that name.
+	GetCluster(userID, name string) (clusterInfo, error)
+	ListClusters(userID string) ([]clusterInfo, error)
+	DeleteCluster(userID, name string) error
+	SetDNSStatus(userID, name, status string) error
+	SetDNSReady(userID, name string, ready bool) error
+	// ExpiredClusters returns the clusters whose duration has run out by now, leaving out the
+	// deleted ones.
+	ExpiredClusters(now time.Time) ([]clusterInfo, error)
+	// SetDeletedAt marks a cluster deleted at the unix time deletedAt, or not deleted with 0.
+	SetDeletedAt(userID, name string, deletedAt int64) error
+	// DeletedClusters returns the clusters deleted at or before the time given.
+	DeletedClusters(before time.Time) ([]clusterInfo, error)
+	SetStorage(userID, name, storage string) error
+	// SetLastBackup records the unix time and status of the last scheduled backup of a cluster.
+	SetLastBackup(userID, name string, at int64, status string) error
+	// SetTimeouts records the statement and idle in transaction timeouts of a postgres cluster.
+	SetTimeouts(userID, name, statementTimeout, idleTimeout string) error
+	// EachCluster calls fn for every cluster of every user without loading them all at once,
+	// stopping at the first error of fn.
+	EachCluster(fn func(clusterInfo) error) error
+	// CountClusters returns the number of clusters of every user.
+	CountClusters() (int, error)
+	// Users returns every user which has at least one cluster.
+	Users() ([]string, error)
+	// AllocatedPorts returns the ports of every cluster. A port stays allocated until its
+	// cluster is removed by a delete or the reaper.
+	AllocatedPorts() (map[int]struct{}, error)
+	// InsertAuditEvent appends to the lifecycle history of a cluster.
+	InsertAuditEvent(e auditEvent) error
+	// AuditEvents returns the history of the user's cluster with that name, oldest first. The
+	// history is kept after the cluster is deleted.
+	AuditEvents(userID, name string) ([]auditEvent, error)
+	InsertJob(j job) error
+	// UpdateJob records the state, result and error of a job.
+	UpdateJob(j job) error
+	// GetJob returns sql.ErrNoRows if the user doesn't have a job with that id.
+	GetJob(userID, id string) (job, error)
+	// ListJobs returns the jobs of the user, newest first.
+	ListJobs(userID string) ([]job, error)
+	// DeleteJobs removes the finished jobs last updated before the unix time given.
+	DeleteJobs(before int64) error
+	// FailRunningJobs marks the jobs which are still queued or running failed with msg, after
+	// their work was lost to a restart.
+	FailRunningJobs(at int64, msg string) error
+	Close() error
+}
+
+var store Store
+
+// clusterInfoColumns are added to clusterInfo after it was first created. Existing
+// databases get them through migrateClusterInfo.
+var clusterInfoColumns = []string{
+	"expiresAt integer not null default 0",
+	"username text not null default 'postgres'",
+	"dnsStatus text not null default ''",
+	"poolerPort integer not null default 0",
+	"subdomain text not null default ''",
+	"type text not null default 'postgres'",
+	"maxConnections integer not null default 0",
+	"tags text not null default ''",
+	"createdAt integer not null default 0",
+	"existingVolume text not null default ''",
+	"composeProject text not null default ''",
+	"image text not null default ''",
+	"deletedAt integer not null default 0",
+	"storage text not null default ''",
+	"memory text not null default ''",
+	"tlsDir text not null default ''",
+	"dnsReady integer not null default 0",
+	"domain text not null default ''",
+	"clonedFrom text not null default ''",
+	"encoding text not null default ''",
+	"locale text not null default ''",
+	"backupSchedule text not null default ''",
+	"lastBackupAt integer not null default 0",
+	"lastBackupStatus text not null default ''",
+	"statementTimeout text not null default ''",
+	"idleInTransactionTimeout text not null default ''",
+	"network text not null default ''",
+	"metricsPort integer not null default 0",
+}
+
+// clusterSelect lists the columns scanned by scanCluster, in order.
+const clusterSelect = "select userId, clusterId, name, port, expiresAt, username, dnsStatus, poolerPort, subdomain, type, maxConnections, tags, createdAt, existingVolume, composeProject, image, deletedAt, storage, memory, tlsDir, dnsReady, domain, clonedFrom, encoding, locale, backupSchedule, lastBackupAt, lastBackupStatus, statementTimeout, idleInTransactionTimeout, network, metricsPort from clusterInfo"
+
+func migrateClusterInfo(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists clusterInfo (id integer not null primary key autoincrement, userId text not null, clusterId text, Name text, Port integer);`)
+	if err != nil {
+		return err
+	}
+	for _, column := range clusterInfoColumns {
+		_, err = db.Exec("alter table clusterInfo add column " + column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	_, err = db.Exec("create unique index if not exists clusterInfo_user_name on clusterInfo (userId, name)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create table if not exists audit_log (id integer not null primary key autoincrement, cluster_id text not null, user_id text not null, name text not null, event text not null, actor text not null, timestamp integer not null, detail text not null default '');`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("create index if not exists audit_log_user_name on audit_log (user_id, name)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create table if not exists jobs (id text not null primary key, user_id text not null, kind text not null, name text not null, state text not null, created_at integer not null, updated_at integer not null, result text not null default '', error text not null default '', status integer not null default 0);`)
+	return err
+}
+
+// jobSelect lists the columns scanned by scanJob, in order.
+const jobSelect = "select id, user_id, kind, name, state, created_at, updated_at, result, error, status from jobs"
+
+func scanJob(row scanner) (job, error) {
+	var j job
+	var result string
+	err := row.Scan(&j.ID, &j.UserID, &j.Kind, &j.Name, &j.State, &j.CreatedAt, &j.UpdatedAt, &result, &j.Error, &j.Status)
+	if result != "" {
+		j.Result = json.RawMessage(result)
+	}
+	return j, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCluster(row scanner) (clusterInfo, error) {
+	var c clusterInfo
+	var tags string
+	err := row.Scan(&c.UserID, &c.ClusterID, &c.Name, &c.Port, &c.ExpiresAt, &c.Username, &c.DNSStatus, &c.PoolerPort, &c.Subdomain, &c.Type, &c.MaxConnections, &tags, &c.CreatedAt, &c.ExistingVolume, &c.ComposeProject, &c.Image, &c.DeletedAt, &c.Storage, &c.Memory, &c.TLSDir, &c.DNSReady, &c.Domain, &c.ClonedFrom, &c.Encoding, &c.Locale, &c.BackupSchedule, &c.LastBackupAt, &c.LastBackupStatus, &c.StatementTimeout, &c.IdleInTransactionSessionTimeout, &c.Network, &c.MetricsPort)
+	c.ClusterID = strings.TrimSpace(c.ClusterID)
+	c.Tags = []string{}
+	if tags != "" {
+		c.Tags = strings.Split(tags, ",")
+	}
+	return c, err
+}
+
+// sqliteStore holds a single connection pool for the lifetime of the process. The schema is
+// created once when it is opened, and the statements on the create and list paths are prepared
+// once and reused.
+type sqliteStore struct {
+	db         *sql.DB
+	insertStmt *sql.Stmt
+	getStmt    *sql.Stmt
+	listStmt   *sql.Stmt
+	deleteStmt *sql.Stmt
+}
+
+func newSqliteStore(path string) (*sqliteStore, error) {
+	// sqlite only supports a single writer, let the driver wait for it instead of failing with SQLITE_BUSY
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if err = migrateClusterInfo(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqliteStore{db: db}
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.insertStmt, "insert into clusterInfo(userId, clusterId, name, port, expiresAt, username, dnsStatus, poolerPort, subdomain, type, maxConnections, tags, createdAt, existingVolume, composeProject, image, deletedAt, storage, memory, tlsDir, dnsReady, domain, clonedFrom, encoding, locale, backupSchedule, lastBackupAt, lastBackupStatus, statementTimeout, idleInTransactionTimeout, network, metricsPort) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"},
+		{&s.getStmt, clusterSelect + " where userId = ? and name = ?"},
+		{&s.listStmt, clusterSelect + " where userId = ? order by id"},
+		{&s.deleteStmt, "delete from clusterInfo where userId = ? and name = ?"},
+	}
+	for _, st := range stmts {
+		if *st.stmt, err = db.Prepare(st.query); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) InsertCluster(c clusterInfo) error {
+	_, err := s.insertStmt.Exec(c.UserID, c.ClusterID, c.Name, c.Port, c.ExpiresAt, c.Username, c.DNSStatus, c.PoolerPort, c.Subdomain, c.Type, c.MaxConnections, strings.Join(c.Tags, ","), c.CreatedAt, c.ExistingVolume, c.ComposeProject, c.Image, c.DeletedAt, c.Storage, c.Memory, c.TLSDir, c.DNSReady, c.Domain, c.ClonedFrom, c.Encoding, c.Locale, c.BackupSchedule, c.LastBackupAt, c.LastBackupStatus, c.StatementTimeout, c.IdleInTransactionSessionTimeout, c.Network, c.MetricsPort)
+	return err
+}
+
+func (s *sqliteStore) GetCluster(userID, name string) (clusterInfo, error) {
+	return scanCluster(s.getStmt.QueryRow(userID, name))
+}
+
+func (s *sqliteStore) ListClusters(userID string) ([]clusterInfo, error) {
+	rows, err := s.listStmt.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanClusters(rows)
+}
+
+func (s *sqliteStore) DeleteCluster(userID, name string) error {
+	_, err := s.deleteStmt.Exec(userID, name)
+	return err
+}
+
+func (s *sqliteStore) SetDNSStatus(userID, name, status string) error {
+	_, err := s.db.Exec("update clusterInfo set dnsStatus = ? where userId = ? and name = ?", status, userID, name)
+	return err
+}
+
+func (s *sqliteStore) SetDNSReady(userID, name string, ready bool) error {
+	_, err := s.db.Exec("update clusterInfo set dnsReady = ? where userId = ? and name = ?", ready, userID, name)
+	return err
+}
+
+func (s *sqliteStore) ExpiredClusters(now time.Time) ([]clusterInfo, error) {
+	rows, err := s.db.Query(clusterSelect+" where expiresAt > 0 and expiresAt <= ? and deletedAt = 0", now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return scanClusters(rows)
+}
+
+func (s *sqliteStore) SetDeletedAt(userID, name string, deletedAt int64) error {
+	_, err := s.db.Exec("update clusterInfo set deletedAt = ? where userId = ? and name = ?", deletedAt, userID, name)
+	return err
+}
+
+func (s *sqliteStore) SetStorage(userID, name, storage string) error {
+	_, err := s.db.Exec("update clusterInfo set storage = ? where userId = ? and name = ?", storage, userID, name)
+	return err
+}
+
+func (s *sqliteStore) SetLastBackup(userID, name string, at int64, status string) error {
+	_, err := s.db.Exec("update clusterInfo set lastBackupAt = ?, lastBackupStatus = ? where userId = ? and name = ?", at, status, userID, name)
+	return err
+}
+
+func (s *sqliteStore) SetTimeouts(userID, name, statementTimeout, idleTimeout string) error {
+	_, err := s.db.Exec("update clusterInfo set statementTimeout = ?, idleInTransactionTimeout = ? where userId = ? and name = ?", statementTimeout, idleTimeout, userID, name)
+	return err
+}
+
+func (s *sqliteStore) DeletedClusters(before time.Time) ([]clusterInfo, error) {
+	rows, err := s.db.Query(clusterSelect+" where deletedAt > 0 and deletedAt <= ?", before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return scanClusters(rows)
+}
+
+func (s *sqliteStore) EachCluster(fn func(clusterInfo) error) error {
+	rows, err := s.db.Query(clusterSelect + " order by id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c, err := scanCluster(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(c); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) CountClusters() (int, error) {
+	var n int
+	err := s.db.QueryRow("select count(*) from clusterInfo").Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) Users() ([]string, error) {
+	rows, err := s.db.Query("select distinct userId from clusterInfo order by userId")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []string
+	for rows.Next() {
+		var u string
+		if err = rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqliteStore) AllocatedPorts() (map[int]struct{}, error) {
+	rows, err := s.db.Query("select port, poolerPort, metricsPort from clusterInfo")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ports := map[int]struct{}{}
+	for rows.Next() {
+		var port, poolerPort, metricsPort int
+		if err = rows.Scan(&port, &poolerPort, &metricsPort); err != nil {
+			return nil, err
+		}
+		ports[port] = struct{}{}
+		if poolerPort != 0 {
+			ports[poolerPort] = struct{}{}
+		}
+		if metricsPort != 0 {
+			ports[metricsPort] = struct{}{}
+		}
+	}
+	return ports, rows.Err()
+}
+
+func (s *sqliteStore) InsertAuditEvent(e auditEvent) error {
+	_, err := s.db.Exec("insert into audit_log(cluster_id, user_id, name, event, actor, timestamp, detail) values(?, ?, ?, ?, ?, ?, ?)",
+		e.ClusterID, e.UserID, e.Name, e.Event, e.Actor, e.Timestamp, e.Detail)
+	return err
+}
+
+func (s *sqliteStore) AuditEvents(userID, name string) ([]auditEvent, error) {
+	rows, err := s.db.Query("select cluster_id, user_id, name, event, actor, timestamp, detail from audit_log where user_id = ? and name = ? order by id", userID, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []auditEvent{}
+	for rows.Next() {
+		var e auditEvent
+		if err = rows.Scan(&e.ClusterID, &e.UserID, &e.Name, &e.Event, &e.Actor, &e.Timestamp, &e.Detail); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqliteStore) InsertJob(j job) error {
+	_, err := s.db.Exec("insert into jobs(id, user_id, kind, name, state, created_at, updated_at, result, error, status) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		j.ID, j.UserID, j.Kind, j.Name, j.State, j.CreatedAt, j.UpdatedAt, string(j.Result), j.Error, j.Status)
+	return err
+}
+
+func (s *sqliteStore) UpdateJob(j job) error {
+	_, err := s.db.Exec("update jobs set state = ?, updated_at = ?, result = ?, error = ?, status = ? where user_id = ? and id = ?",
+		j.State, j.UpdatedAt, string(j.Result), j.Error, j.Status, j.UserID, j.ID)
+	return err
+}
+
+func (s *sqliteStore) GetJob(userID, id string) (job, error) {
+	return scanJob(s.db.QueryRow(jobSelect+" where user_id = ? and id = ?", userID, id))
+}
+
+func (s *sqliteStore) ListJobs(userID string) ([]job, error) {
+	rows, err := s.db.Query(jobSelect+" where user_id = ? order by created_at desc, rowid desc", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *sqliteStore) DeleteJobs(before int64) error {
+	_, err := s.db.Exec("delete from jobs where state in (?, ?, ?) and updated_at < ?", jobSucceeded, jobFailed, jobCancelled, before)
+	return err
+}
+
+func (s *sqliteStore) FailRunningJobs(at int64, msg string) error {
+	_, err := s.db.Exec("update jobs set state = ?, updated_at = ?, error = ?, status = ? where state in (?, ?)", jobFailed, at, msg, http.StatusInternalServerError, jobQueued, jobRunning)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func scanClusters(rows *sql.Rows) ([]clusterInfo, error) {
+	defer rows.Close()
+	var clusters []clusterInfo
+	for rows.Next() {
+		c, err := scanCluster(rows)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, rows.Err()
+}
+
+// importedLegacySuffix is appended to a per user database once its clusters are imported, so
+// they aren't imported again after the user deleted them.
+const importedLegacySuffix = ".imported"
+
+// importLegacyClusters copies the clusters from the per user databases at
+// <projectDir>/<userID>/<userID>.db, which were used before the central store, and moves each
+// database aside once it is imported. A database is left from an import before they were
+// moved aside when the store knows its user, or for the clusters whose directory is gone.
+func importLegacyClusters(s Store) error {
+	entries, err := os.ReadDir(projectDir)
+	if err != nil {
+		return err
+	}
+	known, err := s.Users()
+	if err != nil {
+		return err
+	}
+	imported := map[string]bool{}
+	for _, u := range known {
+		imported[u] = true
+	}
+	for _, e := range entries {
+		userID := e.Name()
+		legacyPath := filepath.Join(projectDir, userID, userID+".db")
+		if !e.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(legacyPath); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if !imported[userID] {
+			clusters, err := readLegacyClusters(legacyPath, userID)
+			if err != nil {
+				return err
+			}
+			n := 0
+			for _, c := range clusters {
+				if _, err := os.Stat(filepath.Join(servicePath(userID, c.Type, c.Name), "docker-compose.yml")); errors.Is(err, fs.ErrNotExist) {
+					log.Printf("WARN: skipping legacy cluster %s of %s, its directory is gone", c.Name, userID)
+					continue
+				}
+				err = s.InsertCluster(c)
+				if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+					log.Printf("WARN: skipping duplicate legacy cluster %s of %s", c.Name, userID)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				n++
+			}
+			log.Printf("INFO: imported %d clusters of %s from %s", n, userID, legacyPath)
+		}
+		if err = os.Rename(legacyPath, legacyPath+importedLegacySuffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readLegacyClusters(path, userID string) ([]clusterInfo, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("select * from clusterInfo")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	// the legacy schema grew columns over time, so pick up whatever is there
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var clusters []clusterInfo
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		for i := range values {
+			values[i] = new(interface{})
+		}
+		if err = rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		c := clusterInfo{UserID: userID, Username: defaultUsername, Type: "postgres"}
+		for i, col := range columns {
+			v := *(values[i].(*interface{}))
+			switch strings.ToLower(col) {
+			case "clusterid":
+				c.ClusterID = strings.TrimSpace(asString(v))
+			case "name":
+				c.Name = asString(v)
+			case "port":
+				c.Port = int(asInt(v))
+			case "expiresat":
+				c.ExpiresAt = asInt(v)
+			case "username":
+				c.Username = asString(v)
+			case "dnsstatus":
+				c.DNSStatus = asString(v)
+			}
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, rows.Err()
+}
+
+func asString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func asInt(v interface{}) int64 {
+	if i, ok := v.(int64); ok {
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newTestStore opens a store in a directory of its own.
+func newTestStore(tb testing.TB) *sqliteStore {
+	tb.Helper()
+	s, err := newSqliteStore(filepath.Join(tb.TempDir(), "spinup.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+// writeLegacyDB writes the per user database of userID as used before the central store, with
+// a cluster of every name, and the compose files of the clusters which still exist.
+func writeLegacyDB(t *testing.T, userID string, names []string, existing map[string]bool) string {
+	t.Helper()
+	dir := filepath.Join(projectDir, userID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, userID+".db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("create table clusterInfo (id integer not null primary key autoincrement, clusterId text, Name text, Port integer)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		if _, err = db.Exec("insert into clusterInfo(clusterId, name, port) values(?, ?, ?)", fmt.Sprintf("c%d", i), name, 6000+i); err != nil {
+			t.Fatal(err)
+		}
+		if !existing[name] {
+			continue
+		}
+		path := servicePath(userID, "postgres", name)
+		if err = os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(path, "docker-compose.yml"), []byte("services: {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestImportLegacyClustersOnce(t *testing.T) {
+	s := newTestStore(t)
+	legacy := writeLegacyDB(t, "legacy-user", []string{"one", "two", "gone"}, map[string]bool{"one": true, "two": true})
+	if err := importLegacyClusters(s); err != nil {
+		t.Fatal(err)
+	}
+	clusters, err := s.ListClusters("legacy-user")
+	if err != nil || len(clusters) != 2 {
+		t.Fatalf("want the 2 clusters with a directory imported, got %d %v", len(clusters), err)
+	}
+	if _, err = os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("want %s moved aside after the import, stat says %v", legacy, err)
+	}
+	if _, err = os.Stat(legacy + importedLegacySuffix); err != nil {
+		t.Errorf("want the imported database kept at %s%s: %v", legacy, importedLegacySuffix, err)
+	}
+
+	// the user deletes every cluster, which mustn't come back on the next start
+	for _, c := range clusters {
+		if err = s.DeleteCluster("legacy-user", c.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = importLegacyClusters(s); err != nil {
+		t.Fatal(err)
+	}
+	if clusters, _ = s.ListClusters("legacy-user"); len(clusters) != 0 {
+		t.Errorf("want the deleted clusters to stay deleted, imported %d again", len(clusters))
+	}
+}
+
+func TestImportLegacyClustersOfKnownUser(t *testing.T) {
+	s := newTestStore(t)
+	legacy := writeLegacyDB(t, "known-user", []string{"old"}, map[string]bool{"old": true})
+	if err := s.InsertCluster(clusterInfo{UserID: "known-user", ClusterID: "n", Name: "new", Type: "postgres"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := importLegacyClusters(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetCluster("known-user", "old"); err != sql.ErrNoRows {
+		t.Errorf("want the database of a user the store knows left alone, got %v", err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("want %s moved aside, stat says %v", legacy, err)
+	}
+}
+
+func TestDeleteJobsPrunesFinishedJobs(t *testing.T) {
+	s := newTestStore(t)
+	old, recent := int64(1000), int64(5000)
+	for _, j := range []job{
+		{ID: "old-succeeded", State: jobSucceeded, UpdatedAt: old},
+		{ID: "old-failed", State: jobFailed, UpdatedAt: old},
+		{ID: "old-cancelled", State: jobCancelled, UpdatedAt: old},
+		{ID: "old-running", State: jobRunning, UpdatedAt: old},
+		{ID: "recent-cancelled", State: jobCancelled, UpdatedAt: recent},
+	} {
+		j.UserID, j.Kind, j.Name, j.CreatedAt = "alice", "create", "db", j.UpdatedAt
+		if err := s.InsertJob(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteJobs(recent); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := s.ListJobs("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, j := range jobs {
+		left = append(left, j.ID)
+	}
+	sort.Strings(left)
+	if strings.Join(left, " ") != "old-running recent-cancelled" {
+		t.Errorf("want the unfinished and the recent job kept, kept %v", left)
+	}
+}
+
+// BenchmarkInsertCluster inserts with the prepared statement of the long-lived store.
+func BenchmarkInsertCluster(b *testing.B) {
+	s := newTestStore(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.InsertCluster(clusterInfo{UserID: "bench", ClusterID: "c", Name: fmt.Sprintf("db%d", i), Type: "postgres"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkInsertClusterPerCallDB inserts like the per user databases did before the store:
+// every insert opens the database, migrates the table and prepares the statement in a
+// transaction of its own.
+func BenchmarkInsertClusterPerCallDB(b *testing.B) {
+	dir := b.TempDir()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := sql.Open("sqlite3", filepath.Join(dir, "bench.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = db.Exec("create table if not exists clusterInfo (id integer not null primary key autoincrement, clusterId text, Name text, Port integer)"); err != nil {
+			b.Fatal(err)
+		}
+		for _, column := range []string{"expiresAt integer not null default 0", "username text not null default 'postgres'", "dnsStatus text not null default ''"} {
+			if _, err = db.Exec("alter table clusterInfo add column " + column); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+				b.Fatal(err)
+			}
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		stmt, err := tx.Prepare("insert into clusterInfo(clusterId, name, port, expiresAt, username, dnsStatus) values(?, ?, ?, ?, ?, ?)")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = stmt.Exec("c", fmt.Sprintf("db%d", i), 5432, 0, "postgres", ""); err != nil {
+			b.Fatal(err)
+		}
+		stmt.Close()
+		if err = tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+		db.Close()
+	}
+}
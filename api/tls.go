@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tlsCA signs the certificates of clusters created with TLS, from SPINUP_TLS_CA_CERT and
+// SPINUP_TLS_CA_KEY. Without it every cluster gets a self-signed certificate.
+var tlsCA *tls.Certificate
+
+// certValidity is how long the certificate of a cluster is valid, the longest clients accept.
+const certValidity = 825 * 24 * time.Hour
+
+// loadTLSCA reads the CA certificate and key the certificates of clusters are signed with.
+func loadTLSCA(certFile, keyFile string) (*tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if !ca.Leaf.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	if _, ok := ca.PrivateKey.(crypto.Signer); !ok {
+		return nil, errors.New("the CA key can't sign certificates")
+	}
+	return &ca, nil
+}
+
+// tlsDir is where the certificate and key of the cluster at path are kept.
+func tlsDir(path string) string {
+	return filepath.Join(path, "tls")
+}
+
+// tlsDirOf is the TLS directory recorded for the cluster of s at path, empty without TLS.
+func tlsDirOf(s service, path string) string {
+	if !s.Db.TLS {
+		return ""
+	}
+	return tlsDir(path)
+}
+
+// tlsHosts are the names clients may connect to the cluster of s with.
+func tlsHosts(s service) []string {
+	hosts := []string{hostName()}
+	if dnsEnabled {
+		hosts = append(hosts, recordName(s))
+	}
+	if hostName() != "localhost" {
+		hosts = append(hosts, "localhost")
+	}
+	return hosts
+}
+
+// writeServerCert writes a new key and certificate for hosts into dir as server.key and
+// server.crt, along with ca.crt which clients verify the certificate with.
+func writeServerCert(dir string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := crand.Int(crand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	parent, signer := tmpl, crypto.Signer(key)
+	if tlsCA != nil {
+		parent, signer = tlsCA.Leaf, tlsCA.PrivateKey.(crypto.Signer)
+	} else {
+		// a self-signed certificate is its own CA
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	caDER := der
+	if tlsCA != nil {
+		caDER = tlsCA.Leaf.Raw
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files := []struct {
+		name      string
+		blockType string
+		der       []byte
+		perm      os.FileMode
+	}{
+		{"server.key", "EC PRIVATE KEY", keyDER, 0600},
+		{"server.crt", "CERTIFICATE", der, 0644},
+		{"ca.crt", "CERTIFICATE", caDER, 0644},
+	}
+	for _, f := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, f.name), pem.EncodeToMemory(&pem.Block{Type: f.blockType, Bytes: f.der}), f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// updateRequest changes the settings of a cluster which can change while it runs. A field
+// left out keeps its value, an empty one goes back to the server default.
+type updateRequest struct {
+	StatementTimeout                *string
+	IdleInTransactionSessionTimeout *string
+	// only accepted to reject them with a useful error, they apply at create only
+	Encoding string
+	Locale   string
+}
+
+type updateResponse struct {
+	Name string
+	pgTimeouts
+	// whether the server reloaded its config, otherwise the settings apply when it next starts
+	Reloaded bool
+}
+
+// UpdateService changes the settings of a running postgres cluster. They are written to the
+// config of the cluster, which the server reloads without a restart.
+func UpdateService(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "POST") {
+		return
+	}
+	userId, err := validateToken(req.Header.Get("Authorization"))
+	if err != nil {
+		logger(req.Context()).Printf("error validating token %v", err)
+		http.Error(w, "error validating token", http.StatusUnauthorized)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	var ur updateRequest
+	if err = decodeJSONBody(w, req, &ur); err != nil {
+		var mr *malformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.msg, mr.status)
+			return
+		}
+		logger(req.Context()).Printf("ERROR: decoding update body %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if ur.Encoding != "" || ur.Locale != "" {
+		http.Error(w, "Encoding and Locale are only applied when a cluster is created, they can't be changed", http.StatusBadRequest)
+		return
+	}
+	cluster, err := store.GetCluster(userId, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cluster not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: reading cluster info for %s %v", userId, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if cluster.DeletedAt != 0 {
+		http.Error(w, "cluster is deleted", http.StatusConflict)
+		return
+	}
+	timeouts := pgTimeouts{cluster.StatementTimeout, cluster.IdleInTransactionSessionTimeout}
+	if ur.StatementTimeout != nil {
+		timeouts.StatementTimeout = *ur.StatementTimeout
+	}
+	if ur.IdleInTransactionSessionTimeout != nil {
+		timeouts.IdleInTransactionSessionTimeout = *ur.IdleInTransactionSessionTimeout
+	}
+	if cluster.Type != "postgres" {
+		http.Error(w, fmt.Sprintf("%s clusters have no settings to update", cluster.Type), http.StatusBadRequest)
+		return
+	}
+	if err = validatePGTimeouts(cluster.Type, timeouts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := servicePath(userId, cluster.Type, name)
+	if _, err = os.Stat(filepath.Join(path, pgConfigFile)); err != nil {
+		http.Error(w, "cluster was created without a config spinup can change, recreate it to update its settings", http.StatusConflict)
+		return
+	}
+	if err = createConfigfile(path, timeouts); err != nil {
+		logger(req.Context()).Printf("ERROR: writing config of %s %v", name, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	if err = store.SetTimeouts(userId, name, timeouts.StatementTimeout, timeouts.IdleInTransactionSessionTimeout); err != nil {
+		logger(req.Context()).Printf("ERROR: recording settings of %s %v", name, err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	res := updateResponse{Name: name, pgTimeouts: timeouts, Reloaded: true}
+	if err = reloadConfig(req.Context(), cluster); err != nil {
+		// a stopped cluster reads the config when it starts
+		logger(req.Context()).Printf("WARN: reloading config of %s %v", cluster.ClusterID, err)
+		res.Reloaded = false
+	}
+	audit(userId, userId, name, cluster.ClusterID, auditUpdate, fmt.Sprintf("statement_timeout %s, idle_in_transaction_session_timeout %s", orDefault(timeouts.StatementTimeout), orDefault(timeouts.IdleInTransactionSessionTimeout)))
+	logger(req.Context()).Printf("INFO: updated settings of %s for user %s", name, userId)
+	writeJSON(w, req, res)
+}
+
+// reloadConfig makes the postgres server of cluster read its config again.
+func reloadConfig(ctx context.Context, cluster clusterInfo) error {
+	output, err := runner.Run(ctx, "docker", "exec", cluster.ClusterID, "psql", "-U", cluster.Username, "-tAc", "SELECT pg_reload_conf()")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(output)) != "t" {
+		return fmt.Errorf("pg_reload_conf returned %q", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func orDefault(v string) string {
+	if v == "" {
+		return "default"
+	}
+	return v
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSignatureBytes is the largest signature part of an upload, far more than any supported
+// key needs.
+const maxSignatureBytes = 4096
+
+// uploadDir holds uploads while they are used. It can't clash with the directory of a user,
+// tmp is a reserved name.
+func uploadDir() string {
+	return filepath.Join(dataDir, "tmp")
+}
+
+// upload is a file received by receiveUpload. Its file must be removed once it is used.
+type upload struct {
+	// path of the temporary file holding the upload
+	path string
+	size int64
+	// base64 detached signature sent with the file, if any
+	signature string
+}
+
+// receiveUpload streams the file part field of the multipart body of req to a temporary file
+// in uploadDir, without holding it in memory. The body is limited to maxUploadBytes while it is
+// read. A signature part is taken as the detached signature of the file, any other part is
+// rejected. Errors meant for the client are *malformedRequest, the temporary file is removed
+// on any error.
+func receiveUpload(w http.ResponseWriter, req *http.Request, field string) (upload, error) {
+	var u upload
+	req.Body = http.MaxBytesReader(w, req.Body, maxUploadBytes)
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return u, &malformedRequest{status: http.StatusBadRequest, msg: "Request body must be multipart/form-data"}
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			switch part.FormName() {
+			case field:
+				if u.path != "" {
+					err = &malformedRequest{status: http.StatusBadRequest, msg: fmt.Sprintf("%s must only be sent once", field)}
+				} else {
+					u.path, u.size, err = saveUpload(part)
+				}
+			case "signature":
+				var sig []byte
+				if sig, err = ioutil.ReadAll(io.LimitReader(part, maxSignatureBytes)); err == nil {
+					u.signature = strings.TrimSpace(string(sig))
+				}
+			default:
+				err = &malformedRequest{status: http.StatusBadRequest, msg: fmt.Sprintf("unknown part %q, only %s and signature are accepted", part.FormName(), field)}
+			}
+			part.Close()
+		}
+		if err != nil {
+			if u.path != "" {
+				os.Remove(u.path)
+			}
+			var malformed *malformedRequest
+			switch {
+			case errors.As(err, &malformed):
+				return upload{}, err
+			case err.Error() == "http: request body too large":
+				return upload{}, &malformedRequest{status: http.StatusRequestEntityTooLarge, msg: fmt.Sprintf("Upload must not be larger than %d bytes", maxUploadBytes)}
+			case errors.Is(err, io.ErrUnexpectedEOF) || strings.HasPrefix(err.Error(), "multipart:"):
+				return upload{}, &malformedRequest{status: http.StatusBadRequest, msg: "Request body is not valid multipart/form-data"}
+			}
+			return upload{}, err
+		}
+	}
+	if u.path == "" {
+		return u, &malformedRequest{status: http.StatusBadRequest, msg: fmt.Sprintf("%s is required", field)}
+	}
+	return u, nil
+}
+
+// saveUpload copies part to a new temporary file in uploadDir, removing it again when the copy
+// fails.
+func saveUpload(part *multipart.Part) (string, int64, error) {
+	if err := os.MkdirAll(uploadDir(), 0700); err != nil {
+		return "", 0, err
+	}
+	f, err := ioutil.TempFile(uploadDir(), "upload-*.partial")
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := io.Copy(f, part)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	return f.Name(), n, nil
+}
+
+// verifyUploadFile is verifyUpload for an upload on disk. RSA and ECDSA signatures are
+// verified against the SHA-256 of the file as it is read, but Ed25519 signs the data itself,
+// so an upload is read into memory to verify its Ed25519 signature.
+func verifyUploadFile(field string, u upload) error {
+	if !requireSignedUploads {
+		return nil
+	}
+	if u.signature == "" {
+		return fmt.Errorf("%s must be signed, send a signature", field)
+	}
+	raw, err := base64.StdEncoding.DecodeString(u.signature)
+	if err != nil {
+		return fmt.Errorf("signature is not base64")
+	}
+	ok := false
+	if key, isEd25519 := uploadKey.(ed25519.PublicKey); isEd25519 {
+		data, err := ioutil.ReadFile(u.path)
+		if err != nil {
+			return err
+		}
+		ok = ed25519.Verify(key, data, raw)
+	} else {
+		digest, err := fileDigest(u.path)
+		if err != nil {
+			return err
+		}
+		switch key := uploadKey.(type) {
+		case *rsa.PublicKey:
+			ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, raw) == nil
+		case *ecdsa.PublicKey:
+			ok = ecdsa.VerifyASN1(key, digest, raw)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%s: %v", field, errBadSignature)
+	}
+	return nil
+}
+
+// fileDigest returns the SHA-256 of the file at path.
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// removeStaleUploads removes the uploads left behind by a restart, which nothing uses anymore.
+func removeStaleUploads() {
+	partials, _ := filepath.Glob(filepath.Join(uploadDir(), "upload-*.partial"))
+	for _, p := range partials {
+		if err := os.Remove(p); err != nil {
+			log.Printf("WARN: removing stale upload %s %v", p, err)
+		}
+	}
+}
@@ -23,20 +23,19 @@ type githubAccess struct {
 }
 
 func GithubAuth(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+	if !allowMethod(w, r, "POST") {
 		return
 	}
 	type userAuth struct {
 		Code string `json:"code"`
 	}
-	log.Println("inside githubauth::")
+	logger(r.Context()).Println("inside githubauth::")
 	type githubAuth struct {
 		Code         string `json:"code"`
 		ClientID     string `json:"client_id"`
 		ClientSecret string `json:"client_secret"`
 	}
-	log.Println("req::", r.Body)
+	logger(r.Context()).Println("req::", r.Body)
 	var ua userAuth
 	// TODO: format this to include best practices https://www.alexedwards.net/blog/how-to-properly-parse-a-json-request-body
 	err := json.NewDecoder(r.Body).Decode(&ua)
@@ -44,7 +43,7 @@ func GithubAuth(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Println("ua", ua)
+	logger(r.Context()).Println("ua", ua)
 	clientID, ok := os.LookupEnv("CLIENT_ID")
 	if !ok {
 		log.Fatalf("FATAL: getting environment variable CLIENT_ID")
@@ -53,11 +52,11 @@ func GithubAuth(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		log.Fatalf("FATAL: getting environment variable CLIENT_SECRET")
 	}
-	log.Println("req::", r.Body)
+	logger(r.Context()).Println("req::", r.Body)
 	requestBodyMap := map[string]string{"client_id": clientID, "client_secret": clientSecret, "code": ua.Code}
 	requestBodyJSON, err := json.Marshal(requestBodyMap)
 	if err != nil {
-		log.Printf("ERROR: marshalling github auth %v", requestBodyMap)
+		logger(r.Context()).Printf("ERROR: marshalling github auth %v", requestBodyMap)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
@@ -73,7 +72,7 @@ func GithubAuth(w http.ResponseWriter, r *http.Request) {
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		log.Printf("ERROR: likely user code is invalid")
+		logger(r.Context()).Printf("ERROR: likely user code is invalid")
 		// http.Error(w, "ERROR: likely user code is invalid", http.StatusInternalServerError)
 		// return
 	}
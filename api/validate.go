@@ -0,0 +1,343 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const defaultUsername = "postgres"
+
+// unquoted postgres identifiers, limited to NAMEDATALEN-1 bytes
+var pgIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$]{0,62}$`)
+
+// a single DNS label, lowercase only as spinup creates the records
+var dnsLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+func validateSubdomain(subdomain string) error {
+	if !dnsLabel.MatchString(subdomain) {
+		return fmt.Errorf("subdomain %q must be a DNS label of at most 63 lowercase letters, digits or hyphens, not starting or ending with a hyphen", subdomain)
+	}
+	return nil
+}
+
+// maxNameLength and maxUserIDLength limit the length of Db.Name and UserID, from
+// SPINUP_MAX_NAME_LENGTH and SPINUP_MAX_USERID_LENGTH. With the defaults the record name
+// <userID>-<name> fits in a DNS label, and the longest GitHub login is allowed.
+var maxNameLength, maxUserIDLength = 23, 39
+
+// names of clusters and users are directory names and part of DNS and compose project names
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// reservedNames can't be used as cluster or user names, as they collide with the directories
+// spinup keeps next to clusters, like the per type directories of SPINUP_LAYOUT=type, or are
+// names docker gives a meaning of its own.
+var reservedNames = map[string]bool{
+	"backups": true,
+	"data":    true,
+	"logs":    true,
+	"tls":     true,
+	"tmp":     true,
+	"bridge":  true,
+	"host":    true,
+	"none":    true,
+	"default": true,
+}
+
+// validateName checks the cluster or user name of a create, field names it in the error.
+func validateName(field, name string, max int) error {
+	if name == "" {
+		return fmt.Errorf("%s is required", field)
+	}
+	if len(name) > max {
+		return fmt.Errorf("%s %q is longer than %d characters", field, name, max)
+	}
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("%s %q must start with a letter or digit and contain only letters, digits, _ or -", field, name)
+	}
+	lower := strings.ToLower(name)
+	if _, isType := dbTypes[lower]; isType || reservedNames[lower] {
+		return fmt.Errorf("%s %q is reserved", field, name)
+	}
+	return nil
+}
+
+const maxTags = 10
+
+// tags are stored comma separated, so they can't contain commas
+var tagPattern = regexp.MustCompile(`^[a-z0-9_.-]{1,32}$`)
+
+func validateTags(tags []string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("a cluster can have at most %d tags", maxTags)
+	}
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			return fmt.Errorf("tag %q must be at most 32 lowercase letters, digits, _, . or -", tag)
+		}
+	}
+	return nil
+}
+
+// docker volume names
+var volumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,254}$`)
+
+// validateExistingVolume checks that the volume a cluster attaches exists, if it attaches one.
+func validateExistingVolume(ctx context.Context, volume string) error {
+	if volume == "" {
+		return nil
+	}
+	if !volumeName.MatchString(volume) {
+		return fmt.Errorf("existingVolume %q is not a valid docker volume name", volume)
+	}
+	if _, err := runner.Run(ctx, "docker", "volume", "inspect", volume); err != nil {
+		logger(ctx).Printf("WARN: inspecting volume %s %v", volume, err)
+		return fmt.Errorf("volume %q doesn't exist", volume)
+	}
+	return nil
+}
+
+// allowedNetworks are the docker networks a cluster can be attached to, from SPINUP_ALLOWED_NETWORKS.
+var allowedNetworks = map[string]bool{}
+
+// errNetworkNotAllowed is returned for a network outside of SPINUP_ALLOWED_NETWORKS.
+var errNetworkNotAllowed = errors.New("network is not allowed")
+
+// validateNetwork checks that the network a cluster attaches to is allowed and exists, if it
+// attaches to one.
+func validateNetwork(ctx context.Context, network string) error {
+	if network == "" {
+		return nil
+	}
+	if !allowedNetworks[network] {
+		return fmt.Errorf("%w: %q isn't in SPINUP_ALLOWED_NETWORKS", errNetworkNotAllowed, network)
+	}
+	if _, err := runner.Run(ctx, "docker", "network", "inspect", network); err != nil {
+		logger(ctx).Printf("WARN: inspecting network %s %v", network, err)
+		return fmt.Errorf("network %q doesn't exist", network)
+	}
+	return nil
+}
+
+// parseRunAsUser parses the UID:GID a cluster runs as, 0 and 0 when it isn't set.
+func parseRunAsUser(user string) (int, int, error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(user, ":")
+	if len(parts) == 2 {
+		uid, uidErr := strconv.ParseUint(parts[0], 10, 31)
+		gid, gidErr := strconv.ParseUint(parts[1], 10, 31)
+		if uidErr == nil && gidErr == nil {
+			return int(uid), int(gid), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("runAsUser %q must be a numeric UID:GID, e.g. 1000:1000", user)
+}
+
+// cpuShares is the cpu_shares weight of a reservation of cpus, docker's default weight of 1024
+// being one CPU.
+func cpuShares(cpus float64) int64 {
+	// docker's minimum weight
+	if shares := int64(cpus * 1024); shares > 2 {
+		return shares
+	}
+	return 2
+}
+
+// validateCPUs validates the CPU reservation and the cores a cluster is pinned to against the
+// cores of the host.
+func validateCPUs(cpus, cpuset string) error {
+	hostCPUs := runtime.NumCPU()
+	if cpus != "" {
+		n, err := strconv.ParseFloat(cpus, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("cpus %q must be a positive number of CPUs, e.g. 1.5. It is a reservation: the share of CPU time the cluster gets when the host is busy, not a limit capping it", cpus)
+		}
+		if n > float64(hostCPUs) {
+			return fmt.Errorf("cpus %q can't reserve more than the %d CPUs of the host. A reservation is a share of CPU time the cluster is guaranteed under contention, unlike a limit it doesn't keep the cluster from using idle CPUs", cpus, hostCPUs)
+		}
+	}
+	if cpuset == "" {
+		return nil
+	}
+	cores, err := parseCPUSet(cpuset, hostCPUs)
+	if err != nil {
+		return err
+	}
+	if cpus != "" {
+		if n, _ := strconv.ParseFloat(cpus, 64); n > float64(len(cores)) {
+			return fmt.Errorf("cpus %q can't reserve more than the %d cores of cpuset %q, pinning limits the cluster to those cores while the reservation only weighs its share of them", cpus, len(cores), cpuset)
+		}
+	}
+	return nil
+}
+
+// parseCPUSet parses a list of cores like docker's --cpuset-cpus, e.g. 0-1,3, into the
+// distinct cores it names, which must be below hostCPUs.
+func parseCPUSet(cpuset string, hostCPUs int) ([]int, error) {
+	invalid := fmt.Errorf("cpuset %q must be a list of cores or ranges of cores, e.g. 0-1,3", cpuset)
+	seen := map[int]bool{}
+	var cores []int
+	for _, part := range strings.Split(cpuset, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, invalid
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, invalid
+			}
+		}
+		if last >= hostCPUs {
+			return nil, fmt.Errorf("cpuset %q names core %d, but the host only has cores 0-%d", cpuset, last, hostCPUs-1)
+		}
+		for c := first; c <= last; c++ {
+			if !seen[c] {
+				seen[c] = true
+				cores = append(cores, c)
+			}
+		}
+	}
+	return cores, nil
+}
+
+func validateUsername(username string) error {
+	if !pgIdentifier.MatchString(username) {
+		return fmt.Errorf("username %q must start with a lowercase letter or underscore, contain only lowercase letters, digits, _ or $ and be at most 63 characters", username)
+	}
+	if strings.HasPrefix(username, "pg_") {
+		return fmt.Errorf("username %q must not start with the reserved prefix pg_", username)
+	}
+	return nil
+}
+
+// postgres keeps 3 connections for superusers by default
+const minMaxConnections = 5
+
+// memoryPerConnection is the memory a cluster needs for each of its max_connections
+const memoryPerConnection = 4 << 20
+
+func validateMaxConnections(db dbCluster) error {
+	if db.MaxConnections == 0 {
+		return nil
+	}
+	if db.Type != "postgres" {
+		return fmt.Errorf("MaxConnections is only supported for postgres")
+	}
+	if db.MaxConnections < minMaxConnections {
+		return fmt.Errorf("MaxConnections must be at least %d", minMaxConnections)
+	}
+	if db.Memory == "" {
+		return nil
+	}
+	memory, err := parseSize("memory", db.Memory)
+	if err != nil {
+		return err
+	}
+	if limit := memory / memoryPerConnection; int64(db.MaxConnections) > limit {
+		return fmt.Errorf("MaxConnections %d is too many for %s of memory, at most %d are allowed", db.MaxConnections, db.Memory, limit)
+	}
+	return nil
+}
+
+// postgresEncodings are the server encodings of postgres, by their name with only its letters and
+// digits in upper case, the way postgres itself compares them.
+var postgresEncodings = map[string]string{}
+
+func init() {
+	for _, e := range []string{
+		"EUC_CN", "EUC_JP", "EUC_JIS_2004", "EUC_KR", "EUC_TW", "ISO_8859_5", "ISO_8859_6", "ISO_8859_7",
+		"ISO_8859_8", "KOI8R", "KOI8U", "LATIN1", "LATIN2", "LATIN3", "LATIN4", "LATIN5", "LATIN6",
+		"LATIN7", "LATIN8", "LATIN9", "LATIN10", "MULE_INTERNAL", "SQL_ASCII", "UTF8", "WIN866",
+		"WIN874", "WIN1250", "WIN1251", "WIN1252", "WIN1253", "WIN1254", "WIN1255", "WIN1256",
+		"WIN1257", "WIN1258",
+	} {
+		postgresEncodings[encodingKey(e)] = e
+	}
+}
+
+var notAlphanumeric = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+func encodingKey(name string) string {
+	return strings.ToUpper(notAlphanumeric.ReplaceAllString(name, ""))
+}
+
+// locales like en_US.UTF-8, de_DE@euro, C or POSIX
+var localePattern = regexp.MustCompile(`^([a-zA-Z]{2,3}(_[A-Z]{2})?|C|POSIX)(\.[a-zA-Z0-9-]+)?(@[a-z]+)?$`)
+
+// validateEncoding checks the Encoding and Locale of a postgres cluster, and returns the name
+// postgres gives the encoding. initdb fails on an encoding its locale can't represent, so a UTF8
+// database needs a UTF-8 locale and the other encodings need a locale other than UTF-8, C or
+// POSIX, which go with every encoding.
+func validateEncoding(db dbCluster) (string, error) {
+	if db.Encoding == "" && db.Locale == "" {
+		return "", nil
+	}
+	if db.Type != "postgres" {
+		return "", fmt.Errorf("Encoding and Locale are only supported for postgres")
+	}
+	if db.Locale != "" && !localePattern.MatchString(db.Locale) {
+		return "", fmt.Errorf("Locale %q must look like en_US.UTF-8, C or POSIX", db.Locale)
+	}
+	if db.Encoding == "" {
+		return "", nil
+	}
+	encoding, ok := postgresEncodings[encodingKey(db.Encoding)]
+	if !ok {
+		return "", fmt.Errorf("Encoding %q is not a postgres server encoding, e.g. UTF8 or LATIN1", db.Encoding)
+	}
+	// the image's default locale is en_US.utf8
+	locale := db.Locale
+	if locale == "" {
+		locale = "en_US.UTF-8"
+	}
+	base := strings.SplitN(locale, "@", 2)[0]
+	if base == "C" || base == "POSIX" || encoding == "SQL_ASCII" {
+		return encoding, nil
+	}
+	utf8Locale := false
+	if i := strings.Index(base, "."); i >= 0 {
+		utf8Locale = encodingKey(base[i+1:]) == "UTF8"
+	}
+	if (encoding == "UTF8") != utf8Locale {
+		return "", fmt.Errorf("Encoding %s doesn't match Locale %s, set a Locale of the same encoding or C", encoding, locale)
+	}
+	return encoding, nil
+}
+
+// parseSize parses sizes like 512MB, 1G or 65536 into bytes. field names the size in the error.
+func parseSize(field, s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}}
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	size := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v, size = strings.TrimSuffix(v, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s %q must be a positive size like 512MB", field, s)
+	}
+	return n * size, nil
+}
+
+// validateSize checks a size like 512MB of a cluster, if it is set.
+func validateSize(field, s string) error {
+	if s == "" {
+		return nil
+	}
+	_, err := parseSize(field, s)
+	return err
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/golang/gddo/httputil/header"
+)
+
+// Version of spinup, set at build time with
+// -ldflags "-X github.com/spinup-host/api.Version=v0.1.0".
+var Version = "dev"
+
+type helloResponse struct {
+	Service string
+	Version string
+	// paths of the endpoints to discover the service with
+	Links map[string]string
+}
+
+// prefersJSON reports whether the Accept header of req ranks application/json above
+// text/plain. Without an Accept header plain text is preferred.
+func prefersJSON(req *http.Request) bool {
+	var jsonQ, textQ float64
+	for _, spec := range header.ParseAccept(req.Header, "Accept") {
+		switch spec.Value {
+		case "application/json":
+			jsonQ = spec.Q
+		case "text/plain":
+			textQ = spec.Q
+		}
+	}
+	return jsonQ > textQ
+}
+
+func writeJSON(w http.ResponseWriter, req *http.Request, v interface{}) {
+	jsonBody, err := json.Marshal(v)
+	if err != nil {
+		logger(req.Context()).Printf("ERROR: marshalling response %v", err)
+		http.Error(w, "Internal server error ", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+type versionResponse struct {
+	Version   string
+	GoVersion string
+}
+
+// GetVersion returns the version of spinup. Like Hello and Health it doesn't need a token.
+func GetVersion(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, "GET") {
+		return
+	}
+	writeJSON(w, req, versionResponse{Version: Version, GoVersion: runtime.Version()})
+}
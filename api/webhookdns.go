@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// webhookProvider hands the records to a service of the operator's, for DNS providers spinup
+// doesn't know. Every call POSTs a webhookRequest to url. A list is answered with a JSON array
+// of DNSRecord, the other actions only need a 2xx status.
+type webhookProvider struct {
+	url string
+	// sent as a bearer token when set, from SPINUP_DNS_WEBHOOK_TOKEN
+	token  string
+	client *http.Client
+}
+
+type webhookRequest struct {
+	// one of list, create, update or delete
+	Action string
+	ZoneID string
+	// with list only its Type and Name are set, with delete only its ID
+	Record DNSRecord
+}
+
+func newWebhookProvider(rawURL, token string) (*webhookProvider, error) {
+	if rawURL == "" {
+		return nil, fmt.Errorf("SPINUP_DNS_PROVIDER=webhook needs SPINUP_DNS_WEBHOOK_URL")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("SPINUP_DNS_WEBHOOK_URL %q is not an http or https URL", rawURL)
+	}
+	return &webhookProvider{url: rawURL, token: token, client: &http.Client{}}, nil
+}
+
+func (p *webhookProvider) ListRecords(ctx context.Context, zoneID, recordType, name string) ([]DNSRecord, error) {
+	var records []DNSRecord
+	err := p.post(ctx, webhookRequest{Action: "list", ZoneID: zoneID, Record: DNSRecord{Type: recordType, Name: name}}, &records)
+	return records, err
+}
+
+func (p *webhookProvider) CreateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	return p.post(ctx, webhookRequest{Action: "create", ZoneID: zoneID, Record: r}, nil)
+}
+
+func (p *webhookProvider) UpdateRecord(ctx context.Context, zoneID string, r DNSRecord) error {
+	return p.post(ctx, webhookRequest{Action: "update", ZoneID: zoneID, Record: r}, nil)
+}
+
+func (p *webhookProvider) DeleteRecord(ctx context.Context, zoneID, id string) error {
+	return p.post(ctx, webhookRequest{Action: "delete", ZoneID: zoneID, Record: DNSRecord{ID: id}}, nil)
+}
+
+func (p *webhookProvider) post(ctx context.Context, wr webhookRequest, dst interface{}) error {
+	body, err := json.Marshal(wr)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("DNS webhook answered %s to %s: %s", res.Status, wr.Action, bytes.TrimSpace(data))
+	}
+	if dst == nil {
+		return nil
+	}
+	if err = json.Unmarshal(data, dst); err != nil {
+		return fmt.Errorf("DNS webhook answered %s with invalid JSON %v", wr.Action, err)
+	}
+	return nil
+}
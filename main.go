@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/pires/go-proxyproto"
 	"github.com/rs/cors"
 	"github.com/spinup-host/api"
 )
@@ -14,19 +24,150 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 	mux := http.NewServeMux()
 	mux.HandleFunc("/hello", api.Hello)
+	mux.HandleFunc("/health", api.Health)
+	mux.HandleFunc("/version", api.GetVersion)
 	mux.HandleFunc("/createservice", api.CreateService)
+	mux.HandleFunc("/getjob", api.GetJob)
+	mux.HandleFunc("/listjobs", api.ListJobs)
+	mux.HandleFunc("/canceljob", api.CancelJob)
+	mux.HandleFunc("/bulkcreateservice", api.BulkCreateService)
+	mux.HandleFunc("/bulkdeleteservice", api.BulkDeleteService)
 	mux.HandleFunc("/githubAuth", api.GithubAuth)
 	mux.HandleFunc("/logs", api.Logs)
-	mux.HandleFunc("/jwt", api.JWT)
 	mux.HandleFunc("/jwtdecode", api.JWTDecode)
 	mux.HandleFunc("/streamlogs", api.StreamLogs)
+	mux.HandleFunc("/downloadlogs", api.DownloadLogs)
 	mux.HandleFunc("/listcluster", api.ListCluster)
+	mux.HandleFunc("/describeservice", api.DescribeService)
+	mux.HandleFunc("/servicestats", api.ServiceStats)
+	mux.HandleFunc("/credentials", api.Credentials)
+	mux.HandleFunc("/cloneservice", api.CloneService)
+	mux.HandleFunc("/pingservice", api.PingService)
+	mux.HandleFunc("/listbackups", api.ListBackups)
+	mux.HandleFunc("/downloadbackup", api.DownloadBackup)
+	mux.HandleFunc("/restoreservice", api.RestoreService)
+	mux.HandleFunc("/dbtypes", api.ListDBTypes)
+	mux.HandleFunc("/deleteservice", api.DeleteService)
+	mux.HandleFunc("/undeleteservice", api.UndeleteService)
+	mux.HandleFunc("/resizevolume", api.ResizeVolume)
+	mux.HandleFunc("/updateservice", api.UpdateService)
+	mux.HandleFunc("/servicehistory", api.GetServiceHistory)
+	mux.HandleFunc("/syncdns", api.SyncDNS)
+	mux.HandleFunc("/presets", api.ListPresets)
+	// the admin endpoints don't check the caller themselves
+	mux.HandleFunc("/admin/users", api.RequireScope("admin", api.AdminListUsers))
+	mux.HandleFunc("/admin/retrydns", api.RequireScope("admin", api.RetryDNS))
+	mux.HandleFunc("/admin/export", api.RequireScope("admin", api.ExportClusters))
+	mux.HandleFunc("/admin/import", api.RequireScope("admin", api.ImportClusters))
+	mux.HandleFunc("/admin/reconcile", api.RequireScope("admin", api.AdminReconcile))
+	api.ReconcileOnStartup()
+	api.StartReaper()
+	api.StartBackupScheduler()
+	api.WatchReload()
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"https://app.spinup.host", "http://localhost:3000"},
-		AllowedHeaders: []string{"authorization", "content-type"},
+		AllowedMethods: []string{"GET", "POST", "DELETE"},
+		AllowedHeaders: []string{"authorization", "content-type", "x-request-id", "if-none-match"},
+		ExposedHeaders: []string{"X-Request-ID", "ETag"},
 	})
-	err := http.ListenAndServe(":4434", c.Handler(mux))
+	addr := ":4434"
+	if v, ok := os.LookupEnv("SPINUP_LISTEN"); ok {
+		addr = v
+	}
+	ln, err := listen(addr)
 	if err != nil {
+		log.Fatalf("FATAL: listening on %s %v", addr, err)
+	}
+	if os.Getenv("SPINUP_PROXY_PROTOCOL") == "true" {
+		// the load balancer's PROXY header carries the client address, which then becomes the
+		// RemoteAddr of requests. Connections without one are rejected.
+		ln = &proxyproto.Listener{
+			Listener: ln,
+			Policy: func(net.Addr) (proxyproto.Policy, error) {
+				return proxyproto.REQUIRE, nil
+			},
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		log.Println("INFO: requiring the PROXY protocol on every connection")
+	}
+	// /streamlogs isn't cut off by WriteTimeout: upgrading to a websocket clears the deadlines
+	// of the connection and the log writer sets its own deadline for every message.
+	srv := &http.Server{
+		Handler:           c.Handler(api.RequestID(api.LogBodies(mux))),
+		ReadHeaderTimeout: durationEnv("SPINUP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       durationEnv("SPINUP_READ_TIMEOUT", 30*time.Second),
+		// a create can wait for a free slot, pull images and start containers
+		WriteTimeout: durationEnv("SPINUP_WRITE_TIMEOUT", 5*time.Minute),
+		IdleTimeout:  durationEnv("SPINUP_IDLE_TIMEOUT", 2*time.Minute),
+	}
+	shutdownTimeout := durationEnv("SPINUP_SHUTDOWN_TIMEOUT", 30*time.Second)
+	done := make(chan struct{})
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("INFO: shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		// new creates get 503 while the ones in flight finish, everything else is still served
+		if err := api.Drain(ctx); err != nil {
+			log.Printf("ERROR: waiting for creates in flight %v", err)
+		}
+		// closing the listener also removes the socket file of a unix listener
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("ERROR: shutting down server %v", err)
+		}
+		close(done)
+	}()
+	log.Printf("INFO: listening on %s", addr)
+	if err = srv.Serve(ln); err != http.ErrServerClosed {
 		log.Fatalf("FATAL: starting server %v", err)
 	}
+	<-done
+}
+
+// durationEnv parses the environment variable name as a duration, def when it's unset.
+func durationEnv(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("FATAL: %s must be a positive duration, got %q", name, v)
+	}
+	return d
+}
+
+// listen listens on a TCP address like :4434, or on a unix socket given as unix:/run/spinup.sock.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	// a socket left behind by a crash makes listen fail, unless another spinup still serves it
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// the reverse proxy connects through the group
+	if err = os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }